@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+var errCurrentPasswordInvalid = errors.New("current password is invalid")
+
+type UpdateProfileRequest struct {
+	Username *string `json:"username"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+type ChangeEmailRequest struct {
+	NewEmail        string `json:"newEmail"`
+	CurrentPassword string `json:"currentPassword"`
+}
+
+// startAccountSpan starts the handler span for a /users/me endpoint and
+// returns the authenticated user, writing the 401 itself when there is none.
+func startAccountSpan(w http.ResponseWriter, r *http.Request, name, route, operation string) (context.Context, trace.Span, *User, bool) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+
+	ctx, span := tracer.Start(ctx, name,
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.String("component", "auth_service"),
+			attribute.String("operation", operation),
+		),
+	)
+
+	if httpRequestCount != nil {
+		httpRequestCount.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("endpoint", operation),
+			attribute.String("method", r.Method),
+			attribute.String("component", "auth_service"),
+		))
+	}
+
+	user, ok := authUserFromContext(ctx)
+	if !ok {
+		span.SetStatus(codes.Error, "Unauthenticated request")
+		writeAuthError(w, http.StatusUnauthorized, "Authentication required", "MISSING_TOKEN")
+		return ctx, span, nil, false
+	}
+	span.SetAttributes(attribute.Int("user_id", user.ID))
+	return ctx, span, user, true
+}
+
+// userFieldTaken applies the uniqueness check registerUser does for email
+// and username, ignoring the user being updated.
+func userFieldTaken(ctx context.Context, column, value string, excludeUserID int) (bool, error) {
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	ctx, span := tracer.Start(ctx, "auth.account.check_"+column,
+		trace.WithAttributes(
+			attribute.String("operation", "check_"+column+"_exists"),
+			attribute.String("table", "users"),
+		),
+	)
+	defer span.End()
+
+	var existing User
+	err := DB.WithContext(ctx).Where(column+" = ? AND id <> ?", value, excludeUserID).First(&existing).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		span.SetStatus(codes.Ok, "Value available")
+		return false, nil
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Database error")
+		return false, err
+	}
+	span.SetStatus(codes.Error, "Value already exists")
+	return true, nil
+}
+
+// checkCurrentPassword guards password and email changes. Failures count
+// against the same throttle as logins so a stolen session cannot be used to
+// guess the password. Accounts created through OIDC have no password to
+// check and are told to set one first.
+func checkCurrentPassword(ctx context.Context, w http.ResponseWriter, r *http.Request, span trace.Span, user *User, password string) bool {
+	if user.Password == "" {
+		span.SetStatus(codes.Error, "No password set")
+		Logger.InfoContext(ctx, "Account change rejected - no password set",
+			slog.Int("user_id", user.ID),
+		)
+		writeAuthError(w, http.StatusConflict, "This account has no password, set one first", "NO_PASSWORD")
+		return false
+	}
+
+	throttleKey := normalizeLoginEmail(user.Email)
+	if allowed, _, retryAfter := loginLimiter.allow(throttleKey, remoteHost(r.RemoteAddr)); !allowed {
+		span.SetStatus(codes.Error, "Too many attempts")
+		w.Header().Set("Retry-After", fmt.Sprint(int(retryAfter.Seconds())+1))
+		writeAuthError(w, http.StatusTooManyRequests, "Too many attempts, try again later", "RATE_LIMITED")
+		return false
+	}
+
+	if password == "" || !verifyPassword(user.Password, password) {
+		loginLimiter.recordFailure(throttleKey)
+		span.RecordError(errCurrentPasswordInvalid)
+		span.SetStatus(codes.Error, "Invalid current password")
+		Logger.InfoContext(ctx, "Account change rejected - invalid current password",
+			slog.Int("user_id", user.ID),
+		)
+		writeAuthError(w, http.StatusForbidden, "Current password is incorrect", "INVALID_CURRENT_PASSWORD")
+		return false
+	}
+	return true
+}
+
+func writeAccountJSON(w http.ResponseWriter, status int, resp AuthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func getCurrentUser(w http.ResponseWriter, r *http.Request) {
+	_, span, user, ok := startAccountSpan(w, r, "auth.account.get", "/users/me", "account_get")
+	defer span.End()
+	if !ok {
+		return
+	}
+
+	span.SetStatus(codes.Ok, "Profile loaded")
+	writeAccountJSON(w, http.StatusOK, AuthResponse{Success: true, Message: "Profile loaded", User: user})
+}
+
+func updateCurrentUser(w http.ResponseWriter, r *http.Request) {
+	ctx, span, user, ok := startAccountSpan(w, r, "auth.account.update", "/users/me", "account_update")
+	defer span.End()
+	if !ok {
+		return
+	}
+
+	var req UpdateProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		span.SetStatus(codes.Error, "Invalid JSON")
+		writeAuthError(w, http.StatusBadRequest, "Invalid JSON payload", "INVALID_REQUEST")
+		return
+	}
+	if req.Username == nil {
+		span.SetStatus(codes.Ok, "Nothing to update")
+		writeAccountJSON(w, http.StatusOK, AuthResponse{Success: true, Message: "Nothing to update", User: user})
+		return
+	}
+
+	username := strings.TrimSpace(*req.Username)
+	var v Validator
+	v.Username("username", username)
+	if !v.Valid() {
+		recordValidationFailure(span, v.Errors)
+		writeValidationError(w, v.Errors)
+		return
+	}
+	if username == user.Username {
+		span.SetStatus(codes.Ok, "Username unchanged")
+		writeAccountJSON(w, http.StatusOK, AuthResponse{Success: true, Message: "Username unchanged", User: user})
+		return
+	}
+
+	taken, err := userFieldTaken(ctx, "username", username, user.ID)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Database error")
+		writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+		return
+	}
+	if taken {
+		span.SetStatus(codes.Error, "Username already exists")
+		Logger.InfoContext(ctx, "Username change failed - username already taken",
+			slog.Int("user_id", user.ID),
+		)
+		writeAuthError(w, http.StatusConflict, "Username already taken", "USERNAME_TAKEN")
+		return
+	}
+
+	previous := user.Username
+	err = DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("username", username).Error; err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, r, user.ID, user.ID, auditUsernameChanged, map[string]interface{}{
+			"previousUsername": previous,
+			"newUsername":      username,
+		})
+	})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Database error")
+		Logger.ErrorContext(ctx, "Username change failed",
+			slog.Int("user_id", user.ID),
+			slog.String("error", err.Error()),
+		)
+		writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+		return
+	}
+
+	span.SetStatus(codes.Ok, "Username changed")
+	Logger.InfoContext(ctx, "Username changed",
+		slog.Int("user_id", user.ID),
+	)
+	writeAccountJSON(w, http.StatusOK, AuthResponse{Success: true, Message: "Profile updated", User: user})
+}
+
+func changePassword(w http.ResponseWriter, r *http.Request) {
+	ctx, span, user, ok := startAccountSpan(w, r, "auth.account.change_password", "/users/me/password", "account_change_password")
+	defer span.End()
+	if !ok {
+		return
+	}
+
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.NewPassword == "" {
+		span.SetStatus(codes.Error, "Missing required fields")
+		writeAuthError(w, http.StatusBadRequest, "Current and new password are required", "MISSING_FIELDS")
+		return
+	}
+	var v Validator
+	v.Password("newPassword", req.NewPassword, user.Username, user.Email)
+	if !v.Valid() {
+		recordValidationFailure(span, v.Errors)
+		writeValidationError(w, v.Errors)
+		return
+	}
+	// An account created through OIDC sets its first password without a
+	// current one.
+	firstPassword := user.Password == ""
+	if !firstPassword && !checkCurrentPassword(ctx, w, r, span, user, req.CurrentPassword) {
+		return
+	}
+
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	_, hashSpan := tracer.Start(ctx, "auth.account.change_password.hash_password",
+		trace.WithAttributes(
+			attribute.String("operation", "password_hashing"),
+			attribute.String("password.algorithm", passwordHashAlgorithm),
+		),
+	)
+	hashed, err := hashPassword(req.NewPassword)
+	if err != nil {
+		hashSpan.RecordError(err)
+		hashSpan.SetStatus(codes.Error, "Password hashing failed")
+		hashSpan.End()
+		span.SetStatus(codes.Error, "Password hashing failed")
+		writeAuthError(w, http.StatusInternalServerError, "Password change failed", "HASH_FAILED")
+		return
+	}
+	hashSpan.SetStatus(codes.Ok, "Password hashed successfully")
+	hashSpan.End()
+
+	// The session making the change stays signed in; every other session is
+	// revoked in case the old password was compromised.
+	currentSession, _ := authSessionFromContext(ctx)
+	var revoked int64
+	err = DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("password", hashed).Error; err != nil {
+			return err
+		}
+		var err error
+		if revoked, err = revokeOtherSessions(tx, user.ID, currentSession); err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, r, user.ID, user.ID, auditPasswordChanged, map[string]interface{}{
+			"sessionsRevoked": revoked,
+			"firstPassword":   firstPassword,
+		})
+	})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Database error")
+		Logger.ErrorContext(ctx, "Password change failed",
+			slog.Int("user_id", user.ID),
+			slog.String("error", err.Error()),
+		)
+		writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+		return
+	}
+	loginLimiter.recordSuccess(normalizeLoginEmail(user.Email))
+
+	span.SetAttributes(
+		attribute.Int64("sessions.revoked", revoked),
+		attribute.Bool("password.first", firstPassword),
+	)
+	span.SetStatus(codes.Ok, "Password changed")
+	Logger.InfoContext(ctx, "Password changed",
+		slog.Int("user_id", user.ID),
+		slog.Int64("sessions_revoked", revoked),
+		slog.Bool("first_password", firstPassword),
+	)
+	writeAccountJSON(w, http.StatusOK, AuthResponse{Success: true, Message: "Password changed", User: user})
+}
+
+func changeEmail(w http.ResponseWriter, r *http.Request) {
+	ctx, span, user, ok := startAccountSpan(w, r, "auth.account.change_email", "/users/me/email", "account_change_email")
+	defer span.End()
+	if !ok {
+		return
+	}
+
+	var req ChangeEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.NewEmail) == "" {
+		span.SetStatus(codes.Error, "Missing required fields")
+		writeAuthError(w, http.StatusBadRequest, "New email and current password are required", "MISSING_FIELDS")
+		return
+	}
+	newEmail := strings.TrimSpace(req.NewEmail)
+	var v Validator
+	v.Email("newEmail", newEmail)
+	if !v.Valid() {
+		recordValidationFailure(span, v.Errors)
+		writeValidationError(w, v.Errors)
+		return
+	}
+	if newEmail == user.Email {
+		span.SetStatus(codes.Error, "Email unchanged")
+		writeAuthError(w, http.StatusBadRequest, "New email is the same as the current one", "EMAIL_UNCHANGED")
+		return
+	}
+	if !checkCurrentPassword(ctx, w, r, span, user, req.CurrentPassword) {
+		return
+	}
+
+	taken, err := userFieldTaken(ctx, "email", newEmail, user.ID)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Database error")
+		writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+		return
+	}
+	if taken {
+		span.SetStatus(codes.Error, "Email already exists")
+		writeAuthError(w, http.StatusConflict, "Email already in use", "EMAIL_TAKEN")
+		return
+	}
+
+	err = DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("pending_email", newEmail).Error; err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, r, user.ID, user.ID, auditEmailChangeRequested, map[string]interface{}{
+			"newEmail": newEmail,
+		})
+	})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Database error")
+		writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+		return
+	}
+
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	mailCtx, mailSpan := tracer.Start(ctx, "auth.account.change_email.send_verification",
+		trace.WithAttributes(attribute.String("operation", "send_email_change_verification")),
+	)
+	err = sendEmailChangeVerification(mailCtx, user, newEmail)
+	if err != nil {
+		mailSpan.RecordError(err)
+		mailSpan.SetStatus(codes.Error, "Verification email failed")
+		mailSpan.End()
+		span.SetStatus(codes.Error, "Verification email failed")
+		Logger.ErrorContext(ctx, "Failed to send email change verification",
+			slog.Int("user_id", user.ID),
+			slog.String("error", err.Error()),
+		)
+		writeAuthError(w, http.StatusBadGateway, "Could not send the verification email, try again later", "MAIL_FAILED")
+		return
+	}
+	mailSpan.SetStatus(codes.Ok, "Verification email sent")
+	mailSpan.End()
+
+	span.SetStatus(codes.Ok, "Email change requested")
+	Logger.InfoContext(ctx, "Email change requested",
+		slog.Int("user_id", user.ID),
+	)
+	writeAccountJSON(w, http.StatusAccepted, AuthResponse{
+		Success: true,
+		Message: "Open the link sent to the new address to finish changing your email",
+		User:    user,
+	})
+}
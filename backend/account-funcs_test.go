@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveAccount calls handler as user, the way AuthMiddleware would.
+func serveAccount(handler http.HandlerFunc, user *User, body interface{}) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, "/users/me", strings.NewReader(string(payload)))
+	req = req.WithContext(context.WithValue(req.Context(), authUserKey, user))
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestChangePasswordSetsFirstPasswordOfOIDCAccount(t *testing.T) {
+	setupTestDB(t)
+	setVar(t, &loginLimiter, newLoginThrottle(loginRateWindow, loginRateLimitPerUser, loginRateLimitPerIP))
+
+	user := User{Username: "alice", Email: "alice@example.com"}
+	if err := DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serveAccount(changePassword, &user, ChangePasswordRequest{NewPassword: "correct-horse-battery-9"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("changePassword returned %d: %s", rec.Code, rec.Body)
+	}
+	var stored User
+	if err := DB.First(&stored, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !verifyPassword(stored.Password, "correct-horse-battery-9") {
+		t.Error("new password was not stored")
+	}
+
+	// From now on the current password is required.
+	rec = serveAccount(changePassword, &stored, ChangePasswordRequest{NewPassword: "another-long-password-7"})
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("second change without the current password returned %d, want 403: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestChangeEmailRequiresPassword(t *testing.T) {
+	setupTestDB(t)
+
+	user := User{Username: "alice", Email: "alice@example.com"}
+	if err := DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serveAccount(changeEmail, &user, ChangeEmailRequest{NewEmail: "alice@example.org"})
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("changeEmail returned %d, want 409: %s", rec.Code, rec.Body)
+	}
+	var resp ErrorResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.Error != "NO_PASSWORD" {
+		t.Errorf("error code = %q, want NO_PASSWORD", resp.Error)
+	}
+	var stored User
+	if err := DB.First(&stored, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.PendingEmail != "" {
+		t.Errorf("pending email = %q, want none", stored.PendingEmail)
+	}
+}
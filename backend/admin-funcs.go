@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const (
+	adminDefaultPageSize = 50
+	adminMaxPageSize     = 200
+)
+
+type AdminUserListResponse struct {
+	Success bool   `json:"success"`
+	Users   []User `json:"users"`
+	Total   int64  `json:"total"`
+	Limit   int    `json:"limit"`
+	Offset  int    `json:"offset"`
+}
+
+type AdminUserResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+	User    *User  `json:"user,omitempty"`
+}
+
+type AdminWatchlistResponse struct {
+	Success   bool          `json:"success"`
+	UserID    int           `json:"userId"`
+	Watchlist []UserSymbols `json:"watchlist"`
+}
+
+type AdminAuditResponse struct {
+	Success bool         `json:"success"`
+	Events  []AuditEvent `json:"events"`
+	Total   int64        `json:"total"`
+	Limit   int          `json:"limit"`
+	Offset  int          `json:"offset"`
+}
+
+type DisableUserRequest struct {
+	Reason string `json:"reason"`
+}
+
+type UpdateRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// startAdminSpan starts the handler span and counts the request, the same
+// way for every admin endpoint.
+func startAdminSpan(r *http.Request, name, route, operation string) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+
+	ctx, span := tracer.Start(ctx, name,
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.String("component", "admin_service"),
+			attribute.String("operation", operation),
+		),
+	)
+
+	if admin, ok := authUserFromContext(ctx); ok {
+		span.SetAttributes(attribute.Int("admin.user_id", admin.ID))
+	}
+
+	if httpRequestCount != nil {
+		httpRequestCount.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("endpoint", route),
+			attribute.String("method", r.Method),
+			attribute.String("component", "admin_service"),
+		))
+	}
+	return ctx, span
+}
+
+// loadTargetUser resolves the {id} route variable to a user, writing the
+// error response itself when it cannot.
+func loadTargetUser(ctx context.Context, w http.ResponseWriter, r *http.Request, span trace.Span) (*User, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		span.SetStatus(codes.Error, "Invalid user id")
+		writeAuthError(w, http.StatusBadRequest, "Invalid user id", "INVALID_REQUEST")
+		return nil, false
+	}
+	span.SetAttributes(attribute.Int("target.user_id", id))
+
+	var user User
+	err = DB.WithContext(ctx).First(&user, "id = ?", id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		span.SetStatus(codes.Error, "User not found")
+		writeAuthError(w, http.StatusNotFound, "User not found", "USER_NOT_FOUND")
+		return nil, false
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Database error")
+		writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+		return nil, false
+	}
+	return &user, true
+}
+
+// adminPage reads the limit and offset query parameters of list endpoints.
+func adminPage(query url.Values) (int, int) {
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = adminDefaultPageSize
+	}
+	if limit > adminMaxPageSize {
+		limit = adminMaxPageSize
+	}
+	offset, err := strconv.Atoi(query.Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminListUsers(w http.ResponseWriter, r *http.Request) {
+	ctx, span := startAdminSpan(r, "admin.users.list", "/admin/users", "list_users")
+	defer span.End()
+
+	query := r.URL.Query()
+	limit, offset := adminPage(query)
+
+	db := DB.WithContext(ctx).Model(&User{})
+	if search := strings.TrimSpace(query.Get("q")); search != "" {
+		pattern := "%" + strings.ToLower(search) + "%"
+		db = db.Where("LOWER(username) LIKE ? OR LOWER(email) LIKE ?", pattern, pattern)
+		span.SetAttributes(attribute.Bool("search", true))
+	}
+	if role := query.Get("role"); role != "" {
+		db = db.Where("role = ?", role)
+	}
+	switch query.Get("status") {
+	case "disabled":
+		db = db.Where("disabled_at IS NOT NULL")
+	case "active":
+		db = db.Where("disabled_at IS NULL")
+	}
+
+	var total int64
+	users := []User{}
+	err := db.Count(&total).Error
+	if err == nil {
+		err = db.Order("id").Limit(limit).Offset(offset).Find(&users).Error
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Database error")
+		Logger.ErrorContext(ctx, "Failed to list users",
+			slog.String("error", err.Error()),
+		)
+		writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("result.total", total),
+		attribute.Int("result.count", len(users)),
+	)
+	span.SetStatus(codes.Ok, "Users listed")
+
+	writeAdminJSON(w, AdminUserListResponse{
+		Success: true,
+		Users:   users,
+		Total:   total,
+		Limit:   limit,
+		Offset:  offset,
+	})
+}
+
+func adminGetUser(w http.ResponseWriter, r *http.Request) {
+	ctx, span := startAdminSpan(r, "admin.users.get", "/admin/users/{id}", "get_user")
+	defer span.End()
+
+	user, ok := loadTargetUser(ctx, w, r, span)
+	if !ok {
+		return
+	}
+
+	span.SetStatus(codes.Ok, "User loaded")
+	writeAdminJSON(w, AdminUserResponse{Success: true, User: user})
+}
+
+func adminDisableUser(w http.ResponseWriter, r *http.Request) {
+	ctx, span := startAdminSpan(r, "admin.users.disable", "/admin/users/{id}/disable", "disable_user")
+	defer span.End()
+
+	admin, _ := authUserFromContext(ctx)
+	user, ok := loadTargetUser(ctx, w, r, span)
+	if !ok {
+		return
+	}
+	if user.ID == admin.ID {
+		span.SetStatus(codes.Error, "Cannot disable own account")
+		writeAuthError(w, http.StatusConflict, "You cannot disable your own account", "CANNOT_DISABLE_SELF")
+		return
+	}
+
+	var req DisableUserRequest
+	json.NewDecoder(r.Body).Decode(&req)
+	req.Reason = strings.TrimSpace(req.Reason)
+	if len(req.Reason) > 255 {
+		req.Reason = req.Reason[:255]
+	}
+
+	now := time.Now().UTC()
+	var revoked int64
+	err := DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Updates(map[string]interface{}{
+			"disabled_at":     now,
+			"disabled_reason": req.Reason,
+		}).Error; err != nil {
+			return err
+		}
+		var err error
+		revoked, err = revokeUserSessions(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Database error")
+		Logger.ErrorContext(ctx, "Failed to disable user",
+			slog.Int("user_id", user.ID),
+			slog.String("error", err.Error()),
+		)
+		writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+		return
+	}
+
+	span.SetAttributes(attribute.Int64("sessions.revoked", revoked))
+	span.SetStatus(codes.Ok, "User disabled")
+	Logger.WarnContext(ctx, "User account disabled by admin",
+		slog.Int("user_id", user.ID),
+		slog.Int("admin_user_id", admin.ID),
+		slog.String("reason", req.Reason),
+		slog.Int64("sessions_revoked", revoked),
+	)
+
+	writeAdminJSON(w, AdminUserResponse{Success: true, Message: "User disabled", User: user})
+}
+
+func adminEnableUser(w http.ResponseWriter, r *http.Request) {
+	ctx, span := startAdminSpan(r, "admin.users.enable", "/admin/users/{id}/enable", "enable_user")
+	defer span.End()
+
+	admin, _ := authUserFromContext(ctx)
+	user, ok := loadTargetUser(ctx, w, r, span)
+	if !ok {
+		return
+	}
+
+	err := DB.WithContext(ctx).Model(user).Updates(map[string]interface{}{
+		"disabled_at":     nil,
+		"disabled_reason": "",
+	}).Error
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Database error")
+		writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+		return
+	}
+
+	span.SetStatus(codes.Ok, "User enabled")
+	Logger.InfoContext(ctx, "User account enabled by admin",
+		slog.Int("user_id", user.ID),
+		slog.Int("admin_user_id", admin.ID),
+	)
+
+	writeAdminJSON(w, AdminUserResponse{Success: true, Message: "User enabled", User: user})
+}
+
+func adminUpdateRole(w http.ResponseWriter, r *http.Request) {
+	ctx, span := startAdminSpan(r, "admin.users.update_role", "/admin/users/{id}/role", "update_role")
+	defer span.End()
+
+	admin, _ := authUserFromContext(ctx)
+	user, ok := loadTargetUser(ctx, w, r, span)
+	if !ok {
+		return
+	}
+
+	var req UpdateRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validRole(req.Role) {
+		span.SetStatus(codes.Error, "Invalid role")
+		writeAuthError(w, http.StatusBadRequest, "Role must be one of: user, admin", "INVALID_ROLE")
+		return
+	}
+	if user.ID == admin.ID && req.Role != roleAdmin {
+		span.SetStatus(codes.Error, "Cannot demote own account")
+		writeAuthError(w, http.StatusConflict, "You cannot remove your own admin role", "CANNOT_DEMOTE_SELF")
+		return
+	}
+
+	previous := user.Role
+	if err := DB.WithContext(ctx).Model(user).Update("role", req.Role).Error; err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Database error")
+		writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("role.previous", previous),
+		attribute.String("role.new", req.Role),
+	)
+	span.SetStatus(codes.Ok, "Role updated")
+	Logger.WarnContext(ctx, "User role changed by admin",
+		slog.Int("user_id", user.ID),
+		slog.Int("admin_user_id", admin.ID),
+		slog.String("previous_role", previous),
+		slog.String("new_role", req.Role),
+	)
+
+	writeAdminJSON(w, AdminUserResponse{Success: true, Message: "Role updated", User: user})
+}
+
+func adminLogoutUser(w http.ResponseWriter, r *http.Request) {
+	ctx, span := startAdminSpan(r, "admin.users.logout", "/admin/users/{id}/logout", "force_logout")
+	defer span.End()
+
+	admin, _ := authUserFromContext(ctx)
+	user, ok := loadTargetUser(ctx, w, r, span)
+	if !ok {
+		return
+	}
+
+	revoked, err := revokeUserSessions(DB.WithContext(ctx), user.ID)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Database error")
+		writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+		return
+	}
+
+	span.SetAttributes(attribute.Int64("sessions.revoked", revoked))
+	span.SetStatus(codes.Ok, "User logged out")
+	Logger.WarnContext(ctx, "User sessions revoked by admin",
+		slog.Int("user_id", user.ID),
+		slog.Int("admin_user_id", admin.ID),
+		slog.Int64("sessions_revoked", revoked),
+	)
+
+	writeAdminJSON(w, AdminUserResponse{Success: true, Message: "All sessions revoked", User: user})
+}
+
+func adminGetWatchlist(w http.ResponseWriter, r *http.Request) {
+	ctx, span := startAdminSpan(r, "admin.users.watchlist", "/admin/users/{id}/watchlist", "get_user_watchlist")
+	defer span.End()
+
+	user, ok := loadTargetUser(ctx, w, r, span)
+	if !ok {
+		return
+	}
+
+	watchlist := []UserSymbols{}
+	if err := DB.WithContext(ctx).Where("user_id = ?", user.ID).Find(&watchlist).Error; err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Database error")
+		writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+		return
+	}
+
+	span.SetAttributes(attribute.Int("result.count", len(watchlist)))
+	span.SetStatus(codes.Ok, "Watchlist loaded")
+
+	writeAdminJSON(w, AdminWatchlistResponse{
+		Success:   true,
+		UserID:    user.ID,
+		Watchlist: watchlist,
+	})
+}
+
+// adminListAuditEvents queries the audit trail, newest first. Filters are
+// userId, action (a trailing * matches a prefix, e.g. auth.*), outcome,
+// remoteAddr (host, any port) and an RFC 3339 since/until range.
+func adminListAuditEvents(w http.ResponseWriter, r *http.Request) {
+	ctx, span := startAdminSpan(r, "admin.audit.list", "/admin/audit", "list_audit_events")
+	defer span.End()
+
+	query := r.URL.Query()
+	limit, offset := adminPage(query)
+
+	db := DB.WithContext(ctx).Model(&AuditEvent{})
+	if v := query.Get("userId"); v != "" {
+		userID, err := strconv.Atoi(v)
+		if err != nil {
+			span.SetStatus(codes.Error, "Invalid user id")
+			writeAuthError(w, http.StatusBadRequest, "userId must be a number", "INVALID_REQUEST")
+			return
+		}
+		db = db.Where("user_id = ?", userID)
+	}
+	if action := query.Get("action"); action != "" {
+		if prefix, ok := strings.CutSuffix(action, "*"); ok {
+			db = db.Where("action LIKE ?", prefix+"%")
+		} else {
+			db = db.Where("action = ?", action)
+		}
+	}
+	if outcome := query.Get("outcome"); outcome != "" {
+		db = db.Where("outcome = ?", outcome)
+	}
+	if addr := query.Get("remoteAddr"); addr != "" {
+		db = db.Where("remote_addr = ? OR remote_addr LIKE ?", addr, addr+":%")
+	}
+	for _, bound := range []struct{ param, clause string }{
+		{"since", "created_at >= ?"},
+		{"until", "created_at < ?"},
+	} {
+		v := query.Get(bound.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			span.SetStatus(codes.Error, "Invalid time range")
+			writeAuthError(w, http.StatusBadRequest, bound.param+" must be an RFC 3339 timestamp", "INVALID_REQUEST")
+			return
+		}
+		db = db.Where(bound.clause, t.UTC())
+	}
+
+	var total int64
+	events := []AuditEvent{}
+	err := db.Count(&total).Error
+	if err == nil {
+		err = db.Order("id DESC").Limit(limit).Offset(offset).Find(&events).Error
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Database error")
+		Logger.ErrorContext(ctx, "Failed to list audit events",
+			slog.String("error", err.Error()),
+		)
+		writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int64("result.total", total),
+		attribute.Int("result.count", len(events)),
+	)
+	span.SetStatus(codes.Ok, "Audit events listed")
+
+	writeAdminJSON(w, AdminAuditResponse{
+		Success: true,
+		Events:  events,
+		Total:   total,
+		Limit:   limit,
+		Offset:  offset,
+	})
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // intraday series are in US/Eastern; the runtime image has no zoneinfo
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ALPHAVANTAGE_API_KEY takes a comma-separated list; calls are spread over
+// the keys, each paced on its own. It has no default: the provider refuses to
+// start without a key.
+var (
+	alphaVantageBaseURL = getEnv("ALPHAVANTAGE_BASE_URL", "https://www.alphavantage.co")
+	alphaVantageAPIKeys = getEnv("ALPHAVANTAGE_API_KEY", "")
+)
+
+type alphaVantageProvider struct {
+	client  *http.Client
+	baseURL string
+	quota   *alphaVantageQuota
+}
+
+func newAlphaVantageProvider(client *http.Client) (*alphaVantageProvider, error) {
+	var keys []string
+	for _, key := range strings.Split(alphaVantageAPIKeys, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("ALPHAVANTAGE_API_KEY is not set")
+	}
+	return &alphaVantageProvider{
+		client:  client,
+		baseURL: strings.TrimRight(alphaVantageBaseURL, "/"),
+		quota:   newAlphaVantageQuota(keys),
+	}, nil
+}
+
+func (p *alphaVantageProvider) Name() string {
+	return "alphavantage"
+}
+
+func (p *alphaVantageProvider) queryURL(function string, params url.Values, apiKey string) string {
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("function", function)
+	params.Set("apikey", apiKey)
+	return p.baseURL + "/query?" + params.Encode()
+}
+
+// fetch performs the call with a key from the quota, waiting for one before
+// every attempt. The call's operation is the AlphaVantage function.
+func (p *alphaVantageProvider) fetch(ctx context.Context, call providerCall, params url.Values) ([]byte, error) {
+	call.before = func(ctx context.Context, c *providerCall) error {
+		key, err := p.quota.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		c.url = p.queryURL(c.operation, params, key.key)
+		c.check = p.quota.checkPayload(key, c.operation)
+		trace.SpanFromContext(ctx).SetAttributes(attribute.Int("api.key_index", key.index))
+		return nil
+	}
+	return call.fetch(ctx, p.client)
+}
+
+// parseListingDate reads the YYYY-MM-DD dates of LISTING_STATUS, where a
+// missing date is written as "null".
+func parseListingDate(value string) *time.Time {
+	t, err := time.Parse("2006-01-02", strings.TrimSpace(value))
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// ListSymbols returns the listings from the LISTING_STATUS CSV, whose columns
+// are symbol, name, exchange, assetType, ipoDate, delistingDate and status.
+func (p *alphaVantageProvider) ListSymbols(ctx context.Context) ([]StockListing, error) {
+	call := providerCall{
+		api:       "alphavantage",
+		operation: "LISTING_STATUS",
+		spanName:  "alphaVantage.LISTING_STATUS",
+	}
+	body, err := p.fetch(ctx, call, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	ctx, readCsvSpan := tracer.Start(ctx, "processCsvResponse")
+	defer readCsvSpan.End()
+	readCsvSpan.AddEvent("Starting CSV parsing")
+
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.Read()
+	var listings []StockListing
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			readCsvSpan.SetStatus(codes.Error, fmt.Sprintf("CSV read error: %v", err))
+			readCsvSpan.RecordError(err)
+			Logger.ErrorContext(ctx, "CSV parsing error", "error", err)
+			return nil, err
+		}
+		if len(record) < 7 {
+			continue
+		}
+		listings = append(listings, StockListing{
+			Symbol:        strings.TrimSpace(record[0]),
+			Name:          strings.TrimSpace(record[1]),
+			Exchange:      strings.TrimSpace(record[2]),
+			AssetType:     strings.TrimSpace(record[3]),
+			IPODate:       parseListingDate(record[4]),
+			DelistingDate: parseListingDate(record[5]),
+			Status:        strings.TrimSpace(record[6]),
+		})
+	}
+	readCsvSpan.SetAttributes(attribute.Int("symbols.count", len(listings)))
+	readCsvSpan.SetStatus(codes.Ok, "CSV parsing complete")
+
+	Logger.InfoContext(ctx, "CSV parsing complete", "symbols_count", len(listings))
+	return listings, nil
+}
+
+const (
+	// alphaVantageCompactBars is how many of the latest bars
+	// outputsize=compact returns.
+	alphaVantageCompactBars = 100
+	// alphaVantageCompactDays is how many calendar days back the compact
+	// daily series is sure to reach. Daily bars fall on trading days, five
+	// a week, so 100 of them span 20 weeks less the weekdays at either end.
+	alphaVantageCompactDays = alphaVantageCompactBars*7/5 - 5
+	// alphaVantageIntradayDays is how far back full intraday output reaches.
+	alphaVantageIntradayDays = 30
+)
+
+// seriesFunction maps an interval to the AlphaVantage function serving it.
+// Intraday and daily series come in compact and full sizes; full is only
+// requested when the range starts before the compact bars could reach.
+// Weekly and monthly series always cover the whole history. Full intraday
+// output only reaches back about a month, so older intraday ranges are
+// rejected rather than served with their start missing.
+func seriesFunction(query SeriesQuery) (string, url.Values, error) {
+	params := url.Values{}
+	var function string
+	switch query.Interval {
+	case "daily":
+		function = "TIME_SERIES_DAILY"
+	case "weekly":
+		return "TIME_SERIES_WEEKLY", params, nil
+	case "monthly":
+		return "TIME_SERIES_MONTHLY", params, nil
+	default:
+		function = "TIME_SERIES_INTRADAY"
+		params.Set("interval", query.Interval)
+		if !query.From.IsZero() && query.From.Before(time.Now().AddDate(0, 0, -alphaVantageIntradayDays)) {
+			return "", nil, fmt.Errorf("%w: %s stock bars are only available for the last %d days", errUnsupportedQuery, query.Interval, alphaVantageIntradayDays)
+		}
+	}
+
+	// Bars only fall on trading time, so 100 bars span at least 100 bar
+	// lengths of calendar time. Daily ranges are counted in days.
+	full := !query.From.IsZero() && time.Since(query.From) > alphaVantageCompactBars*seriesIntervals[query.Interval]
+	if query.Interval == "daily" {
+		full = !query.From.IsZero() && dayStart(query.From).Before(dayStart(time.Now()).AddDate(0, 0, -alphaVantageCompactDays))
+	}
+	if full {
+		params.Set("outputsize", "full")
+	} else {
+		params.Set("outputsize", "compact")
+	}
+	return function, params, nil
+}
+
+// Series returns the series of a symbol for the query's interval as candles.
+func (p *alphaVantageProvider) Series(ctx context.Context, symbol string, query SeriesQuery) (*Quote, error) {
+	function, params, err := seriesFunction(query)
+	if err != nil {
+		return nil, err
+	}
+	params.Set("symbol", symbol)
+	call := providerCall{
+		api:       "alphavantage",
+		operation: function,
+		spanName:  "alphaVantage." + function,
+		attrs: []attribute.KeyValue{
+			attribute.String("stock_symbol", symbol),
+			attribute.String("series.interval", query.Interval),
+			attribute.String("series.outputsize", params.Get("outputsize")),
+		},
+	}
+	body, err := p.fetch(ctx, call, params)
+	if err != nil {
+		return nil, err
+	}
+
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	ctx, responseSpan := tracer.Start(ctx, "processAPIresponse")
+	defer responseSpan.End()
+	responseSpan.AddEvent("Started decoding JSON")
+
+	candles, err := parseAlphaVantageSeries(body, p.Name())
+	if err != nil {
+		if !errors.Is(err, errUnknownSymbol) {
+			err = &PayloadError{Provider: p.Name(), Operation: call.operation, Reason: err.Error()}
+		}
+		responseSpan.SetStatus(codes.Error, fmt.Sprintf("Series read error: %v", err))
+		responseSpan.RecordError(err)
+		Logger.ErrorContext(ctx, "Failed to read time series for stock data", "error", err, "symbol", symbol)
+		return nil, err
+	}
+	responseSpan.SetAttributes(attribute.Int("candles.count", len(candles)))
+	responseSpan.SetStatus(codes.Ok, "JSON decoded")
+
+	return &Quote{
+		Symbol:   strings.ToUpper(symbol),
+		Type:     "STOCK",
+		Interval: query.Interval,
+		Currency: alphaVantageCurrency,
+		Source:   p.Name(),
+		Candles:  candles,
+		Raw:      body,
+	}, nil
+}
+
+// The series do not state a currency. LISTING_STATUS only covers US
+// exchanges, so prices are taken to be in US dollars.
+const alphaVantageCurrency = "USD"
+
+// parseAlphaVantageSeries reads any TIME_SERIES_* payload into candles, oldest
+// first. Daily and longer bars are keyed by date and kept as UTC midnight of
+// that date; intraday bars are read in the time zone given in the metadata.
+func parseAlphaVantageSeries(body []byte, source string) ([]Candle, error) {
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	var meta map[string]string
+	var series map[string]map[string]string
+	for key, value := range payload {
+		var err error
+		switch {
+		case key == "Meta Data":
+			err = json.Unmarshal(value, &meta)
+		case strings.Contains(key, "Time Series"):
+			err = json.Unmarshal(value, &series)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %q: %w", key, err)
+		}
+	}
+	if series == nil {
+		var message string
+		if json.Unmarshal(payload["Error Message"], &message) == nil && message != "" {
+			return nil, fmt.Errorf("%w: %s", errUnknownSymbol, message)
+		}
+		return nil, errors.New("response has no time series")
+	}
+
+	location := time.UTC
+	for key, value := range meta {
+		if strings.HasSuffix(key, "Time Zone") {
+			if loc, err := time.LoadLocation(value); err == nil {
+				location = loc
+			}
+		}
+	}
+
+	candles := make([]Candle, 0, len(series))
+	for stamp, bar := range series {
+		timestamp, err := time.Parse("2006-01-02", stamp)
+		if err != nil {
+			if timestamp, err = time.ParseInLocation("2006-01-02 15:04:05", stamp, location); err != nil {
+				return nil, fmt.Errorf("bad timestamp %q", stamp)
+			}
+		}
+
+		// Fields are numbered, e.g. "1. open"; only the name after the
+		// number matters.
+		values := make(map[string]float64, len(bar))
+		for field, raw := range bar {
+			if _, name, ok := strings.Cut(field, ". "); ok {
+				field = name
+			}
+			value, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad %s at %s: %q", field, stamp, raw)
+			}
+			values[field] = value
+		}
+		for _, field := range []string{"open", "high", "low", "close", "volume"} {
+			if _, ok := values[field]; !ok {
+				return nil, fmt.Errorf("missing %s at %s", field, stamp)
+			}
+		}
+
+		candles = append(candles, Candle{
+			Timestamp: timestamp.UTC(),
+			Open:      values["open"],
+			High:      values["high"],
+			Low:       values["low"],
+			Close:     values["close"],
+			Volume:    values["volume"],
+			Currency:  alphaVantageCurrency,
+			Source:    source,
+		})
+	}
+	sort.Slice(candles, func(i, j int) bool { return candles[i].Timestamp.Before(candles[j].Timestamp) })
+	return candles, nil
+}
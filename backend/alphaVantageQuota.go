@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// AlphaVantage keys are paced with a token bucket each:
+// ALPHAVANTAGE_REQUESTS_PER_MINUTE refills it and ALPHAVANTAGE_BURST sizes
+// it. Calls over the pace wait in a queue of at most ALPHAVANTAGE_MAX_QUEUE,
+// for no longer than ALPHAVANTAGE_MAX_WAIT or their context deadline. A key
+// that AlphaVantage reports as throttled rests for
+// ALPHAVANTAGE_THROTTLE_COOLDOWN.
+var (
+	alphaVantageRequestsPerMinute = getEnvInt("ALPHAVANTAGE_REQUESTS_PER_MINUTE", 5)
+	alphaVantageBurst             = getEnvInt("ALPHAVANTAGE_BURST", 1)
+	alphaVantageMaxQueue          = getEnvInt("ALPHAVANTAGE_MAX_QUEUE", 25)
+	alphaVantageMaxWait           = getEnvDuration("ALPHAVANTAGE_MAX_WAIT", 2*time.Minute)
+	alphaVantageThrottleCooldown  = getEnvDuration("ALPHAVANTAGE_THROTTLE_COOLDOWN", time.Minute)
+)
+
+// quotaKey is one API key with its own bucket.
+type quotaKey struct {
+	index         int
+	key           string
+	limiter       *rate.Limiter
+	cooldownUntil time.Time
+}
+
+// alphaVantageQuota hands out keys at the configured pace.
+type alphaVantageQuota struct {
+	mu      sync.Mutex
+	keys    []*quotaKey
+	waiting atomic.Int64
+}
+
+func newAlphaVantageQuota(keys []string) *alphaVantageQuota {
+	q := &alphaVantageQuota{}
+	limit := rate.Limit(float64(alphaVantageRequestsPerMinute) / 60)
+	for i, key := range keys {
+		q.keys = append(q.keys, &quotaKey{index: i, key: key, limiter: rate.NewLimiter(limit, alphaVantageBurst)})
+	}
+	return q
+}
+
+// reserve books the earliest slot across all keys and returns how long the
+// caller has to wait for it.
+func (q *alphaVantageQuota) reserve(now time.Time) (*quotaKey, *rate.Reservation, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var best *quotaKey
+	var bestReservation *rate.Reservation
+	var bestDelay time.Duration
+	for _, k := range q.keys {
+		reservation := k.limiter.ReserveN(now, 1)
+		if !reservation.OK() {
+			continue
+		}
+		delay := max(reservation.DelayFrom(now), k.cooldownUntil.Sub(now))
+		if best != nil && delay >= bestDelay {
+			reservation.CancelAt(now)
+			continue
+		}
+		if bestReservation != nil {
+			bestReservation.CancelAt(now)
+		}
+		best, bestReservation, bestDelay = k, reservation, delay
+	}
+	return best, bestReservation, bestDelay
+}
+
+// acquire waits for a key. Calls that would wait past their deadline, or
+// past ALPHAVANTAGE_MAX_WAIT, or that find the queue full, get a
+// RateLimitError right away instead.
+func (q *alphaVantageQuota) acquire(ctx context.Context) (*quotaKey, error) {
+	if q.waiting.Add(1) > int64(alphaVantageMaxQueue) {
+		q.waiting.Add(-1)
+		recordQuotaWait(ctx, 0, "queue_full")
+		return nil, &RateLimitError{Provider: "alphavantage", Reason: "request queue is full", RetryAfter: time.Minute / time.Duration(max(alphaVantageRequestsPerMinute, 1))}
+	}
+	defer q.waiting.Add(-1)
+	if alphaVantageQueueDepth != nil {
+		alphaVantageQueueDepth.Add(ctx, 1)
+		defer alphaVantageQueueDepth.Add(ctx, -1)
+	}
+
+	now := time.Now()
+	key, reservation, delay := q.reserve(now)
+	if key == nil {
+		recordQuotaWait(ctx, 0, "rejected")
+		return nil, &RateLimitError{Provider: "alphavantage", Reason: "no API key can serve the request"}
+	}
+
+	deadline, hasDeadline := ctx.Deadline()
+	if delay > alphaVantageMaxWait || (hasDeadline && now.Add(delay).After(deadline)) {
+		reservation.CancelAt(now)
+		recordQuotaWait(ctx, 0, "rejected")
+		return nil, &RateLimitError{Provider: "alphavantage", Reason: "quota exhausted", RetryAfter: delay}
+	}
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			reservation.Cancel()
+			recordQuotaWait(ctx, time.Since(now), "cancelled")
+			return nil, ctx.Err()
+		}
+	}
+
+	waited := time.Since(now)
+	recordQuotaWait(ctx, waited, "acquired")
+	trace.SpanFromContext(ctx).AddEvent("alphaVantage.quota_acquired", trace.WithAttributes(
+		attribute.Int("api.key_index", key.index),
+		attribute.Float64("quota.wait_sec", waited.Seconds()),
+	))
+	return key, nil
+}
+
+// throttled rests a key that AlphaVantage reported as over its quota.
+func (q *alphaVantageQuota) throttled(key *quotaKey) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	key.cooldownUntil = time.Now().Add(alphaVantageThrottleCooldown)
+}
+
+func recordQuotaWait(ctx context.Context, waited time.Duration, outcome string) {
+	if alphaVantageQueueWait != nil {
+		alphaVantageQueueWait.Record(ctx, waited.Seconds(), metric.WithAttributes(attribute.String("outcome", outcome)))
+	}
+}
+
+// AlphaVantage answers 200 with a "Note" or "Information" message instead of
+// data when a key is over its quota, but also when the request needs a
+// premium plan or the key is not accepted. Only the quota messages rest the
+// key.
+var (
+	alphaVantageRateLimitMessage = regexp.MustCompile(`(?i)rate limit|call frequency|(call|request)s? per (second|minute|day)|spreading out`)
+	alphaVantagePremiumMessage   = regexp.MustCompile(`(?i)premium (endpoint|feature|function)`)
+)
+
+// alphaVantageMessage returns the field and text of a payload that holds a
+// "Note" or "Information" message and no data.
+func alphaVantageMessage(body []byte) (string, string, bool) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 || body[0] != '{' {
+		return "", "", false
+	}
+	var payload map[string]json.RawMessage
+	if json.Unmarshal(body, &payload) != nil {
+		return "", "", false
+	}
+	for key := range payload {
+		if key == "Meta Data" || strings.Contains(key, "Time Series") {
+			return "", "", false
+		}
+	}
+	for _, key := range []string{"Note", "Information"} {
+		var message string
+		if json.Unmarshal(payload[key], &message) == nil && message != "" {
+			return key, message, true
+		}
+	}
+	return "", "", false
+}
+
+// checkPayload is the providerCall check for AlphaVantage responses. Quota
+// messages become a RateLimitError and rest the key; premium-only requests
+// are unsupported queries; any other message is an unusable payload.
+func (q *alphaVantageQuota) checkPayload(key *quotaKey, operation string) func([]byte) error {
+	return func(body []byte) error {
+		field, message, ok := alphaVantageMessage(body)
+		if !ok {
+			return nil
+		}
+		switch {
+		case field == "Note" || alphaVantageRateLimitMessage.MatchString(message):
+			q.throttled(key)
+			return &RateLimitError{
+				Provider:   "alphavantage",
+				Reason:     fmt.Sprintf("key %d throttled: %s", key.index, message),
+				RetryAfter: alphaVantageThrottleCooldown,
+			}
+		case alphaVantagePremiumMessage.MatchString(message):
+			return fmt.Errorf("%w: %s", errUnsupportedQuery, message)
+		default:
+			return &PayloadError{Provider: "alphavantage", Operation: operation, Reason: message}
+		}
+	}
+}
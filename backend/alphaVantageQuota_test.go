@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestAlphaVantagePayloadClassification(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		// want is "", "rate_limit", "unsupported" or "payload".
+		want string
+	}{
+		{"series", `{"Meta Data": {}, "Time Series (Daily)": {}}`, ""},
+		{"csv", "symbol,name\nIBM,IBM\n", ""},
+		{"note", `{"Note": "Thank you for using Alpha Vantage! Our standard API call frequency is 5 calls per minute and 500 calls per day."}`, "rate_limit"},
+		{"daily limit", `{"Information": "Thank you for using Alpha Vantage! Our standard API rate limit is 25 requests per day. Please subscribe to any of the premium plans at https://www.alphavantage.co/premium/ to instantly remove all daily rate limits."}`, "rate_limit"},
+		{"burst limit", `{"Information": "Thank you for using Alpha Vantage! Please consider spreading out your free API requests more sparingly (1 request per second)."}`, "rate_limit"},
+		{"premium outputsize", `{"Information": "Thank you for using Alpha Vantage! The **outputsize=full** parameter value is a premium feature for the TIME_SERIES_DAILY endpoint. You may subscribe to any of the premium plans at https://www.alphavantage.co/premium/ to instantly unlock all premium features"}`, "unsupported"},
+		{"premium endpoint", `{"Information": "Thank you for using Alpha Vantage! This is a premium endpoint. You may subscribe to any of the premium plans at https://www.alphavantage.co/premium/ to instantly unlock all premium endpoints"}`, "unsupported"},
+		{"bad key", `{"Information": "the parameter apikey is invalid or missing. Please claim your free API key on (https://www.alphavantage.co/support/#api-key)."}`, "payload"},
+	}
+	for _, tt := range tests {
+		quota := newAlphaVantageQuota([]string{"key"})
+		key := quota.keys[0]
+		err := quota.checkPayload(key, "TIME_SERIES_DAILY")([]byte(tt.body))
+
+		var rateLimitErr *RateLimitError
+		var payloadErr *PayloadError
+		got := ""
+		switch {
+		case err == nil:
+		case errors.As(err, &rateLimitErr):
+			got = "rate_limit"
+		case errors.Is(err, errUnsupportedQuery):
+			got = "unsupported"
+		case errors.As(err, &payloadErr):
+			got = "payload"
+		default:
+			got = err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("%s: classified as %q, want %q", tt.name, got, tt.want)
+		}
+		if rested := !key.cooldownUntil.IsZero(); rested != (tt.want == "rate_limit") {
+			t.Errorf("%s: key rested = %t, want it rested only for rate limits", tt.name, rested)
+		}
+	}
+}
+
+func TestAlphaVantagePremiumSeriesIsUnsupported(t *testing.T) {
+	calls := 0
+	provider := newTestAlphaVantage(t, "test-key", func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"Information": "Thank you for using Alpha Vantage! The **outputsize=full** parameter value is a premium feature for the TIME_SERIES_DAILY endpoint."}`))
+	})
+
+	for i := 0; i < 2; i++ {
+		_, err := provider.Series(context.Background(), "IBM", SeriesQuery{Interval: "daily"})
+		if !errors.Is(err, errUnsupportedQuery) {
+			t.Fatalf("call %d: err = %v, want errUnsupportedQuery", i+1, err)
+		}
+	}
+	// The key was not rested, so the second call went out too.
+	if calls != 2 {
+		t.Errorf("provider saw %d calls, want 2", calls)
+	}
+}
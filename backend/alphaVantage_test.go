@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newTestAlphaVantage points a provider at handler, with keys paced fast
+// enough that tests never wait for a slot.
+func newTestAlphaVantage(t *testing.T, keys string, handler http.HandlerFunc) *alphaVantageProvider {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	setVar(t, &alphaVantageBaseURL, server.URL)
+	setVar(t, &alphaVantageAPIKeys, keys)
+	setVar(t, &alphaVantageRequestsPerMinute, 6000)
+	setVar(t, &alphaVantageBurst, 10)
+
+	provider, err := newAlphaVantageProvider(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestNewAlphaVantageProviderRequiresKey(t *testing.T) {
+	for _, keys := range []string{"", " , "} {
+		setVar(t, &alphaVantageAPIKeys, keys)
+		if _, err := newAlphaVantageProvider(http.DefaultClient); err == nil {
+			t.Errorf("ALPHAVANTAGE_API_KEY=%q: provider created, want an error", keys)
+		}
+	}
+}
+
+func TestAlphaVantageDailySeries(t *testing.T) {
+	var query url.Values
+	provider := newTestAlphaVantage(t, "test-key", func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write([]byte(`{
+			"Meta Data": {"2. Symbol": "IBM", "5. Time Zone": "US/Eastern"},
+			"Time Series (Daily)": {
+				"2024-03-05": {"1. open": "190.0", "2. high": "193.5", "3. low": "189.0", "4. close": "192.25", "5. volume": "4100000"},
+				"2024-03-04": {"1. open": "187.5", "2. high": "190.5", "3. low": "187.0", "4. close": "189.75", "5. volume": "3900000"}
+			}
+		}`))
+	})
+
+	quote, err := provider.Series(context.Background(), "ibm", SeriesQuery{Interval: "daily"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for param, want := range map[string]string{"function": "TIME_SERIES_DAILY", "symbol": "ibm", "apikey": "test-key", "outputsize": "compact"} {
+		if got := query.Get(param); got != want {
+			t.Errorf("query %s = %q, want %q", param, got, want)
+		}
+	}
+
+	if quote.Symbol != "IBM" || quote.Currency != "USD" || quote.Source != "alphavantage" {
+		t.Errorf("quote = %s %s from %s, want IBM USD from alphavantage", quote.Symbol, quote.Currency, quote.Source)
+	}
+	if len(quote.Candles) != 2 {
+		t.Fatalf("got %d candles, want 2", len(quote.Candles))
+	}
+	first, second := quote.Candles[0], quote.Candles[1]
+	if !first.Timestamp.Equal(time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)) || !second.Timestamp.After(first.Timestamp) {
+		t.Errorf("timestamps = %s, %s, want 2024-03-04 then 2024-03-05 at UTC midnight", first.Timestamp, second.Timestamp)
+	}
+	if first.Open != 187.5 || first.High != 190.5 || first.Low != 187 || first.Close != 189.75 || first.Volume != 3900000 {
+		t.Errorf("first candle = %+v", first)
+	}
+}
+
+func TestAlphaVantageIntradaySeriesUsesMetadataTimeZone(t *testing.T) {
+	provider := newTestAlphaVantage(t, "test-key", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("interval") != "5min" {
+			http.Error(w, "missing interval", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{
+			"Meta Data": {"6. Time Zone": "US/Eastern"},
+			"Time Series (5min)": {
+				"2024-03-05 09:30:00": {"1. open": "1", "2. high": "2", "3. low": "0.5", "4. close": "1.5", "5. volume": "10"}
+			}
+		}`))
+	})
+
+	quote, err := provider.Series(context.Background(), "IBM", SeriesQuery{Interval: "5min"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 3, 5, 14, 30, 0, 0, time.UTC); !quote.Candles[0].Timestamp.Equal(want) {
+		t.Errorf("timestamp = %s, want %s", quote.Candles[0].Timestamp, want)
+	}
+}
+
+func TestAlphaVantageUnknownSymbol(t *testing.T) {
+	provider := newTestAlphaVantage(t, "test-key", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Error Message": "Invalid API call. Please retry or visit the documentation for TIME_SERIES_DAILY."}`))
+	})
+
+	_, err := provider.Series(context.Background(), "NOPE", SeriesQuery{Interval: "daily"})
+	if !errors.Is(err, errUnknownSymbol) {
+		t.Fatalf("err = %v, want errUnknownSymbol", err)
+	}
+}
+
+func TestAlphaVantageListSymbols(t *testing.T) {
+	provider := newTestAlphaVantage(t, "test-key", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("function") != "LISTING_STATUS" {
+			http.Error(w, "unexpected function", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("symbol,name,exchange,assetType,ipoDate,delistingDate,status\r\n" +
+			"IBM,International Business Machines Corp,NYSE,Stock,1962-01-02,null,Active\r\n" +
+			"OLD,Delisted Co,NASDAQ,Stock,1999-05-03,2020-01-15,Delisted\r\n"))
+	})
+
+	listings, err := provider.ListSymbols(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listings) != 2 {
+		t.Fatalf("got %d listings, want 2", len(listings))
+	}
+	if ibm := listings[0]; ibm.Symbol != "IBM" || ibm.Exchange != "NYSE" || ibm.IPODate == nil || ibm.DelistingDate != nil {
+		t.Errorf("listing = %+v", ibm)
+	}
+	if old := listings[1]; old.DelistingDate == nil || old.Status != "Delisted" {
+		t.Errorf("listing = %+v, want a delisting date", old)
+	}
+}
+
+func TestAlphaVantageIntradayRange(t *testing.T) {
+	var calls int
+	var outputsize string
+	provider := newTestAlphaVantage(t, "test-key", func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		outputsize = r.URL.Query().Get("outputsize")
+		w.Write([]byte(`{"Meta Data": {"6. Time Zone": "US/Eastern"}, "Time Series (60min)": {}}`))
+	})
+
+	query := SeriesQuery{Interval: "60min", From: time.Now().AddDate(0, 0, -10)}
+	if _, err := provider.Series(context.Background(), "IBM", query); err != nil {
+		t.Fatal(err)
+	}
+	if outputsize != "full" {
+		t.Errorf("outputsize = %q for 10 days of hourly bars, want full", outputsize)
+	}
+
+	query.From = time.Now().AddDate(0, 0, -60)
+	if _, err := provider.Series(context.Background(), "IBM", query); !errors.Is(err, errUnsupportedQuery) {
+		t.Errorf("err = %v for 60 days of hourly bars, want errUnsupportedQuery", err)
+	}
+	if calls != 1 {
+		t.Errorf("upstream called %d times, want the old range rejected without a call", calls)
+	}
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// apiTokenPrefix marks personal API tokens so AuthMiddleware can tell them
+// apart from JWTs without a database lookup.
+const apiTokenPrefix = "stk_"
+
+const (
+	scopeWatchlistRead  = "watchlist:read"
+	scopeWatchlistWrite = "watchlist:write"
+)
+
+var apiTokenScopes = []string{scopeWatchlistRead, scopeWatchlistWrite}
+
+var (
+	apiTokenDefaultTTL    = getEnvDuration("API_TOKEN_DEFAULT_TTL", 90*24*time.Hour)
+	apiTokenMaxTTL        = getEnvDuration("API_TOKEN_MAX_TTL", 365*24*time.Hour)
+	apiTokenMaxPerUser    = getEnvInt("API_TOKEN_MAX_PER_USER", 20)
+	apiTokenTouchInterval = getEnvDuration("API_TOKEN_TOUCH_INTERVAL", time.Minute)
+)
+
+var (
+	errInvalidAPIToken = errors.New("invalid api token")
+	errAPITokenExpired = errors.New("api token expired")
+)
+
+const authAPITokenKey contextKey = "auth_api_token"
+
+type CreateAPITokenRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+type APITokenView struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+type APITokenResponse struct {
+	Success  bool          `json:"success"`
+	Message  string        `json:"message"`
+	Token    string        `json:"token,omitempty"`
+	APIToken *APITokenView `json:"apiToken,omitempty"`
+}
+
+type APITokenListResponse struct {
+	Success bool           `json:"success"`
+	Tokens  []APITokenView `json:"tokens"`
+}
+
+func (t *APIToken) scopeList() []string {
+	if t.Scopes == "" {
+		return []string{}
+	}
+	return strings.Fields(t.Scopes)
+}
+
+func (t *APIToken) hasScope(scope string) bool {
+	return slices.Contains(t.scopeList(), scope)
+}
+
+func (t *APIToken) view() APITokenView {
+	return APITokenView{
+		ID:         t.ID,
+		Name:       t.Name,
+		Prefix:     t.Prefix,
+		Scopes:     t.scopeList(),
+		ExpiresAt:  t.ExpiresAt,
+		LastUsedAt: t.LastUsedAt,
+		RevokedAt:  t.RevokedAt,
+		CreatedAt:  t.CreatedAt,
+	}
+}
+
+// apiTokenFromContext returns the API token the request was authenticated
+// with, if it was not authenticated with a session.
+func apiTokenFromContext(ctx context.Context) (*APIToken, bool) {
+	token, ok := ctx.Value(authAPITokenKey).(*APIToken)
+	return token, ok && token != nil
+}
+
+func isAPIToken(token string) bool {
+	return strings.HasPrefix(token, apiTokenPrefix)
+}
+
+// authenticateAPIToken resolves a presented API token to its record, with the
+// owning user preloaded, and records when it was last used.
+func authenticateAPIToken(ctx context.Context, raw string) (*APIToken, error) {
+	var token APIToken
+	err := DB.WithContext(ctx).Preload("User").
+		Where("token_hash = ? AND revoked_at IS NULL", hashOpaqueToken(raw)).
+		First(&token).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errInvalidAPIToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if token.User.ID == 0 {
+		return nil, errInvalidAPIToken
+	}
+	if time.Now().After(token.ExpiresAt) {
+		return &token, errAPITokenExpired
+	}
+
+	// last_used_at is only written once per touch interval so busy scripts do
+	// not turn every request into a write.
+	now := time.Now().UTC()
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= apiTokenTouchInterval {
+		err := DB.WithContext(ctx).Model(&APIToken{}).
+			Where("id = ? AND (last_used_at IS NULL OR last_used_at < ?)", token.ID, now.Add(-apiTokenTouchInterval)).
+			Update("last_used_at", now).Error
+		if err != nil {
+			Logger.WarnContext(ctx, "Failed to record api token usage",
+				slog.Int("api_token_id", token.ID),
+				slog.String("error", err.Error()),
+			)
+		} else {
+			token.LastUsedAt = &now
+		}
+	}
+	return &token, nil
+}
+
+// recordAPITokenRequest counts requests per token so heavy or unexpected
+// script usage can be traced back to the token that made it.
+func recordAPITokenRequest(ctx context.Context, token *APIToken, r *http.Request) {
+	if httpRequestCount == nil {
+		return
+	}
+	route := r.URL.Path
+	if current := mux.CurrentRoute(r); current != nil {
+		if tmpl, err := current.GetPathTemplate(); err == nil {
+			route = tmpl
+		}
+	}
+	httpRequestCount.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("endpoint", route),
+		attribute.String("method", r.Method),
+		attribute.String("component", "api_token"),
+		attribute.String("auth.method", "api_token"),
+		attribute.Int("api_token_id", token.ID),
+		attribute.Int("user_id", token.UserID),
+	))
+}
+
+// RequireScope rejects API token requests whose token lacks scope. Session
+// authenticated requests are not restricted by scopes.
+func RequireScope(scope string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token, ok := apiTokenFromContext(r.Context()); ok && !token.hasScope(scope) {
+				Logger.InfoContext(r.Context(), "API token missing required scope",
+					slog.Int("api_token_id", token.ID),
+					slog.String("scope", scope),
+					slog.String("path", r.URL.Path),
+				)
+				writeAuthError(w, http.StatusForbidden, fmt.Sprintf("Token lacks the %s scope", scope), "INSUFFICIENT_SCOPE")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireSession rejects requests authenticated with an API token, for
+// account management routes a script should never reach.
+func RequireSession() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := apiTokenFromContext(r.Context()); ok {
+				writeAuthError(w, http.StatusForbidden, "This endpoint requires an interactive session", "SESSION_REQUIRED")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func validateAPITokenRequest(req *CreateAPITokenRequest) (time.Time, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		return time.Time{}, errors.New("name is required and must be at most 100 characters")
+	}
+	if len(req.Scopes) == 0 {
+		return time.Time{}, fmt.Errorf("at least one scope is required (%s)", strings.Join(apiTokenScopes, ", "))
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(apiTokenScopes, scope) {
+			return time.Time{}, fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+
+	now := time.Now().UTC()
+	if req.ExpiresAt == nil {
+		return now.Add(apiTokenDefaultTTL), nil
+	}
+	expiresAt := req.ExpiresAt.UTC()
+	if !expiresAt.After(now) {
+		return time.Time{}, errors.New("expiresAt must be in the future")
+	}
+	if expiresAt.After(now.Add(apiTokenMaxTTL)) {
+		return time.Time{}, fmt.Errorf("expiresAt must be within %s", apiTokenMaxTTL)
+	}
+	return expiresAt, nil
+}
+
+func createAPIToken(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+
+	ctx, span := tracer.Start(ctx, "auth.api_tokens.create",
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", "/users/tokens"),
+			attribute.String("component", "auth_service"),
+			attribute.String("operation", "create_api_token"),
+		),
+	)
+	defer span.End()
+
+	if httpRequestCount != nil {
+		httpRequestCount.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("endpoint", "api_tokens_create"),
+			attribute.String("method", r.Method),
+			attribute.String("component", "auth_service"),
+		))
+	}
+
+	user, ok := authUserFromContext(ctx)
+	if !ok {
+		span.SetStatus(codes.Error, "Unauthenticated request")
+		writeAuthError(w, http.StatusUnauthorized, "Authentication required", "MISSING_TOKEN")
+		return
+	}
+	span.SetAttributes(attribute.Int("user_id", user.ID))
+
+	var req CreateAPITokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		span.SetStatus(codes.Error, "Invalid request body")
+		writeAuthError(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST")
+		return
+	}
+	expiresAt, err := validateAPITokenRequest(&req)
+	if err != nil {
+		span.SetStatus(codes.Error, "Invalid token request")
+		writeAuthError(w, http.StatusBadRequest, err.Error(), "INVALID_REQUEST")
+		return
+	}
+
+	var active int64
+	if err := DB.WithContext(ctx).Model(&APIToken{}).
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", user.ID, time.Now().UTC()).
+		Count(&active).Error; err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Database error")
+		writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+		return
+	}
+	if active >= int64(apiTokenMaxPerUser) {
+		span.SetStatus(codes.Error, "Token limit reached")
+		writeAuthError(w, http.StatusConflict, fmt.Sprintf("A user can have at most %d active tokens", apiTokenMaxPerUser), "TOKEN_LIMIT_REACHED")
+		return
+	}
+
+	secret, _, err := generateOpaqueToken()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Token generation failed")
+		writeAuthError(w, http.StatusInternalServerError, "Token generation failed", "TOKEN_GENERATION_FAILED")
+		return
+	}
+	raw := apiTokenPrefix + secret
+
+	token := APIToken{
+		UserID:    user.ID,
+		Name:      req.Name,
+		Prefix:    raw[:len(apiTokenPrefix)+8],
+		TokenHash: hashOpaqueToken(raw),
+		Scopes:    strings.Join(req.Scopes, " "),
+		ExpiresAt: expiresAt,
+	}
+	if err := DB.WithContext(ctx).Create(&token).Error; err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Database error")
+		Logger.ErrorContext(ctx, "Failed to store api token",
+			slog.Int("user_id", user.ID),
+			slog.String("error", err.Error()),
+		)
+		writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+		return
+	}
+
+	span.SetAttributes(attribute.Int("api_token_id", token.ID))
+	span.SetStatus(codes.Ok, "API token created")
+	Logger.InfoContext(ctx, "API token created",
+		slog.Int("user_id", user.ID),
+		slog.Int("api_token_id", token.ID),
+		slog.String("scopes", token.Scopes),
+		slog.Time("expires_at", token.ExpiresAt),
+	)
+
+	view := token.view()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(APITokenResponse{
+		Success:  true,
+		Message:  "Token created. Copy it now; it will not be shown again",
+		Token:    raw,
+		APIToken: &view,
+	})
+}
+
+func listAPITokens(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+
+	ctx, span := tracer.Start(ctx, "auth.api_tokens.list",
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", "/users/tokens"),
+			attribute.String("component", "auth_service"),
+			attribute.String("operation", "list_api_tokens"),
+		),
+	)
+	defer span.End()
+
+	if httpRequestCount != nil {
+		httpRequestCount.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("endpoint", "api_tokens_list"),
+			attribute.String("method", r.Method),
+			attribute.String("component", "auth_service"),
+		))
+	}
+
+	user, ok := authUserFromContext(ctx)
+	if !ok {
+		span.SetStatus(codes.Error, "Unauthenticated request")
+		writeAuthError(w, http.StatusUnauthorized, "Authentication required", "MISSING_TOKEN")
+		return
+	}
+	span.SetAttributes(attribute.Int("user_id", user.ID))
+
+	var tokens []APIToken
+	if err := DB.WithContext(ctx).Where("user_id = ?", user.ID).Order("created_at DESC").Find(&tokens).Error; err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Database error")
+		writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+		return
+	}
+
+	views := make([]APITokenView, 0, len(tokens))
+	for i := range tokens {
+		views = append(views, tokens[i].view())
+	}
+
+	span.SetAttributes(attribute.Int("token_count", len(views)))
+	span.SetStatus(codes.Ok, "API tokens listed")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(APITokenListResponse{
+		Success: true,
+		Tokens:  views,
+	})
+}
+
+func revokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+
+	ctx, span := tracer.Start(ctx, "auth.api_tokens.revoke",
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", "/users/tokens/{id}"),
+			attribute.String("component", "auth_service"),
+			attribute.String("operation", "revoke_api_token"),
+		),
+	)
+	defer span.End()
+
+	if httpRequestCount != nil {
+		httpRequestCount.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("endpoint", "api_tokens_revoke"),
+			attribute.String("method", r.Method),
+			attribute.String("component", "auth_service"),
+		))
+	}
+
+	user, ok := authUserFromContext(ctx)
+	if !ok {
+		span.SetStatus(codes.Error, "Unauthenticated request")
+		writeAuthError(w, http.StatusUnauthorized, "Authentication required", "MISSING_TOKEN")
+		return
+	}
+	span.SetAttributes(attribute.Int("user_id", user.ID))
+
+	tokenID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		span.SetStatus(codes.Error, "Invalid token id")
+		writeAuthError(w, http.StatusBadRequest, "Invalid token id", "INVALID_REQUEST")
+		return
+	}
+	span.SetAttributes(attribute.Int("api_token_id", tokenID))
+
+	result := DB.WithContext(ctx).Model(&APIToken{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", tokenID, user.ID).
+		Update("revoked_at", time.Now().UTC())
+	if result.Error != nil {
+		span.RecordError(result.Error)
+		span.SetStatus(codes.Error, "Database error")
+		writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+		return
+	}
+	if result.RowsAffected == 0 {
+		span.SetStatus(codes.Error, "Token not found")
+		writeAuthError(w, http.StatusNotFound, "Token not found", "TOKEN_NOT_FOUND")
+		return
+	}
+
+	span.SetStatus(codes.Ok, "API token revoked")
+	Logger.InfoContext(ctx, "API token revoked",
+		slog.Int("user_id", user.ID),
+		slog.Int("api_token_id", tokenID),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(APITokenResponse{
+		Success: true,
+		Message: "Token revoked",
+	})
+}
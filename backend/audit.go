@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const (
+	auditUsernameChanged      = "account.username_changed"
+	auditPasswordChanged      = "account.password_changed"
+	auditEmailChangeRequested = "account.email_change_requested"
+	auditEmailChanged         = "account.email_changed"
+	auditAccountExported      = "account.exported"
+	auditAccountDeleted       = "account.deleted"
+
+	auditLogin          = "auth.login"
+	auditLoginTwoFactor = "auth.login_2fa"
+	auditLoginOIDC      = "auth.login_oidc"
+	auditLockout        = "auth.lockout"
+	auditRegister       = "auth.register"
+	auditLogout         = "auth.logout"
+	auditTokenRefresh   = "auth.token_refresh"
+)
+
+// recordAudit stores an audit event through db, so callers can make it part
+// of the transaction that performs the change. The event is also added to the
+// current span to tie the trace to the audit trail.
+func recordAudit(ctx context.Context, db *gorm.DB, r *http.Request, userID, actorID int, action string, details map[string]interface{}) error {
+	return storeAuditEvent(ctx, db, r, AuditEvent{UserID: userID, ActorID: actorID, Action: action}, details)
+}
+
+// recordAuthEvent stores an authentication event with its outcome. Failures
+// are only logged: the audit trail must never turn a login into an error,
+// and the event is written even if the client has already gone away.
+func recordAuthEvent(ctx context.Context, r *http.Request, userID int, action, outcome string, details map[string]interface{}) {
+	event := AuditEvent{UserID: userID, ActorID: userID, Action: action, Outcome: outcome}
+	db := DB.WithContext(context.WithoutCancel(ctx))
+	if err := storeAuditEvent(ctx, db, r, event, details); err != nil {
+		Logger.WarnContext(ctx, "Failed to record authentication event",
+			slog.String("action", action),
+			slog.String("outcome", outcome),
+			slog.Int("user_id", userID),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+func storeAuditEvent(ctx context.Context, db *gorm.DB, r *http.Request, event AuditEvent, details map[string]interface{}) error {
+	event.TraceID = trace.SpanFromContext(ctx).SpanContext().TraceID().String()
+	if r != nil {
+		event.RemoteAddr = r.RemoteAddr
+		event.UserAgent = r.UserAgent()
+	}
+	if len(details) > 0 {
+		encoded, err := json.Marshal(details)
+		if err != nil {
+			return fmt.Errorf("error encoding audit details: %w", err)
+		}
+		event.Details = string(encoded)
+	}
+
+	if err := db.Create(&event).Error; err != nil {
+		return fmt.Errorf("error storing audit event: %w", err)
+	}
+
+	attrs := []attribute.KeyValue{
+		attribute.Int("audit.user_id", event.UserID),
+		attribute.Int("audit.actor_id", event.ActorID),
+	}
+	if event.Outcome != "" {
+		attrs = append(attrs, attribute.String("audit.outcome", event.Outcome))
+	}
+	trace.SpanFromContext(ctx).AddEvent("audit."+event.Action, trace.WithAttributes(attrs...))
+	return nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+type contextKey string
+
+const (
+	authUserKey    contextKey = "auth_user"
+	authSessionKey contextKey = "auth_session"
+)
+
+var errMissingBearerToken = errors.New("missing bearer token")
+
+// authUserFromContext returns the user injected by AuthMiddleware.
+func authUserFromContext(ctx context.Context) (*User, bool) {
+	user, ok := ctx.Value(authUserKey).(*User)
+	return user, ok && user != nil
+}
+
+// authSessionFromContext returns the refresh token family of the session the
+// request was authenticated with.
+func authSessionFromContext(ctx context.Context) (string, bool) {
+	sessionID, ok := ctx.Value(authSessionKey).(string)
+	return sessionID, ok && sessionID != ""
+}
+
+func bearerToken(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", errMissingBearerToken
+	}
+	return strings.TrimSpace(token), nil
+}
+
+// rejectDisabledUser answers for a disabled account and reports whether it
+// did, ending span in that case.
+func rejectDisabledUser(ctx context.Context, span trace.Span, w http.ResponseWriter, user *User) bool {
+	if user.DisabledAt == nil {
+		return false
+	}
+	span.SetStatus(codes.Error, "Account disabled")
+	span.End()
+
+	Logger.InfoContext(ctx, "Authentication failed - account disabled",
+		slog.Int("user_id", user.ID),
+	)
+	writeAuthError(w, http.StatusForbidden, "This account has been disabled", "ACCOUNT_DISABLED")
+	return true
+}
+
+func writeAuthError(w http.ResponseWriter, status int, message, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="stock-tracker"`)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Success: false,
+		Message: message,
+		Error:   code,
+	})
+}
+
+// AuthMiddleware validates the bearer token on the request, either a session
+// JWT or a personal API token, and injects the authenticated user into the
+// request context.
+func AuthMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			tracer := otel.Tracer("stock-tracker-app-tracer")
+
+			ctx, span := tracer.Start(ctx, "auth.authenticate",
+				trace.WithAttributes(
+					attribute.String("component", "auth_service"),
+					attribute.String("operation", "verify_token"),
+					attribute.String("http.target", r.URL.Path),
+				),
+			)
+
+			token, err := bearerToken(r)
+			if err != nil {
+				span.SetStatus(codes.Error, "Missing bearer token")
+				span.End()
+
+				Logger.InfoContext(ctx, "Authentication failed - missing bearer token",
+					slog.String("path", r.URL.Path),
+				)
+				writeAuthError(w, http.StatusUnauthorized, "Authentication required", "MISSING_TOKEN")
+				return
+			}
+
+			if isAPIToken(token) {
+				span.SetAttributes(attribute.String("auth.method", "api_token"))
+
+				apiToken, err := authenticateAPIToken(ctx, token)
+				if err != nil {
+					span.RecordError(err)
+
+					if errors.Is(err, errInvalidAPIToken) || errors.Is(err, errAPITokenExpired) {
+						span.SetStatus(codes.Error, "Invalid api token")
+						span.End()
+						Logger.InfoContext(ctx, "Authentication failed - invalid api token",
+							slog.String("path", r.URL.Path),
+							slog.String("error", err.Error()),
+						)
+						writeAuthError(w, http.StatusUnauthorized, "Invalid or expired token", "INVALID_TOKEN")
+						return
+					}
+
+					span.SetStatus(codes.Error, "Database error")
+					span.End()
+					Logger.ErrorContext(ctx, "Database error during api token authentication",
+						slog.String("error", err.Error()),
+					)
+					writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+					return
+				}
+
+				span.SetAttributes(
+					attribute.Int("user_id", apiToken.UserID),
+					attribute.Int("api_token_id", apiToken.ID),
+				)
+				if rejectDisabledUser(ctx, span, w, &apiToken.User) {
+					return
+				}
+				recordAPITokenRequest(ctx, apiToken, r)
+				span.SetStatus(codes.Ok, "API token verified")
+				span.End()
+
+				reqCtx := context.WithValue(r.Context(), authUserKey, &apiToken.User)
+				reqCtx = context.WithValue(reqCtx, authAPITokenKey, apiToken)
+				next.ServeHTTP(w, r.WithContext(reqCtx))
+				return
+			}
+
+			claims, userID, err := parseJWT(token)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, "Invalid token")
+				span.End()
+
+				Logger.InfoContext(ctx, "Authentication failed - invalid token",
+					slog.String("path", r.URL.Path),
+					slog.String("error", err.Error()),
+				)
+				writeAuthError(w, http.StatusUnauthorized, "Invalid or expired token", "INVALID_TOKEN")
+				return
+			}
+			span.SetAttributes(attribute.Int("user_id", userID))
+
+			if claims.SessionID != "" {
+				revoked, err := isSessionRevoked(ctx, claims.SessionID)
+				if err != nil {
+					span.RecordError(err)
+					span.SetStatus(codes.Error, "Database error")
+					span.End()
+
+					Logger.ErrorContext(ctx, "Database error during session check",
+						slog.Int("user_id", userID),
+						slog.String("error", err.Error()),
+					)
+					writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+					return
+				}
+				if revoked {
+					span.SetStatus(codes.Error, "Session revoked")
+					span.End()
+
+					Logger.InfoContext(ctx, "Authentication failed - session revoked",
+						slog.Int("user_id", userID),
+						slog.String("family_id", claims.SessionID),
+					)
+					writeAuthError(w, http.StatusUnauthorized, "Session has been revoked", "REVOKED_TOKEN")
+					return
+				}
+			}
+
+			var user User
+			if err := DB.WithContext(ctx).First(&user, "id = ?", userID).Error; err != nil {
+				span.RecordError(err)
+
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					span.SetStatus(codes.Error, "Token user not found")
+					span.End()
+					Logger.InfoContext(ctx, "Authentication failed - user no longer exists",
+						slog.Int("user_id", userID),
+					)
+					writeAuthError(w, http.StatusUnauthorized, "Invalid or expired token", "INVALID_TOKEN")
+					return
+				}
+
+				span.SetStatus(codes.Error, "Database error")
+				span.End()
+				Logger.ErrorContext(ctx, "Database error during authentication",
+					slog.Int("user_id", userID),
+					slog.String("error", err.Error()),
+				)
+				writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+				return
+			}
+
+			if rejectDisabledUser(ctx, span, w, &user) {
+				return
+			}
+
+			span.SetStatus(codes.Ok, "Token verified")
+			span.End()
+
+			reqCtx := context.WithValue(r.Context(), authUserKey, &user)
+			reqCtx = context.WithValue(reqCtx, authSessionKey, claims.SessionID)
+			next.ServeHTTP(w, r.WithContext(reqCtx))
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The symbol catalog tables are refreshed every CATALOG_SYNC_INTERVAL, and at
+// startup when the last sync is older than that. Each replica runs the job;
+// the upserts make concurrent runs harmless.
+var (
+	catalogSyncInterval = getEnvDuration("CATALOG_SYNC_INTERVAL", 24*time.Hour)
+	catalogSyncTimeout  = getEnvDuration("CATALOG_SYNC_TIMEOUT", 5*time.Minute)
+)
+
+const catalogSyncBatchSize = 1000
+
+// startCatalogSync starts the sync loop. The returned func stops it.
+func startCatalogSync() func() {
+	stop := make(chan struct{})
+	go func() {
+		if catalogSyncDue() {
+			runCatalogSync()
+		}
+
+		ticker := time.NewTicker(catalogSyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				runCatalogSync()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// catalogSyncDue reports whether either catalog is empty or out of date.
+func catalogSyncDue() bool {
+	cutoff := time.Now().Add(-catalogSyncInterval)
+	for _, model := range []interface{}{&StockListing{}, &CryptoListing{}} {
+		var fresh int64
+		if err := DB.Model(model).Where("synced_at > ?", cutoff).Count(&fresh).Error; err != nil || fresh == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func runCatalogSync() {
+	ctx, cancel := context.WithTimeout(context.Background(), catalogSyncTimeout)
+	defer cancel()
+
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	ctx, span := tracer.Start(ctx, "catalog.sync")
+	defer span.End()
+
+	stocks, stockErr := syncStockCatalog(ctx)
+	coins, cryptoErr := syncCryptoCatalog(ctx)
+	span.SetAttributes(
+		attribute.Int("catalog.stock_rows", stocks),
+		attribute.Int("catalog.crypto_rows", coins),
+	)
+
+	for _, err := range []error{stockErr, cryptoErr} {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Catalog sync failed")
+			Logger.ErrorContext(ctx, "Symbol catalog sync failed", "error", err)
+		}
+	}
+	if stockErr == nil && cryptoErr == nil {
+		span.SetStatus(codes.Ok, "Catalog synced")
+	}
+	Logger.InfoContext(ctx, "Symbol catalog sync finished", "stock_rows", stocks, "crypto_rows", coins)
+}
+
+// replaceCatalog upserts rows stamped with this sync's time and then removes
+// the rows the provider no longer returns.
+func replaceCatalog[T any](ctx context.Context, rows []T, conflict []clause.Column, update []string, stamp func(*T, time.Time)) error {
+	syncedAt := time.Now().UTC()
+	for i := range rows {
+		stamp(&rows[i], syncedAt)
+	}
+
+	return DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   conflict,
+			DoUpdates: clause.AssignmentColumns(update),
+		}).CreateInBatches(rows, catalogSyncBatchSize).Error; err != nil {
+			return err
+		}
+		var model T
+		return tx.Where("synced_at < ?", syncedAt).Delete(&model).Error
+	})
+}
+
+func syncStockCatalog(ctx context.Context) (int, error) {
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	ctx, span := tracer.Start(ctx, "catalog.sync.stocks",
+		trace.WithAttributes(attribute.String("provider", stockProvider.Name())),
+	)
+	defer span.End()
+
+	listings, err := stockProvider.ListSymbols(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Fetching listings failed")
+		return 0, fmt.Errorf("error fetching stock listings: %w", err)
+	}
+	if len(listings) == 0 {
+		span.SetStatus(codes.Error, "Empty listing")
+		return 0, fmt.Errorf("provider returned no stock listings")
+	}
+
+	// Postgres rejects an upsert that touches the same row twice.
+	seen := make(map[[2]string]bool, len(listings))
+	rows := listings[:0]
+	for _, l := range listings {
+		key := [2]string{l.Symbol, l.Exchange}
+		if l.Symbol == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		rows = append(rows, l)
+	}
+
+	err = replaceCatalog(ctx, rows,
+		[]clause.Column{{Name: "symbol"}, {Name: "exchange"}},
+		[]string{"name", "asset_type", "ipo_date", "delisting_date", "status", "synced_at"},
+		func(l *StockListing, t time.Time) { l.SyncedAt = t },
+	)
+	span.SetAttributes(attribute.Int("catalog.rows", len(rows)))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Storing listings failed")
+		return 0, fmt.Errorf("error storing stock listings: %w", err)
+	}
+	span.SetStatus(codes.Ok, "Stock catalog synced")
+	return len(rows), nil
+}
+
+func syncCryptoCatalog(ctx context.Context) (int, error) {
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	ctx, span := tracer.Start(ctx, "catalog.sync.crypto",
+		trace.WithAttributes(attribute.String("provider", cryptoProvider.Name())),
+	)
+	defer span.End()
+
+	coins, err := cryptoProvider.CoinList(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Fetching coin list failed")
+		return 0, fmt.Errorf("error fetching coin list: %w", err)
+	}
+	if len(coins) == 0 {
+		span.SetStatus(codes.Error, "Empty coin list")
+		return 0, fmt.Errorf("provider returned no coins")
+	}
+
+	// Ranks come from the top coins by market cap. Without them an exact
+	// symbol search for "btc" would list every token using that ticker in
+	// arbitrary order, so a failure here is logged but not fatal.
+	ranks := map[string]int{}
+	if top, err := cryptoProvider.ListCoins(ctx); err != nil {
+		Logger.WarnContext(ctx, "Fetching coin ranks failed, syncing without them", "error", err)
+	} else {
+		for i, coin := range top {
+			ranks[coin.Id] = i + 1
+		}
+	}
+
+	seen := make(map[string]bool, len(coins))
+	rows := coins[:0]
+	for _, c := range coins {
+		if c.ID == "" || seen[c.ID] {
+			continue
+		}
+		seen[c.ID] = true
+		if rank, ok := ranks[c.ID]; ok {
+			c.MarketCapRank = &rank
+		}
+		rows = append(rows, c)
+	}
+
+	err = replaceCatalog(ctx, rows,
+		[]clause.Column{{Name: "id"}},
+		[]string{"symbol", "name", "market_cap_rank", "synced_at"},
+		func(c *CryptoListing, t time.Time) { c.SyncedAt = t },
+	)
+	span.SetAttributes(
+		attribute.Int("catalog.rows", len(rows)),
+		attribute.Int("catalog.ranked", len(ranks)),
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Storing coins failed")
+		return 0, fmt.Errorf("error storing coin list: %w", err)
+	}
+	span.SetStatus(codes.Ok, "Crypto catalog synced")
+	return len(rows), nil
+}
+
+// symbolSearchTrigram is set when pg_trgm is available, enabling fuzzy
+// matching and the indexes that make substring search fast.
+var symbolSearchTrigram bool
+
+// setupSymbolSearchIndexes enables pg_trgm when the database user may do so.
+// Search still works without it, limited to prefix and substring matches.
+func setupSymbolSearchIndexes() {
+	statements := []string{
+		"CREATE EXTENSION IF NOT EXISTS pg_trgm",
+		"CREATE INDEX IF NOT EXISTS idx_stock_listings_name_trgm ON stock_listings USING gin (LOWER(name) gin_trgm_ops)",
+		"CREATE INDEX IF NOT EXISTS idx_stock_listings_symbol_trgm ON stock_listings USING gin (UPPER(symbol) gin_trgm_ops)",
+		"CREATE INDEX IF NOT EXISTS idx_crypto_listings_name_trgm ON crypto_listings USING gin (LOWER(name) gin_trgm_ops)",
+		"CREATE INDEX IF NOT EXISTS idx_crypto_listings_symbol_trgm ON crypto_listings USING gin (LOWER(symbol) gin_trgm_ops)",
+	}
+	for _, statement := range statements {
+		if err := DB.Exec(statement).Error; err != nil {
+			log.Printf("pg_trgm unavailable, symbol search falls back to prefix matching: %v", err)
+			return
+		}
+	}
+	symbolSearchTrigram = true
+}
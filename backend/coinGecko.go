@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// The public API needs no key. Demo and pro keys are sent in the header named
+// by COINGECKO_API_KEY_HEADER; pro keys also need the pro base URL.
+var (
+	coinGeckoBaseURL      = getEnv("COINGECKO_BASE_URL", "https://api.coingecko.com/api/v3")
+	coinGeckoAPIKey       = getEnv("COINGECKO_API_KEY", "")
+	coinGeckoAPIKeyHeader = getEnv("COINGECKO_API_KEY_HEADER", "x-cg-demo-api-key")
+)
+
+type coinGeckoProvider struct {
+	client  *http.Client
+	baseURL string
+	header  http.Header
+}
+
+func newCoinGeckoProvider(client *http.Client) *coinGeckoProvider {
+	header := http.Header{}
+	if coinGeckoAPIKey != "" {
+		header.Set(coinGeckoAPIKeyHeader, coinGeckoAPIKey)
+	}
+	return &coinGeckoProvider{
+		client:  client,
+		baseURL: strings.TrimRight(coinGeckoBaseURL, "/"),
+		header:  header,
+	}
+}
+
+func (p *coinGeckoProvider) Name() string {
+	return "coingecko"
+}
+
+// marketsURL is the /coins/markets query the app has always used: the top
+// 100 coins by market cap in USD, optionally narrowed to the given ids.
+func (p *coinGeckoProvider) marketsURL(ids string) string {
+	params := url.Values{
+		"vs_currency":             {"usd"},
+		"order":                   {"market_cap_desc"},
+		"per_page":                {"100"},
+		"page":                    {"1"},
+		"sparkline":               {"false"},
+		"price_change_percentage": {"24h"},
+	}
+	if ids != "" {
+		params.Set("ids", ids)
+	}
+	return p.baseURL + "/coins/markets?" + params.Encode()
+}
+
+func (p *coinGeckoProvider) fetchMarkets(ctx context.Context, call providerCall) ([]map[string]interface{}, error) {
+	call.api = "coingecko"
+	call.header = p.header
+	body, err := call.fetch(ctx, p.client)
+	if err != nil {
+		return nil, err
+	}
+
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	ctx, responseSpan := tracer.Start(ctx, "processJSONresponse")
+	defer responseSpan.End()
+	responseSpan.AddEvent("Starting JSON response parsing")
+
+	var markets []map[string]interface{}
+	if err := json.Unmarshal(body, &markets); err != nil {
+		responseSpan.SetStatus(codes.Error, fmt.Sprintf("JSON read error: %v", err))
+		responseSpan.RecordError(err)
+		Logger.ErrorContext(ctx, "Failed to decode JSON response from Coingecko", "error", err, "operation", call.operation)
+		return nil, err
+	}
+	responseSpan.SetAttributes(attribute.Int("coins.count", len(markets)))
+	responseSpan.SetStatus(codes.Ok, "JSON decoded")
+	return markets, nil
+}
+
+// ListCoins returns symbol, name and id of the top coins by market cap.
+func (p *coinGeckoProvider) ListCoins(ctx context.Context) ([]coinData, error) {
+	markets, err := p.fetchMarkets(ctx, providerCall{
+		operation: "LISTED_COINS",
+		spanName:  "coingecko.LISTED_COINS",
+		url:       p.marketsURL(""),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var coins []coinData
+	for _, coin := range markets {
+		symbol, ok := coin["symbol"].(string)
+		if !ok {
+			Logger.WarnContext(ctx, "Coin data missing 'symbol' field, skipping record")
+			continue
+		}
+		id, ok := coin["id"].(string)
+		if !ok {
+			Logger.WarnContext(ctx, "Coin data missing 'id' field, skipping coin", "coin_symbol", symbol)
+			continue
+		}
+		name, ok := coin["name"].(string)
+		if !ok {
+			Logger.WarnContext(ctx, "Coin data missing 'name' field, skipping coin", "coin_symbol", symbol)
+			continue
+		}
+		coins = append(coins, coinData{Symbol: symbol, Name: name, Id: id})
+	}
+	Logger.InfoContext(ctx, "Processed crypto data", "total_coins", len(markets), "valid_symbols_extracted", len(coins))
+	return coins, nil
+}
+
+// coinGeckoCurrency is the vs_currency of every market query.
+const coinGeckoCurrency = "USD"
+
+// coinMarket holds the /coins/markets fields a quote is built from. CoinGecko
+// sends null for fields it has no data for.
+type coinMarket struct {
+	ID             string    `json:"id"`
+	Symbol         string    `json:"symbol"`
+	CurrentPrice   *float64  `json:"current_price"`
+	High24h        *float64  `json:"high_24h"`
+	Low24h         *float64  `json:"low_24h"`
+	TotalVolume    *float64  `json:"total_volume"`
+	PriceChange24h *float64  `json:"price_change_24h"`
+	LastUpdated    time.Time `json:"last_updated"`
+}
+
+// candle turns the market snapshot into one bar covering the last 24 hours,
+// closing at the current price. Only the price is required; without the
+// 24h change the bar opens at the current price, and missing highs and lows
+// fall back to the open and close.
+func (m coinMarket) candle(source string) (Candle, error) {
+	if m.CurrentPrice == nil {
+		return Candle{}, errors.New("current_price is null")
+	}
+	if m.LastUpdated.IsZero() {
+		return Candle{}, errors.New("last_updated is missing")
+	}
+
+	c := Candle{
+		Timestamp: m.LastUpdated.UTC(),
+		Open:      *m.CurrentPrice,
+		Close:     *m.CurrentPrice,
+		Currency:  coinGeckoCurrency,
+		Source:    source,
+	}
+	if m.PriceChange24h != nil {
+		c.Open = *m.CurrentPrice - *m.PriceChange24h
+	}
+	c.High, c.Low = math.Max(c.Open, c.Close), math.Min(c.Open, c.Close)
+	if m.High24h != nil {
+		c.High = *m.High24h
+	}
+	if m.Low24h != nil {
+		c.Low = *m.Low24h
+	}
+	if m.TotalVolume != nil {
+		c.Volume = *m.TotalVolume
+	}
+	return c, nil
+}
+
+// CoinQuote returns the current /coins/markets snapshot of a CoinGecko coin id
+// as a 24h candle.
+func (p *coinGeckoProvider) CoinQuote(ctx context.Context, id string) (*Quote, error) {
+	call := providerCall{
+		api:       "coingecko",
+		operation: "COIN_DATA",
+		spanName:  "coingecko.COIN_DATA",
+		url:       p.marketsURL(id),
+		header:    p.header,
+		attrs:     []attribute.KeyValue{attribute.String("crypto_symbol", id)},
+	}
+	body, err := call.fetch(ctx, p.client)
+	if err != nil {
+		return nil, err
+	}
+
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	ctx, responseSpan := tracer.Start(ctx, "processJSONresponse")
+	defer responseSpan.End()
+	responseSpan.AddEvent("Starting JSON response parsing")
+
+	var markets []coinMarket
+	if err := json.Unmarshal(body, &markets); err != nil {
+		err = &PayloadError{Provider: p.Name(), Operation: call.operation, Reason: err.Error()}
+		responseSpan.SetStatus(codes.Error, fmt.Sprintf("JSON read error: %v", err))
+		responseSpan.RecordError(err)
+		Logger.ErrorContext(ctx, "Failed to decode JSON response from Coingecko", "error", err, "operation", call.operation)
+		return nil, err
+	}
+	responseSpan.SetAttributes(attribute.Int("coins.count", len(markets)))
+
+	// An unknown id is not an error to CoinGecko, just an empty list.
+	var market *coinMarket
+	for i := range markets {
+		if markets[i].ID == id {
+			market = &markets[i]
+			break
+		}
+	}
+	if market == nil {
+		err := fmt.Errorf("%w: no market data for coin %q", errUnknownSymbol, id)
+		responseSpan.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	candle, err := market.candle(p.Name())
+	if err != nil {
+		err = &PayloadError{Provider: p.Name(), Operation: call.operation, Reason: err.Error()}
+		responseSpan.SetStatus(codes.Error, err.Error())
+		responseSpan.RecordError(err)
+		Logger.ErrorContext(ctx, "Coingecko market data is incomplete", "error", err, "coin_id", id)
+		return nil, err
+	}
+	responseSpan.SetStatus(codes.Ok, "JSON decoded")
+
+	return &Quote{
+		Symbol:   market.ID,
+		Type:     "CRYPTO",
+		Interval: "24h",
+		Currency: coinGeckoCurrency,
+		Source:   p.Name(),
+		Candles:  []Candle{candle},
+		Raw:      body,
+	}, nil
+}
+
+// coinGeckoDefaultBars is how many bars a series covers when the client
+// gives no start, matching what AlphaVantage returns by default.
+const coinGeckoDefaultBars = 100
+
+// seriesRange fills in the missing bounds of a query: to defaults to now and
+// from to 100 bars earlier, capped at a day for sub-hourly intervals so the
+// points stay fine enough.
+func (p *coinGeckoProvider) seriesRange(query SeriesQuery) (time.Time, time.Time) {
+	from, to := query.From, query.To
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+	if from.IsZero() {
+		span := coinGeckoDefaultBars * seriesIntervals[query.Interval]
+		if seriesIntervals[query.Interval] < time.Hour && span > 24*time.Hour {
+			span = 24 * time.Hour
+		}
+		from = to.Add(-span)
+	}
+	return from, to
+}
+
+// chartGranularity is the spacing of market_chart/range points, which
+// CoinGecko picks from the length of the range.
+func chartGranularity(from, to time.Time) time.Duration {
+	switch span := to.Sub(from); {
+	case span <= 24*time.Hour:
+		return 5 * time.Minute
+	case span <= 90*24*time.Hour:
+		return time.Hour
+	default:
+		return 24 * time.Hour
+	}
+}
+
+// bucketStart returns the start of the bar containing t: the UTC day, the
+// week from Monday, the calendar month, or t truncated to an intraday
+// interval.
+func bucketStart(t time.Time, interval string) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch interval {
+	case "daily":
+		return day
+	case "weekly":
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case "monthly":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return t.Truncate(seriesIntervals[interval])
+	}
+}
+
+func bucketEnd(start time.Time, interval string) time.Time {
+	switch interval {
+	case "daily":
+		return start.AddDate(0, 0, 1)
+	case "weekly":
+		return start.AddDate(0, 0, 7)
+	case "monthly":
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.Add(seriesIntervals[interval])
+	}
+}
+
+// coinChart is the market_chart/range payload: [unix ms, value] pairs.
+type coinChart struct {
+	Prices       [][2]*float64 `json:"prices"`
+	TotalVolumes [][2]*float64 `json:"total_volumes"`
+}
+
+// candles groups chart points into bars of the interval. Prices give the
+// open, high, low and close. CoinGecko only reports a rolling 24h volume, so
+// a bar's volume is estimated as the mean of those samples scaled to the
+// bar's length.
+func (chart coinChart) candles(interval, source string) []Candle {
+	type bucket struct {
+		candle  Candle
+		volumes []float64
+	}
+	var order []time.Time
+	buckets := map[time.Time]*bucket{}
+
+	for _, point := range chart.Prices {
+		if point[0] == nil || point[1] == nil {
+			continue
+		}
+		start := bucketStart(time.UnixMilli(int64(*point[0])), interval)
+		price := *point[1]
+		b, ok := buckets[start]
+		if !ok {
+			b = &bucket{candle: Candle{Timestamp: start, Open: price, High: price, Low: price, Currency: coinGeckoCurrency, Source: source}}
+			buckets[start] = b
+			order = append(order, start)
+		}
+		b.candle.High = math.Max(b.candle.High, price)
+		b.candle.Low = math.Min(b.candle.Low, price)
+		b.candle.Close = price
+	}
+	for _, point := range chart.TotalVolumes {
+		if point[0] == nil || point[1] == nil {
+			continue
+		}
+		if b, ok := buckets[bucketStart(time.UnixMilli(int64(*point[0])), interval)]; ok {
+			b.volumes = append(b.volumes, *point[1])
+		}
+	}
+
+	candles := make([]Candle, 0, len(order))
+	for _, start := range order {
+		b := buckets[start]
+		if len(b.volumes) > 0 {
+			var sum float64
+			for _, v := range b.volumes {
+				sum += v
+			}
+			share := bucketEnd(start, interval).Sub(start).Hours() / 24
+			b.candle.Volume = sum / float64(len(b.volumes)) * share
+		}
+		candles = append(candles, b.candle)
+	}
+	sort.Slice(candles, func(i, j int) bool { return candles[i].Timestamp.Before(candles[j].Timestamp) })
+	return candles
+}
+
+// CoinSeries returns the price series of a CoinGecko coin id from
+// /coins/{id}/market_chart/range, grouped into bars of the query's interval.
+// Intervals finer than the points CoinGecko returns for the range are
+// rejected rather than served with gaps.
+func (p *coinGeckoProvider) CoinSeries(ctx context.Context, id string, query SeriesQuery) (*Quote, error) {
+	from, to := p.seriesRange(query)
+	if granularity := chartGranularity(from, to); seriesIntervals[query.Interval] < granularity {
+		switch {
+		case seriesIntervals[query.Interval] < 5*time.Minute:
+			return nil, fmt.Errorf("%w: %s crypto bars are not available", errUnsupportedQuery, query.Interval)
+		case seriesIntervals[query.Interval] < time.Hour:
+			return nil, fmt.Errorf("%w: %s crypto bars are only available for ranges up to 1 day", errUnsupportedQuery, query.Interval)
+		default:
+			return nil, fmt.Errorf("%w: %s crypto bars are only available for ranges up to 90 days", errUnsupportedQuery, query.Interval)
+		}
+	}
+
+	params := url.Values{
+		"vs_currency": {"usd"},
+		"from":        {strconv.FormatInt(from.Unix(), 10)},
+		"to":          {strconv.FormatInt(to.Unix(), 10)},
+	}
+	call := providerCall{
+		api:       "coingecko",
+		operation: "MARKET_CHART_RANGE",
+		spanName:  "coingecko.MARKET_CHART_RANGE",
+		url:       p.baseURL + "/coins/" + url.PathEscape(id) + "/market_chart/range?" + params.Encode(),
+		header:    p.header,
+		attrs: []attribute.KeyValue{
+			attribute.String("crypto_symbol", id),
+			attribute.String("series.interval", query.Interval),
+		},
+	}
+	body, err := call.fetch(ctx, p.client)
+	if err != nil {
+		var providerErr *ProviderError
+		if errors.As(err, &providerErr) && providerErr.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%w: no market chart for coin %q", errUnknownSymbol, id)
+		}
+		return nil, err
+	}
+
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	ctx, responseSpan := tracer.Start(ctx, "processJSONresponse")
+	defer responseSpan.End()
+	responseSpan.AddEvent("Starting JSON response parsing")
+
+	var chart coinChart
+	if err := json.Unmarshal(body, &chart); err != nil {
+		err = &PayloadError{Provider: p.Name(), Operation: call.operation, Reason: err.Error()}
+		responseSpan.SetStatus(codes.Error, fmt.Sprintf("JSON read error: %v", err))
+		responseSpan.RecordError(err)
+		Logger.ErrorContext(ctx, "Failed to decode JSON response from Coingecko", "error", err, "operation", call.operation)
+		return nil, err
+	}
+	candles := chart.candles(query.Interval, p.Name())
+	responseSpan.SetAttributes(
+		attribute.Int("points.count", len(chart.Prices)),
+		attribute.Int("candles.count", len(candles)),
+	)
+	responseSpan.SetStatus(codes.Ok, "JSON decoded")
+
+	return &Quote{
+		Symbol:   id,
+		Type:     "CRYPTO",
+		Interval: query.Interval,
+		Currency: coinGeckoCurrency,
+		Source:   p.Name(),
+		Candles:  candles,
+		Raw:      body,
+	}, nil
+}
+
+// CoinList returns every coin from /coins/list. The response is large, so
+// only the catalog sync calls it.
+func (p *coinGeckoProvider) CoinList(ctx context.Context) ([]CryptoListing, error) {
+	call := providerCall{
+		api:       "coingecko",
+		operation: "COIN_LIST",
+		spanName:  "coingecko.COIN_LIST",
+		url:       p.baseURL + "/coins/list",
+		header:    p.header,
+	}
+	body, err := call.fetch(ctx, p.client)
+	if err != nil {
+		return nil, err
+	}
+
+	var coins []CryptoListing
+	if err := json.Unmarshal(body, &coins); err != nil {
+		Logger.ErrorContext(ctx, "Failed to decode coin list from Coingecko", "error", err)
+		return nil, err
+	}
+	return coins, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestCoinGecko(t *testing.T, handler http.HandlerFunc) *coinGeckoProvider {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	setVar(t, &coinGeckoBaseURL, server.URL)
+	setVar(t, &coinGeckoAPIKey, "demo-key")
+	return newCoinGeckoProvider(server.Client())
+}
+
+func TestCoinGeckoCoinQuote(t *testing.T) {
+	provider := newTestCoinGecko(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/coins/markets" || r.URL.Query().Get("ids") != "bitcoin" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get(coinGeckoAPIKeyHeader) != "demo-key" {
+			http.Error(w, "missing key", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`[{
+			"id": "bitcoin", "symbol": "btc", "current_price": 65000, "high_24h": 66000, "low_24h": 63000,
+			"total_volume": 30000000000, "price_change_24h": 1500, "last_updated": "2024-03-05T12:00:00Z"
+		}]`))
+	})
+
+	quote, err := provider.CoinQuote(context.Background(), "bitcoin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quote.Candles) != 1 {
+		t.Fatalf("got %d candles, want 1", len(quote.Candles))
+	}
+	c := quote.Candles[0]
+	if c.Open != 63500 || c.Close != 65000 || c.High != 66000 || c.Low != 63000 || c.Volume != 30000000000 {
+		t.Errorf("candle = %+v", c)
+	}
+	if !c.Timestamp.Equal(time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("timestamp = %s, want last_updated", c.Timestamp)
+	}
+}
+
+func TestCoinGeckoCoinQuoteUnknownCoin(t *testing.T) {
+	provider := newTestCoinGecko(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	})
+
+	if _, err := provider.CoinQuote(context.Background(), "not-a-coin"); !errors.Is(err, errUnknownSymbol) {
+		t.Fatalf("err = %v, want errUnknownSymbol", err)
+	}
+}
+
+func TestCoinGeckoCoinSeriesGroupsPointsIntoBars(t *testing.T) {
+	from := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+	to := from.Add(48 * time.Hour)
+	provider := newTestCoinGecko(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/coins/bitcoin/market_chart/range" || r.URL.Query().Get("from") != "1709510400" {
+			http.NotFound(w, r)
+			return
+		}
+		// Hourly points: two in the first day, one in the second.
+		w.Write([]byte(`{
+			"prices": [[1709514000000, 100], [1709560800000, 120], [1709600400000, 90]],
+			"total_volumes": [[1709514000000, 2400], [1709560800000, 4800], [1709600400000, 1200]]
+		}`))
+	})
+
+	quote, err := provider.CoinSeries(context.Background(), "bitcoin", SeriesQuery{Interval: "daily", From: from, To: to})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quote.Candles) != 2 {
+		t.Fatalf("got %d candles, want 2", len(quote.Candles))
+	}
+	day := quote.Candles[0]
+	if !day.Timestamp.Equal(from) || day.Open != 100 || day.High != 120 || day.Low != 100 || day.Close != 120 || day.Volume != 3600 {
+		t.Errorf("first bar = %+v", day)
+	}
+	if next := quote.Candles[1]; !next.Timestamp.Equal(from.Add(24*time.Hour)) || next.Close != 90 {
+		t.Errorf("second bar = %+v", next)
+	}
+}
+
+func TestCoinGeckoCoinSeriesUnknownCoin(t *testing.T) {
+	provider := newTestCoinGecko(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"coin not found"}`, http.StatusNotFound)
+	})
+
+	_, err := provider.CoinSeries(context.Background(), "not-a-coin", SeriesQuery{Interval: "daily"})
+	if !errors.Is(err, errUnknownSymbol) {
+		t.Fatalf("err = %v, want errUnknownSymbol", err)
+	}
+}
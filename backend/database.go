@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/uptrace/opentelemetry-go-extra/otelgorm"
@@ -26,6 +27,18 @@ type User struct {
 	Username string `gorm:"size:100;unique"`
 	Email    string `gorm:"size:200;unique"`
 	Password string `json:"-"`
+
+	EmailVerifiedAt *time.Time `gorm:"default:null" json:"emailVerifiedAt"`
+	PendingEmail    string     `gorm:"size:200" json:"pendingEmail,omitempty"`
+
+	Role           string     `gorm:"size:20;default:user;index" json:"role"`
+	DisabledAt     *time.Time `gorm:"default:null" json:"disabledAt,omitempty"`
+	DisabledReason string     `gorm:"size:255" json:"disabledReason,omitempty"`
+
+	TwoFactorEnabledAt *time.Time `gorm:"default:null" json:"twoFactorEnabledAt"`
+	TOTPSecret         string     `gorm:"size:64" json:"-"`
+	TOTPPendingSecret  string     `gorm:"size:64" json:"-"`
+	TOTPLastStep       int64      `json:"-"`
 }
 
 type UserSymbols struct {
@@ -38,6 +51,231 @@ type UserSymbols struct {
 	CryptoId string `gorm:"size:200;default:null"`
 }
 
+// RefreshToken is one link in a rotating refresh token chain. Every token
+// issued from the same login shares a FamilyID, so reuse of a rotated token
+// can revoke the whole chain at once.
+type RefreshToken struct {
+	ID         int        `gorm:"primaryKey;autoIncrement"`
+	UserID     int        `gorm:"index"`
+	User       User       `gorm:"foreignKey:UserID"`
+	FamilyID   string     `gorm:"size:64;index"`
+	TokenHash  string     `gorm:"size:64;uniqueIndex"`
+	ExpiresAt  time.Time  `gorm:"index"`
+	RotatedAt  *time.Time `gorm:"default:null"`
+	RevokedAt  *time.Time `gorm:"default:null"`
+	UserAgent  string     `gorm:"size:500"`
+	RemoteAddr string     `gorm:"size:100"`
+	CreatedAt  time.Time
+}
+
+func (RefreshToken) TableName() string {
+	return "refresh_tokens"
+}
+
+// EmailVerificationToken confirms the account email, or with Email set, the
+// new address of a pending email change.
+type EmailVerificationToken struct {
+	ID        int    `gorm:"primaryKey;autoIncrement"`
+	UserID    int    `gorm:"index"`
+	User      User   `gorm:"foreignKey:UserID"`
+	TokenHash string `gorm:"size:64;uniqueIndex"`
+	Email     string `gorm:"size:200"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time `gorm:"default:null"`
+	CreatedAt time.Time
+}
+
+func (EmailVerificationToken) TableName() string {
+	return "email_verification_tokens"
+}
+
+type PasswordResetToken struct {
+	ID         int    `gorm:"primaryKey;autoIncrement"`
+	UserID     int    `gorm:"index"`
+	User       User   `gorm:"foreignKey:UserID"`
+	TokenHash  string `gorm:"size:64;uniqueIndex"`
+	ExpiresAt  time.Time
+	UsedAt     *time.Time `gorm:"default:null"`
+	RemoteAddr string     `gorm:"size:100"`
+	CreatedAt  time.Time
+}
+
+func (PasswordResetToken) TableName() string {
+	return "password_reset_tokens"
+}
+
+type RecoveryCode struct {
+	ID        int        `gorm:"primaryKey;autoIncrement"`
+	UserID    int        `gorm:"index"`
+	User      User       `gorm:"foreignKey:UserID"`
+	CodeHash  string     `gorm:"size:64;index"`
+	UsedAt    *time.Time `gorm:"default:null"`
+	CreatedAt time.Time
+}
+
+func (RecoveryCode) TableName() string {
+	return "recovery_codes"
+}
+
+// TwoFactorChallenge is handed out by loginUser in place of a token when the
+// account has two-factor authentication enabled.
+type TwoFactorChallenge struct {
+	ID         int    `gorm:"primaryKey;autoIncrement"`
+	UserID     int    `gorm:"index"`
+	User       User   `gorm:"foreignKey:UserID"`
+	TokenHash  string `gorm:"size:64;uniqueIndex"`
+	ExpiresAt  time.Time
+	Attempts   int
+	UsedAt     *time.Time `gorm:"default:null"`
+	RemoteAddr string     `gorm:"size:100"`
+	CreatedAt  time.Time
+}
+
+func (TwoFactorChallenge) TableName() string {
+	return "two_factor_challenges"
+}
+
+// APIToken is a long-lived personal token for scripts. Only the hash is
+// stored; Prefix is kept so users can tell their tokens apart.
+type APIToken struct {
+	ID         int        `gorm:"primaryKey;autoIncrement"`
+	UserID     int        `gorm:"index"`
+	User       User       `gorm:"foreignKey:UserID"`
+	Name       string     `gorm:"size:100"`
+	Prefix     string     `gorm:"size:16"`
+	TokenHash  string     `gorm:"size:64;uniqueIndex"`
+	Scopes     string     `gorm:"size:200"`
+	ExpiresAt  time.Time  `gorm:"index"`
+	LastUsedAt *time.Time `gorm:"default:null"`
+	RevokedAt  *time.Time `gorm:"default:null"`
+	CreatedAt  time.Time
+}
+
+func (APIToken) TableName() string {
+	return "api_tokens"
+}
+
+// UserIdentity links a User to an account at an external OIDC provider.
+type UserIdentity struct {
+	ID          int    `gorm:"primaryKey;autoIncrement"`
+	UserID      int    `gorm:"index"`
+	User        User   `gorm:"foreignKey:UserID"`
+	Provider    string `gorm:"size:100;uniqueIndex:idx_user_identities_provider_subject"`
+	Subject     string `gorm:"size:255;uniqueIndex:idx_user_identities_provider_subject"`
+	Email       string `gorm:"size:200"`
+	LastLoginAt time.Time
+	CreatedAt   time.Time
+}
+
+func (UserIdentity) TableName() string {
+	return "user_identities"
+}
+
+// OIDCLoginState carries the state, PKCE verifier and nonce of an OIDC login
+// between the redirect to the provider and the callback.
+type OIDCLoginState struct {
+	ID           int    `gorm:"primaryKey;autoIncrement"`
+	StateHash    string `gorm:"size:64;uniqueIndex"`
+	CodeVerifier string `gorm:"size:128"`
+	Nonce        string `gorm:"size:64"`
+	ExpiresAt    time.Time
+	UsedAt       *time.Time `gorm:"default:null"`
+	CreatedAt    time.Time
+}
+
+func (OIDCLoginState) TableName() string {
+	return "oidc_login_states"
+}
+
+// AuditEvent records a security relevant change to an account or an
+// authentication attempt. ActorID is the user who made the change, which
+// differs from UserID for admin actions, and is 0 once the actor's account
+// has been deleted. Outcome is set for authentication events; UserID is 0
+// when a login names an unknown account.
+type AuditEvent struct {
+	ID         int       `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID     int       `gorm:"index" json:"userId"`
+	ActorID    int       `json:"actorId"`
+	Action     string    `gorm:"size:64;index" json:"action"`
+	Outcome    string    `gorm:"size:32;index" json:"outcome,omitempty"`
+	Details    string    `gorm:"type:text" json:"details,omitempty"`
+	RemoteAddr string    `gorm:"size:100" json:"remoteAddr"`
+	UserAgent  string    `gorm:"size:500" json:"userAgent"`
+	TraceID    string    `gorm:"size:32" json:"traceId"`
+	CreatedAt  time.Time `gorm:"index" json:"createdAt"`
+}
+
+func (AuditEvent) TableName() string {
+	return "audit_events"
+}
+
+// StockListing is one row of the provider's listing catalog (AlphaVantage
+// LISTING_STATUS), kept locally for symbol search.
+type StockListing struct {
+	ID            int        `gorm:"primaryKey;autoIncrement" json:"-"`
+	Symbol        string     `gorm:"size:20;uniqueIndex:idx_stock_listings_symbol_exchange" json:"symbol"`
+	Name          string     `gorm:"size:255" json:"name"`
+	Exchange      string     `gorm:"size:50;uniqueIndex:idx_stock_listings_symbol_exchange" json:"exchange"`
+	AssetType     string     `gorm:"size:20" json:"assetType"`
+	IPODate       *time.Time `gorm:"type:date" json:"ipoDate,omitempty"`
+	DelistingDate *time.Time `gorm:"type:date" json:"delistingDate,omitempty"`
+	Status        string     `gorm:"size:20;index" json:"status"`
+	SyncedAt      time.Time  `gorm:"index" json:"-"`
+}
+
+func (StockListing) TableName() string {
+	return "stock_listings"
+}
+
+// CryptoListing is one coin of the provider's coin list. MarketCapRank is
+// only known for the top coins and is used to rank search results.
+type CryptoListing struct {
+	ID            string    `gorm:"primaryKey;size:100" json:"id"`
+	Symbol        string    `gorm:"size:100;index" json:"symbol"`
+	Name          string    `gorm:"size:255" json:"name"`
+	MarketCapRank *int      `json:"marketCapRank,omitempty"`
+	SyncedAt      time.Time `gorm:"index" json:"-"`
+}
+
+func (CryptoListing) TableName() string {
+	return "crypto_listings"
+}
+
+// PriceBar is one stored daily candle. Stock symbols are stored upper case,
+// crypto under the CoinGecko coin id.
+type PriceBar struct {
+	Type      string    `gorm:"primaryKey;size:10"`
+	Symbol    string    `gorm:"primaryKey;size:100"`
+	Timestamp time.Time `gorm:"primaryKey;column:ts"`
+	Open      float64
+	High      float64
+	Low       float64
+	Close     float64
+	Volume    float64
+	Currency  string `gorm:"size:10"`
+	Source    string `gorm:"size:50"`
+	SyncedAt  time.Time
+}
+
+func (PriceBar) TableName() string {
+	return "price_history"
+}
+
+// PriceHistoryCoverage is the range of a symbol's history that has been
+// fetched from the provider. From is the start of a UTC day; To is the time
+// of the last fetch. Days in the range without a bar had no trading.
+type PriceHistoryCoverage struct {
+	Type     string    `gorm:"primaryKey;size:10"`
+	Symbol   string    `gorm:"primaryKey;size:100"`
+	From     time.Time `gorm:"column:covered_from"`
+	To       time.Time `gorm:"column:covered_to"`
+	SyncedAt time.Time
+}
+
+func (PriceHistoryCoverage) TableName() string {
+	return "price_history_coverage"
+}
+
 func (UserSymbols) TableName() string {
 	return "user_symbols"
 }
@@ -179,10 +417,33 @@ func initDB() error {
 	DB.Callback().Delete().After("gorm:after_delete").Register("delete_metrics", recordGormMetricsAndSpanStatus)
 	DB.Callback().Raw().After("gorm:after_raw").Register("raw_metrics", recordGormMetricsAndSpanStatus)
 
-	if err := DB.AutoMigrate(&UserSymbols{}, &User{}); err != nil {
+	// Accounts created before email verification existed are treated as
+	// verified, so the new column must not lock them out.
+	backfillEmailVerified := !DB.Migrator().HasColumn(&User{}, "EmailVerifiedAt")
+
+	if err := DB.AutoMigrate(&UserSymbols{}, &User{}, &RefreshToken{}, &EmailVerificationToken{}, &PasswordResetToken{},
+		&RecoveryCode{}, &TwoFactorChallenge{}, &APIToken{},
+		&UserIdentity{}, &OIDCLoginState{}, &AuditEvent{},
+		&StockListing{}, &CryptoListing{}, &PriceBar{}, &PriceHistoryCoverage{}); err != nil {
 		return fmt.Errorf("error migrating database: %w", err)
 	}
 
+	setupSymbolSearchIndexes()
+
+	if backfillEmailVerified {
+		if err := DB.Model(&User{}).Where("email_verified_at IS NULL").
+			Update("email_verified_at", gorm.Expr("created_at")).Error; err != nil {
+			return fmt.Errorf("error backfilling email verification: %w", err)
+		}
+	}
+
+	if len(adminEmails) > 0 {
+		if err := DB.Model(&User{}).Where("email IN ?", adminEmails).
+			Update("role", roleAdmin).Error; err != nil {
+			return fmt.Errorf("error promoting admin users: %w", err)
+		}
+	}
+
 	fmt.Println("Database connected and instrumented successfully")
 	return nil
 }
@@ -206,6 +467,36 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+		log.Printf("Invalid integer for %s=%q, using default %d", key, value, defaultValue)
+	}
+	return defaultValue
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.ParseBool(value); err == nil {
+			return parsed
+		}
+		log.Printf("Invalid boolean for %s=%q, using default %t", key, value, defaultValue)
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil {
+			return parsed
+		}
+		log.Printf("Invalid duration for %s=%q, using default %s", key, value, defaultValue)
+	}
+	return defaultValue
+}
+
 func CloseDB() error {
 	if DB != nil {
 		sqlDB, err := DB.DB()
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestMain(m *testing.M) {
+	Logger = slog.New(slog.DiscardHandler)
+	os.Exit(m.Run())
+}
+
+// setupTestDB points DB at a fresh SQLite database with every model
+// migrated, and restores the previous DB when the test ends.
+func setupTestDB(t *testing.T) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := gorm.Open(sqlite.Open(path+"?_busy_timeout=5000"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("opening test database: %v", err)
+	}
+	if err := db.AutoMigrate(&UserSymbols{}, &User{}, &RefreshToken{}, &EmailVerificationToken{}, &PasswordResetToken{},
+		&RecoveryCode{}, &TwoFactorChallenge{}, &APIToken{},
+		&UserIdentity{}, &OIDCLoginState{}, &AuditEvent{},
+		&StockListing{}, &CryptoListing{}, &PriceBar{}, &PriceHistoryCoverage{}); err != nil {
+		t.Fatalf("migrating test database: %v", err)
+	}
+
+	previous := DB
+	DB = db
+	t.Cleanup(func() {
+		DB = previous
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+}
+
+// setupTestSigningKeys gives the test its own key ring in a temporary
+// directory.
+func setupTestSigningKeys(t *testing.T) {
+	t.Helper()
+
+	ring := &keyRing{dir: t.TempDir()}
+	if err := ring.refresh(); err != nil {
+		t.Fatalf("creating signing key: %v", err)
+	}
+	previous := signingKeys
+	signingKeys = ring
+	t.Cleanup(func() { signingKeys = previous })
+}
+
+// setVar sets *v for the duration of the test.
+func setVar[T any](t *testing.T, v *T, value T) {
+	t.Helper()
+	previous := *v
+	*v = value
+	t.Cleanup(func() { *v = previous })
+}
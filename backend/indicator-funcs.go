@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	indicatorMinPeriod = 2
+	indicatorMaxPeriod = 200
+)
+
+// IndicatorResponse is the response of the indicator endpoints. Periods holds
+// the period used for each requested indicator.
+type IndicatorResponse struct {
+	Symbol     string           `json:"symbol"`
+	Type       string           `json:"type"`
+	Interval   string           `json:"interval"`
+	Indicators []string         `json:"indicators"`
+	Periods    map[string]int   `json:"periods"`
+	Points     []IndicatorPoint `json:"points"`
+}
+
+func getStockIndicators(w http.ResponseWriter, r *http.Request) {
+	serveIndicators(w, r, "STOCK", "/stocks/{symbol}/indicators")
+}
+
+func getCryptoIndicators(w http.ResponseWriter, r *http.Request) {
+	serveIndicators(w, r, "CRYPTO", "/crypto/{symbol}/indicators")
+}
+
+// readIndicatorRequest reads type, period, from and to. It writes the
+// validation error and returns false when they are invalid.
+func readIndicatorRequest(w http.ResponseWriter, r *http.Request, span trace.Span) ([]string, map[string]int, SeriesQuery, bool) {
+	query := r.URL.Query()
+	var v Validator
+
+	var names []string
+	seen := map[string]bool{}
+	if v.Required("type", query.Get("type")) {
+		for _, name := range strings.Split(query.Get("type"), ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			v.OneOf("type", name, indicatorNames)
+			names = append(names, name)
+		}
+	}
+
+	period := 0
+	if value := query.Get("period"); value != "" {
+		p, err := strconv.Atoi(value)
+		if err != nil || p < indicatorMinPeriod || p > indicatorMaxPeriod {
+			v.Add("period", "INVALID_VALUE", fmt.Sprintf("period must be a whole number from %d to %d", indicatorMinPeriod, indicatorMaxPeriod))
+		}
+		period = p
+	}
+
+	var series SeriesQuery
+	readQueryRange(&v, query, &series)
+
+	if !v.Valid() {
+		recordValidationFailure(span, v.Errors)
+		writeValidationError(w, v.Errors)
+		return nil, nil, SeriesQuery{}, false
+	}
+
+	periods := make(map[string]int, len(names))
+	for _, name := range names {
+		switch {
+		case name == "macd":
+			periods[name] = macdSlowPeriod
+		case period > 0:
+			periods[name] = period
+		default:
+			periods[name] = indicatorDefaultPeriods[name]
+		}
+	}
+	return names, periods, series, true
+}
+
+func serveIndicators(w http.ResponseWriter, r *http.Request, assetType, route string) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	ctx, span := tracer.Start(ctx, "getIndicatorsHandler")
+	defer span.End()
+
+	Logger.InfoContext(ctx, "Handler execution started", "method", r.Method, "target", r.URL.Path)
+
+	span.SetAttributes(
+		attribute.String("http.method", r.Method),
+		attribute.String("http.route", route),
+		attribute.String("asset.type", assetType),
+	)
+
+	if httpRequestCount != nil {
+		httpRequestCount.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("endpoint", route),
+			attribute.String("method", r.Method)))
+	}
+
+	symbol := mux.Vars(r)["symbol"]
+	if symbol == "" {
+		span.SetStatus(codes.Error, "Missing symbol in request")
+		http.Error(w, "Symbol is required", http.StatusBadRequest)
+		return
+	}
+	var v Validator
+	if assetType == "STOCK" {
+		v.Symbol("symbol", symbol)
+	} else {
+		v.CryptoID("symbol", symbol)
+	}
+	if !v.Valid() {
+		recordValidationFailure(span, v.Errors)
+		writeValidationError(w, v.Errors)
+		return
+	}
+
+	names, periods, series, ok := readIndicatorRequest(w, r, span)
+	if !ok {
+		return
+	}
+
+	// The indicators need candles before the first point returned, so the
+	// series starts earlier by the warm-up, converted to calendar days.
+	to := series.To
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+	// Points are daily bars, so the day containing from is the first one.
+	from := dayStart(series.From)
+	if series.From.IsZero() {
+		from = historyDefaultFrom(assetType, to)
+	}
+	warmup := indicatorWarmup(periods)
+	warmupDays := warmup
+	if assetType == "STOCK" {
+		warmupDays = warmup*7/5 + 10
+	}
+
+	quote, err := readDailyHistory(ctx, assetType, symbol, SeriesQuery{
+		Interval: "daily",
+		From:     from.AddDate(0, 0, -warmupDays),
+		To:       to,
+	})
+	if err != nil {
+		span.SetStatus(codes.Error, fmt.Sprintf("Reading price series failed: %v", err))
+		span.RecordError(err)
+		Logger.ErrorContext(ctx, "Reading price series for indicators failed", "error", err, "symbol", symbol)
+		writeProviderError(w, err)
+		return
+	}
+
+	sort.Strings(names)
+	_, computeSpan := tracer.Start(ctx, "compute_indicators", trace.WithAttributes(
+		attribute.StringSlice("indicators.types", names),
+		attribute.Int("indicators.warmup_bars", warmup),
+		attribute.Int("candles.count", len(quote.Candles)),
+	))
+	points := computeIndicators(quote.Candles, periods, from)
+	computeSpan.SetAttributes(attribute.Int("points.count", len(points)))
+	computeSpan.End()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(IndicatorResponse{
+		Symbol:     quote.Symbol,
+		Type:       assetType,
+		Interval:   quote.Interval,
+		Indicators: names,
+		Periods:    periods,
+		Points:     points,
+	}); err != nil {
+		span.SetStatus(codes.Error, fmt.Sprintf("Failed to encode JSON response: %v", err))
+		span.RecordError(err)
+		Logger.ErrorContext(ctx, "Failed to encode JSON response for indicators", "error", err, "symbol", symbol)
+		return
+	}
+	span.SetStatus(codes.Ok, "Indicators computed")
+	Logger.InfoContext(ctx, "Indicators computed and response sent", "symbol", symbol, "points", len(points))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestIndicatorsRejectInvalidSymbols(t *testing.T) {
+	for _, tt := range []struct {
+		handler http.HandlerFunc
+		symbol  string
+	}{
+		{getStockIndicators, "IBM;DROP"},
+		{getStockIndicators, "A-VERY-LONG-SYMBOL-NAME"},
+		{getCryptoIndicators, "Bitcoin"},
+		{getCryptoIndicators, "bit coin"},
+	} {
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/indicators?type=sma", nil), map[string]string{"symbol": tt.symbol})
+		rec := httptest.NewRecorder()
+		// Neither the database nor a provider is set up; reaching either panics.
+		tt.handler(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("symbol %q: status %d, want 400", tt.symbol, rec.Code)
+			continue
+		}
+		var resp ErrorResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if len(resp.Fields) != 1 || resp.Fields[0].Field != "symbol" {
+			t.Errorf("symbol %q: fields = %+v, want a symbol error", tt.symbol, resp.Fields)
+		}
+	}
+}
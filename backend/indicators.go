@@ -0,0 +1,262 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Indicators served by /stocks/{symbol}/indicators and
+// /crypto/{symbol}/indicators. The period parameter applies to sma, ema, rsi
+// and bbands; MACD always uses the conventional 12, 26 and 9.
+var indicatorNames = []string{"sma", "ema", "rsi", "macd", "bbands"}
+
+var indicatorDefaultPeriods = map[string]int{
+	"sma":    20,
+	"ema":    20,
+	"rsi":    14,
+	"bbands": 20,
+}
+
+const (
+	macdFastPeriod   = 12
+	macdSlowPeriod   = 26
+	macdSignalPeriod = 9
+	bbandsDeviations = 2
+)
+
+// MACDValue is the MACD line, its signal line and their difference.
+type MACDValue struct {
+	MACD      float64 `json:"macd"`
+	Signal    float64 `json:"signal"`
+	Histogram float64 `json:"histogram"`
+}
+
+// BollingerValue is the moving average and the bands two standard
+// deviations above and below it.
+type BollingerValue struct {
+	Upper  float64 `json:"upper"`
+	Middle float64 `json:"middle"`
+	Lower  float64 `json:"lower"`
+}
+
+// IndicatorPoint holds the requested indicators at one candle. An indicator
+// is left out until enough candles have been seen to compute it.
+type IndicatorPoint struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Close     float64         `json:"close"`
+	SMA       *float64        `json:"sma,omitempty"`
+	EMA       *float64        `json:"ema,omitempty"`
+	RSI       *float64        `json:"rsi,omitempty"`
+	MACD      *MACDValue      `json:"macd,omitempty"`
+	BBands    *BollingerValue `json:"bbands,omitempty"`
+}
+
+// movingWindow keeps the last period values with their sum and sum of
+// squares, for the simple moving average and the Bollinger bands.
+type movingWindow struct {
+	values []float64
+	next   int
+	count  int
+	sum    float64
+	sumSq  float64
+}
+
+func newMovingWindow(period int) *movingWindow {
+	return &movingWindow{values: make([]float64, period)}
+}
+
+func (m *movingWindow) add(v float64) bool {
+	if m.count == len(m.values) {
+		old := m.values[m.next]
+		m.sum -= old
+		m.sumSq -= old * old
+	} else {
+		m.count++
+	}
+	m.values[m.next] = v
+	m.next = (m.next + 1) % len(m.values)
+	m.sum += v
+	m.sumSq += v * v
+	return m.count == len(m.values)
+}
+
+func (m *movingWindow) mean() float64 {
+	return m.sum / float64(m.count)
+}
+
+// stddev is the population standard deviation, as used for Bollinger bands.
+func (m *movingWindow) stddev() float64 {
+	mean := m.mean()
+	return math.Sqrt(math.Max(m.sumSq/float64(m.count)-mean*mean, 0))
+}
+
+// emaCalc is an exponential moving average seeded with the simple average of
+// its first period values.
+type emaCalc struct {
+	period int
+	alpha  float64
+	seed   float64
+	count  int
+	value  float64
+}
+
+func newEMA(period int) *emaCalc {
+	return &emaCalc{period: period, alpha: 2 / float64(period+1)}
+}
+
+func (e *emaCalc) add(v float64) (float64, bool) {
+	e.count++
+	switch {
+	case e.count < e.period:
+		e.seed += v
+		return 0, false
+	case e.count == e.period:
+		e.value = (e.seed + v) / float64(e.period)
+	default:
+		e.value += e.alpha * (v - e.value)
+	}
+	return e.value, true
+}
+
+// rsiCalc is Wilder's relative strength index: average gains and losses are
+// seeded with the simple average over the first period changes and smoothed
+// with 1/period after that.
+type rsiCalc struct {
+	period  int
+	count   int
+	prev    float64
+	avgGain float64
+	avgLoss float64
+}
+
+func newRSI(period int) *rsiCalc {
+	return &rsiCalc{period: period}
+}
+
+func (r *rsiCalc) add(v float64) (float64, bool) {
+	r.count++
+	if r.count == 1 {
+		r.prev = v
+		return 0, false
+	}
+	change := v - r.prev
+	r.prev = v
+	gain, loss := math.Max(change, 0), math.Max(-change, 0)
+
+	changes := r.count - 1
+	p := float64(r.period)
+	switch {
+	case changes < r.period:
+		r.avgGain += gain
+		r.avgLoss += loss
+		return 0, false
+	case changes == r.period:
+		r.avgGain = (r.avgGain + gain) / p
+		r.avgLoss = (r.avgLoss + loss) / p
+	default:
+		r.avgGain = (r.avgGain*(p-1) + gain) / p
+		r.avgLoss = (r.avgLoss*(p-1) + loss) / p
+	}
+	if r.avgLoss == 0 {
+		return 100, true
+	}
+	return 100 - 100/(1+r.avgGain/r.avgLoss), true
+}
+
+// macdCalc is the difference of the fast and slow EMAs, with an EMA of that
+// difference as signal line.
+type macdCalc struct {
+	fast, slow, signal *emaCalc
+}
+
+func newMACD() *macdCalc {
+	return &macdCalc{fast: newEMA(macdFastPeriod), slow: newEMA(macdSlowPeriod), signal: newEMA(macdSignalPeriod)}
+}
+
+func (m *macdCalc) add(v float64) (MACDValue, bool) {
+	fast, _ := m.fast.add(v)
+	slow, ok := m.slow.add(v)
+	if !ok {
+		return MACDValue{}, false
+	}
+	line := fast - slow
+	signal, ok := m.signal.add(line)
+	if !ok {
+		return MACDValue{}, false
+	}
+	return MACDValue{MACD: line, Signal: signal, Histogram: line - signal}, true
+}
+
+// indicatorWarmup is how many candles before the first returned point are
+// needed for the indicators to settle. Averages need one period; the
+// exponential ones keep a trace of their seed for a few periods more.
+func indicatorWarmup(periods map[string]int) int {
+	warmup := 0
+	for name, period := range periods {
+		bars := period
+		switch name {
+		case "ema", "rsi":
+			bars = 3 * period
+		case "macd":
+			bars = 3*macdSlowPeriod + macdSignalPeriod
+		}
+		warmup = max(warmup, bars)
+	}
+	return warmup
+}
+
+// computeIndicators makes one pass over the candles, oldest first, feeding
+// every requested indicator, and returns the points from from on.
+func computeIndicators(candles []Candle, periods map[string]int, from time.Time) []IndicatorPoint {
+	var sma, bbands *movingWindow
+	var ema *emaCalc
+	var rsi *rsiCalc
+	var macd *macdCalc
+	if p, ok := periods["sma"]; ok {
+		sma = newMovingWindow(p)
+	}
+	if p, ok := periods["bbands"]; ok {
+		bbands = newMovingWindow(p)
+	}
+	if p, ok := periods["ema"]; ok {
+		ema = newEMA(p)
+	}
+	if p, ok := periods["rsi"]; ok {
+		rsi = newRSI(p)
+	}
+	if _, ok := periods["macd"]; ok {
+		macd = newMACD()
+	}
+
+	points := []IndicatorPoint{}
+	for _, c := range candles {
+		point := IndicatorPoint{Timestamp: c.Timestamp, Close: c.Close}
+		if sma != nil && sma.add(c.Close) {
+			value := sma.mean()
+			point.SMA = &value
+		}
+		if bbands != nil && bbands.add(c.Close) {
+			middle, width := bbands.mean(), bbandsDeviations*bbands.stddev()
+			point.BBands = &BollingerValue{Upper: middle + width, Middle: middle, Lower: middle - width}
+		}
+		if ema != nil {
+			if value, ok := ema.add(c.Close); ok {
+				point.EMA = &value
+			}
+		}
+		if rsi != nil {
+			if value, ok := rsi.add(c.Close); ok {
+				point.RSI = &value
+			}
+		}
+		if macd != nil {
+			if value, ok := macd.add(c.Close); ok {
+				point.MACD = &value
+			}
+		}
+		if !c.Timestamp.Before(from) {
+			points = append(points, point)
+		}
+	}
+	return points
+}
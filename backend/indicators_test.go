@@ -0,0 +1,249 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Closing prices of the StockCharts ChartSchool worked examples for moving
+// averages and RSI. The expected values below follow the textbook
+// definitions: averages seeded with the simple average of their first
+// period, Wilder smoothing for RSI and the population deviation for
+// Bollinger bands.
+var (
+	chartSchoolMovingAverageCloses = []float64{
+		22.27, 22.19, 22.08, 22.17, 22.18, 22.13, 22.23, 22.43, 22.24, 22.29,
+		22.15, 22.39, 22.38, 22.61, 23.36, 24.05, 23.75, 23.83, 23.95, 23.63,
+		23.82, 23.87, 23.65, 23.19, 23.10, 23.33, 22.68, 23.10, 22.40, 22.17,
+	}
+	chartSchoolRSICloses = []float64{
+		44.34, 44.09, 44.15, 43.61, 44.33, 44.83, 45.10, 45.42, 45.84, 46.08,
+		45.89, 46.03, 45.61, 46.28, 46.28, 46.00, 46.03, 46.41, 46.22, 45.64,
+		46.21, 46.25, 45.71, 46.45, 45.78, 45.35, 44.03, 44.18, 44.22, 44.57,
+		43.42, 42.66, 43.13,
+	}
+	// An oscillating trend long enough for the MACD signal line, which needs
+	// 26 + 9 - 1 closes.
+	macdCloses = []float64{
+		100.00, 102.97, 105.79, 108.32, 110.41, 111.99, 112.97, 113.34, 113.09, 112.28,
+		110.98, 109.32, 107.41, 105.42, 103.49, 101.78, 100.43, 99.55, 99.22, 99.51,
+		100.41, 101.91, 103.94, 106.42, 109.21, 112.17, 115.15, 118.00, 120.57, 122.73,
+		124.38, 125.45, 125.89, 125.73, 124.98, 123.75, 122.12, 120.24, 118.25, 116.30,
+		114.56, 113.15, 112.20, 111.80, 112.00,
+	}
+)
+
+// dailyCandles turns closes into daily candles from 2024-01-01.
+func dailyCandles(closes []float64) []Candle {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	candles := make([]Candle, len(closes))
+	for i, c := range closes {
+		candles[i] = Candle{Timestamp: start.AddDate(0, 0, i), Open: c, High: c, Low: c, Close: c}
+	}
+	return candles
+}
+
+func smaOf(p IndicatorPoint) []float64 {
+	if p.SMA == nil {
+		return nil
+	}
+	return []float64{*p.SMA}
+}
+
+func emaOf(p IndicatorPoint) []float64 {
+	if p.EMA == nil {
+		return nil
+	}
+	return []float64{*p.EMA}
+}
+
+func rsiOf(p IndicatorPoint) []float64 {
+	if p.RSI == nil {
+		return nil
+	}
+	return []float64{*p.RSI}
+}
+
+func macdOf(p IndicatorPoint) []float64 {
+	if p.MACD == nil {
+		return nil
+	}
+	return []float64{p.MACD.MACD, p.MACD.Signal, p.MACD.Histogram}
+}
+
+func bbandsOf(p IndicatorPoint) []float64 {
+	if p.BBands == nil {
+		return nil
+	}
+	return []float64{p.BBands.Upper, p.BBands.Middle, p.BBands.Lower}
+}
+
+func TestIndicatorReferenceValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		periods map[string]int
+		closes  []float64
+		value   func(IndicatorPoint) []float64
+		// first is the index of the first candle with a value.
+		first int
+		want  [][]float64
+	}{
+		{
+			name: "sma(10)", periods: map[string]int{"sma": 10}, closes: chartSchoolMovingAverageCloses, value: smaOf, first: 9,
+			want: [][]float64{
+				{22.2210}, {22.2090}, {22.2290}, {22.2590}, {22.3030}, {22.4210}, {22.6130}, {22.7650}, {22.9050}, {23.0760},
+				{23.2100}, {23.3770}, {23.5250}, {23.6520}, {23.7100}, {23.6840}, {23.6120}, {23.5050}, {23.4320}, {23.2770},
+				{23.1310},
+			},
+		},
+		{
+			name: "ema(10)", periods: map[string]int{"ema": 10}, closes: chartSchoolMovingAverageCloses, value: emaOf, first: 9,
+			want: [][]float64{
+				{22.2210}, {22.2081}, {22.2412}, {22.2664}, {22.3289}, {22.5164}, {22.7952}, {22.9688}, {23.1254}, {23.2753},
+				{23.3398}, {23.4271}, {23.5076}, {23.5335}, {23.4711}, {23.4036}, {23.3902}, {23.2611}, {23.2318}, {23.0806},
+				{22.9150},
+			},
+		},
+		{
+			name: "rsi(14)", periods: map[string]int{"rsi": 14}, closes: chartSchoolRSICloses, value: rsiOf, first: 14,
+			want: [][]float64{
+				{70.4641}, {66.2496}, {66.4809}, {69.3469}, {66.2947}, {57.9150}, {62.8807}, {63.2088}, {56.0116}, {62.3399},
+				{54.6710}, {50.3868}, {40.0194}, {41.4926}, {41.9024}, {45.4995}, {37.3228}, {33.0905}, {37.7888},
+			},
+		},
+		{
+			name: "bbands(20, 2)", periods: map[string]int{"bbands": 20}, closes: chartSchoolMovingAverageCloses, value: bbandsOf, first: 19,
+			want: [][]float64{
+				{24.1261, 22.7155, 21.3049}, {24.2661, 22.7930, 21.3199}, {24.3939, 22.8770, 21.3601}, {24.4617, 22.9555, 21.4493},
+				{24.4714, 23.0065, 21.5416}, {24.4676, 23.0525, 21.6374}, {24.4665, 23.1125, 21.7585}, {24.4438, 23.1350, 21.8262},
+				{24.4371, 23.1685, 21.8999}, {24.4234, 23.1765, 21.9296}, {24.4355, 23.1705, 21.9055},
+			},
+		},
+		{
+			name: "macd(12, 26, 9)", periods: map[string]int{"macd": macdSlowPeriod}, closes: macdCloses, value: macdOf, first: 33,
+			want: [][]float64{
+				{4.8889, 2.4323, 2.4566}, {5.0227, 2.9504, 2.0723}, {4.9722, 3.3548, 1.6174}, {4.7459, 3.6330, 1.1129},
+				{4.3645, 3.7793, 0.5852}, {3.8573, 3.7949, 0.0624}, {3.2603, 3.6880, -0.4276}, {2.6167, 3.4737, -0.8570},
+				{1.9701, 3.1730, -1.2029}, {1.3653, 2.8115, -1.4462}, {0.8440, 2.4180, -1.5740}, {0.4419, 2.0227, -1.5809},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points := computeIndicators(dailyCandles(tt.closes), tt.periods, time.Time{})
+			if len(points) != len(tt.closes) {
+				t.Fatalf("got %d points, want one per candle", len(points))
+			}
+			if tt.first+len(tt.want) != len(points) {
+				t.Fatalf("test case has %d values from %d, want them up to the last of %d points", len(tt.want), tt.first, len(points))
+			}
+			for i, point := range points {
+				got := tt.value(point)
+				if i < tt.first {
+					if got != nil {
+						t.Errorf("point %d = %v, want no value before %d candles", i, got, tt.first+1)
+					}
+					continue
+				}
+				want := tt.want[i-tt.first]
+				if len(got) != len(want) {
+					t.Errorf("point %d = %v, want %v", i, got, want)
+					continue
+				}
+				for j := range want {
+					if math.Abs(got[j]-want[j]) > 1e-4 {
+						t.Errorf("point %d = %v, want %v", i, got, want)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+// On a steady rise of one per bar every average lags by a fixed amount, so
+// the values are known exactly.
+func TestIndicatorsOnLinearSeries(t *testing.T) {
+	closes := make([]float64, 120)
+	for i := range closes {
+		closes[i] = float64(i + 1)
+	}
+	periods := map[string]int{"sma": 20, "ema": 20, "rsi": 14, "macd": macdSlowPeriod, "bbands": 20}
+	points := computeIndicators(dailyCandles(closes), periods, time.Time{})
+
+	// The standard deviation of 20 consecutive integers is sqrt((20²-1)/12).
+	width := 2 * math.Sqrt(399.0/12)
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	for _, p := range points[40:] {
+		if !near(*p.SMA, p.Close-9.5) || !near(*p.EMA, p.Close-9.5) {
+			t.Fatalf("at %v: sma %v, ema %v, want both %v", p.Close, *p.SMA, *p.EMA, p.Close-9.5)
+		}
+		if *p.RSI != 100 {
+			t.Fatalf("at %v: rsi %v, want 100 without losses", p.Close, *p.RSI)
+		}
+		// (26-1)/2 - (12-1)/2 = 7
+		if !near(p.MACD.MACD, 7) || !near(p.MACD.Signal, 7) || !near(p.MACD.Histogram, 0) {
+			t.Fatalf("at %v: macd %+v, want 7, 7, 0", p.Close, *p.MACD)
+		}
+		if !near(p.BBands.Middle, p.Close-9.5) || !near(p.BBands.Upper-p.BBands.Middle, width) || !near(p.BBands.Middle-p.BBands.Lower, width) {
+			t.Fatalf("at %v: bbands %+v, want %v ± %v", p.Close, *p.BBands, p.Close-9.5, width)
+		}
+	}
+}
+
+func TestIndicatorWarmup(t *testing.T) {
+	tests := []struct {
+		periods map[string]int
+		want    int
+	}{
+		{map[string]int{"sma": 20}, 20},
+		{map[string]int{"bbands": 50}, 50},
+		{map[string]int{"ema": 20}, 60},
+		{map[string]int{"rsi": 14}, 42},
+		{map[string]int{"macd": macdSlowPeriod}, 3*macdSlowPeriod + macdSignalPeriod},
+		{map[string]int{"sma": 200, "rsi": 14, "macd": macdSlowPeriod}, 200},
+	}
+	for _, tt := range tests {
+		if got := indicatorWarmup(tt.periods); got != tt.want {
+			t.Errorf("indicatorWarmup(%v) = %d, want %d", tt.periods, got, tt.want)
+		}
+	}
+}
+
+func TestComputeIndicatorsFromCutoff(t *testing.T) {
+	closes := make([]float64, 200)
+	for i := range closes {
+		closes[i] = 100 + 10*math.Sin(float64(i)/7)
+	}
+	candles := dailyCandles(closes)
+	periods := map[string]int{"sma": 20, "ema": 20, "rsi": 14, "macd": macdSlowPeriod, "bbands": 20}
+	warmup := indicatorWarmup(periods)
+	all := computeIndicators(candles, periods, time.Time{})
+
+	from := candles[warmup].Timestamp
+	points := computeIndicators(candles, periods, from)
+	if len(points) != len(candles)-warmup {
+		t.Fatalf("got %d points from %s, want %d", len(points), from, len(candles)-warmup)
+	}
+	if !points[0].Timestamp.Equal(from) {
+		t.Errorf("first point at %s, want %s", points[0].Timestamp, from)
+	}
+	// The cut-off only hides points; the candles before it still feed the
+	// indicators.
+	if !reflect.DeepEqual(points, all[warmup:]) {
+		t.Error("points after the cut-off differ from the uncut series")
+	}
+	// With the warm-up in front, every indicator has a value at the first
+	// point returned.
+	first := points[0]
+	if first.SMA == nil || first.EMA == nil || first.RSI == nil || first.MACD == nil || first.BBands == nil {
+		t.Errorf("first point after the warm-up is missing values: %+v", first)
+	}
+
+	// A from between two bars starts at the next one.
+	if points := computeIndicators(candles, periods, from.Add(-12*time.Hour)); !points[0].Timestamp.Equal(from) {
+		t.Errorf("from half a day before a bar: first point at %s, want %s", points[0].Timestamp, from)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	jwtIssuer = getEnv("JWT_ISSUER", "stock-tracker-service")
+	jwtTTL    = getEnvDuration("JWT_TTL", 15*time.Minute)
+)
+
+var errInvalidTokenSubject = errors.New("token subject is not a valid user id")
+
+type AuthClaims struct {
+	Username  string `json:"username"`
+	SessionID string `json:"sid,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// generateJWT issues a short-lived access token. sessionID is the refresh
+// token family the token belongs to, so revoking the family also revokes it.
+func generateJWT(user *User, sessionID string) (string, error) {
+	now := time.Now()
+	claims := AuthClaims{
+		Username:  user.Username,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer,
+			Subject:   strconv.Itoa(user.ID),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(jwtTTL)),
+		},
+	}
+
+	key, err := signingKeys.signingKey()
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+
+	signed, err := token.SignedString(key.Signer)
+	if err != nil {
+		return "", fmt.Errorf("error signing token: %w", err)
+	}
+	return signed, nil
+}
+
+// parseJWT validates the signature, issuer and expiry of a token and returns
+// its claims together with the user id from the subject. Tokens signed by a
+// retired key are accepted until that key's grace period ends.
+func parseJWT(tokenString string) (*AuthClaims, int, error) {
+	claims := &AuthClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims,
+		func(token *jwt.Token) (interface{}, error) {
+			kid, _ := token.Header["kid"].(string)
+			key, err := signingKeys.verificationKey(kid)
+			if err != nil {
+				return nil, err
+			}
+			if token.Method.Alg() != key.Method.Alg() {
+				return nil, fmt.Errorf("unexpected signing method %s for key %s", token.Method.Alg(), kid)
+			}
+			return key.Signer.Public(), nil
+		},
+		jwt.WithValidMethods(signingKeys.methods()),
+		jwt.WithIssuer(jwtIssuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil || userID <= 0 {
+		return nil, 0, errInvalidTokenSubject
+	}
+	return claims, userID, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The backend writes its JSON log to logDir/app.log, which fluentd tails into
+// Elasticsearch. Rotated copies sit next to it as app.log.<suffix>.
+var logDir = getEnv("LOG_DIR", "/fluentd/log")
+
+const (
+	appLogName          = "app.log"
+	redactionLogName    = "redactions.jsonl"
+	redactedPlaceholder = "[redacted]"
+)
+
+// RedactionRequest is appended to logDir/redactions.jsonl for every deleted
+// account. The live log and anything already shipped to Elasticsearch cannot
+// be rewritten from here, so downstream jobs use these entries to redact the
+// listed identifiers. Identifiers are the keyed hashes the log handler
+// writes in place of the plain values, so the file itself holds no personal
+// data.
+type RedactionRequest struct {
+	UserID        int       `json:"user_id"`
+	Identifiers   []string  `json:"identifiers"`
+	RequestedAt   time.Time `json:"requested_at"`
+	ScrubbedFiles []string  `json:"scrubbed_files"`
+	PendingFiles  []string  `json:"pending_files"`
+}
+
+// redactUserLogs scrubs the user's identifiers from the rotated log files,
+// which fluentd has finished reading, and records a redaction request for
+// the rest.
+func redactUserLogs(ctx context.Context, userID int, identifiers ...string) error {
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	ctx, span := tracer.Start(ctx, "privacy.redact_logs",
+		trace.WithAttributes(
+			attribute.Int("user_id", userID),
+			attribute.String("log.dir", logDir),
+		),
+	)
+	defer span.End()
+
+	var ids, hashed []string
+	for _, id := range identifiers {
+		if id == "" {
+			continue
+		}
+		ids = append(ids, id)
+		if piiRedactor != nil {
+			hashed = append(hashed, piiRedactor.hash(id))
+		}
+	}
+
+	request := RedactionRequest{
+		UserID:        userID,
+		Identifiers:   append([]string{}, hashed...),
+		RequestedAt:   time.Now().UTC(),
+		ScrubbedFiles: []string{},
+		PendingFiles:  []string{filepath.Join(logDir, appLogName)},
+	}
+
+	// Keys the log handler hashes hold the hashed form instead of the value.
+	targets := append(ids, hashed...)
+	rotated, err := filepath.Glob(filepath.Join(logDir, appLogName+".*"))
+	if err != nil {
+		span.RecordError(err)
+	}
+	for _, path := range rotated {
+		if strings.HasSuffix(path, ".gz") {
+			request.PendingFiles = append(request.PendingFiles, path)
+			continue
+		}
+		changed, err := scrubLogFile(path, userID, targets)
+		if err != nil {
+			span.RecordError(err)
+			request.PendingFiles = append(request.PendingFiles, path)
+			continue
+		}
+		if changed {
+			request.ScrubbedFiles = append(request.ScrubbedFiles, path)
+		}
+	}
+	span.SetAttributes(
+		attribute.Int("log.files_scrubbed", len(request.ScrubbedFiles)),
+		attribute.Int("log.files_pending", len(request.PendingFiles)),
+	)
+
+	f, err := os.OpenFile(filepath.Join(logDir, redactionLogName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to record redaction request")
+		return fmt.Errorf("error opening redaction log: %w", err)
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(request); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to record redaction request")
+		return fmt.Errorf("error writing redaction request: %w", err)
+	}
+
+	span.SetStatus(codes.Ok, "Redaction recorded")
+	return nil
+}
+
+// scrubLogFile rewrites path with every value that identifies the user
+// replaced, and reports whether anything changed.
+func scrubLogFile(path string, userID int, identifiers []string) (bool, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".scrub-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	changed := false
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	out := bufio.NewWriter(tmp)
+	for scanner.Scan() {
+		line, lineChanged := scrubLogLine(scanner.Text(), userID, identifiers)
+		changed = changed || lineChanged
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := out.Flush(); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if !changed {
+		return false, nil
+	}
+	return true, os.Rename(tmp.Name(), path)
+}
+
+func scrubLogLine(line string, userID int, identifiers []string) (string, bool) {
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		// Not a JSON record; only identifiers appearing verbatim can be found.
+		scrubbed := line
+		for _, id := range identifiers {
+			scrubbed = strings.ReplaceAll(scrubbed, id, redactedPlaceholder)
+		}
+		return scrubbed, scrubbed != line
+	}
+
+	changed := false
+	userIDText := strconv.Itoa(userID)
+	for key, value := range record {
+		switch v := value.(type) {
+		case string:
+			scrubbed := v
+			for _, id := range identifiers {
+				scrubbed = strings.ReplaceAll(scrubbed, id, redactedPlaceholder)
+			}
+			if isUserIDKey(key) && v == userIDText {
+				scrubbed = redactedPlaceholder
+			}
+			if scrubbed != v {
+				record[key] = scrubbed
+				changed = true
+			}
+		case float64:
+			if isUserIDKey(key) && v == float64(userID) {
+				record[key] = redactedPlaceholder
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return line, false
+	}
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return line, false
+	}
+	return string(encoded), true
+}
+
+func isUserIDKey(key string) bool {
+	switch key {
+	case "user_id", "userId", "userID", "authUserId":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedactUserLogs(t *testing.T) {
+	dir := t.TempDir()
+	setVar(t, &logDir, dir)
+	redactor := testRedactor(t)
+	setVar(t, &piiRedactor, redactor)
+
+	email := "alice@example.com"
+	rotated := filepath.Join(dir, appLogName+".1")
+	lines := []string{
+		`{"msg":"Login succeeded","user_id":42,"email":"` + redactor.hash(email) + `"}`,
+		`{"msg":"Mail sent to ` + email + `"}`,
+		`{"msg":"Login succeeded","user_id":7}`,
+	}
+	if err := os.WriteFile(rotated, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := redactUserLogs(context.Background(), 42, email, "", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	scrubbed, err := os.ReadFile(rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(scrubbed), email) || strings.Contains(string(scrubbed), redactor.hash(email)) {
+		t.Errorf("rotated log still identifies the user:\n%s", scrubbed)
+	}
+	if !strings.Contains(string(scrubbed), `"user_id":7`) {
+		t.Errorf("rotated log lost another user's record:\n%s", scrubbed)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, redactionLogName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), email) || strings.Contains(string(data), `"alice"`) {
+		t.Errorf("redaction log holds plain identifiers: %s", data)
+	}
+	var request RedactionRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{redactor.hash(email), redactor.hash("alice")}
+	if strings.Join(request.Identifiers, ",") != strings.Join(want, ",") {
+		t.Errorf("identifiers = %v, want %v", request.Identifiers, want)
+	}
+	if len(request.ScrubbedFiles) != 1 || request.ScrubbedFiles[0] != rotated {
+		t.Errorf("scrubbed files = %v, want %s", request.ScrubbedFiles, rotated)
+	}
+}
@@ -9,14 +9,24 @@ import (
 
 type OtelHandler struct {
 	slog.Handler
+	redactor *Redactor
 }
 
-func NewOtelHandler(base slog.Handler) *OtelHandler {
-	return &OtelHandler{Handler: base}
+func NewOtelHandler(base slog.Handler, redactor *Redactor) *OtelHandler {
+	return &OtelHandler{Handler: base, redactor: redactor}
 }
 
 func (h *OtelHandler) Handle(ctx context.Context, r slog.Record) error {
 
+	if h.redactor != nil {
+		redacted := slog.NewRecord(r.Time, r.Level, h.redactor.scrubString(r.Message), r.PC)
+		r.Attrs(func(a slog.Attr) bool {
+			redacted.AddAttrs(h.redactor.RedactSlogAttr(a))
+			return true
+		})
+		r = redacted
+	}
+
 	spanCtx := trace.SpanContextFromContext(ctx)
 	if spanCtx.IsValid() {
 		r.AddAttrs(
@@ -26,3 +36,17 @@ func (h *OtelHandler) Handle(ctx context.Context, r slog.Record) error {
 	}
 	return h.Handler.Handle(ctx, r)
 }
+
+// WithAttrs and WithGroup keep the wrapper in place so attributes bound with
+// Logger.With are redacted and records still get trace ids.
+func (h *OtelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, a := range attrs {
+		redacted = append(redacted, h.redactor.RedactSlogAttr(a))
+	}
+	return &OtelHandler{Handler: h.Handler.WithAttrs(redacted), redactor: h.redactor}
+}
+
+func (h *OtelHandler) WithGroup(name string) slog.Handler {
+	return &OtelHandler{Handler: h.Handler.WithGroup(name), redactor: h.redactor}
+}
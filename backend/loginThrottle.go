@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	loginRateWindow       = getEnvDuration("LOGIN_RATE_WINDOW", time.Minute)
+	loginRateLimitPerUser = getEnvInt("LOGIN_RATE_LIMIT_PER_EMAIL", 10)
+	loginRateLimitPerIP   = getEnvInt("LOGIN_RATE_LIMIT_PER_IP", 30)
+	loginLockoutThreshold = getEnvInt("LOGIN_LOCKOUT_THRESHOLD", 5)
+	loginLockoutDuration  = getEnvDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute)
+	loginDelayBase        = getEnvDuration("LOGIN_DELAY_BASE", 250*time.Millisecond)
+	loginDelayMax         = getEnvDuration("LOGIN_DELAY_MAX", 5*time.Second)
+)
+
+// Endpoints that send mail to an address given in the request are limited
+// to MAIL_RATE_LIMIT_PER_EMAIL messages per address and
+// MAIL_RATE_LIMIT_PER_IP requests per client within MAIL_RATE_WINDOW.
+var (
+	mailRateWindow       = getEnvDuration("MAIL_RATE_WINDOW", 15*time.Minute)
+	mailRateLimitPerUser = getEnvInt("MAIL_RATE_LIMIT_PER_EMAIL", 3)
+	mailRateLimitPerIP   = getEnvInt("MAIL_RATE_LIMIT_PER_IP", 10)
+)
+
+const (
+	throttleReasonLocked      = "account_locked"
+	throttleReasonEmailLimit  = "email_rate_limited"
+	throttleReasonIPRateLimit = "ip_rate_limited"
+)
+
+var (
+	loginLimiter = newLoginThrottle(loginRateWindow, loginRateLimitPerUser, loginRateLimitPerIP)
+	mailLimiter  = newLoginThrottle(mailRateWindow, mailRateLimitPerUser, mailRateLimitPerIP)
+)
+
+type loginFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// loginThrottle keeps sliding windows of login attempts per email and per
+// client address, and consecutive failures per email for progressive delays
+// and lockout. State is kept in memory, so limits apply per replica.
+type loginThrottle struct {
+	mu            sync.Mutex
+	window        time.Duration
+	limitPerEmail int
+	limitPerIP    int
+	attempts      map[string][]time.Time
+	failures      map[string]*loginFailures
+	lastSweep     time.Time
+}
+
+func newLoginThrottle(window time.Duration, limitPerEmail, limitPerIP int) *loginThrottle {
+	return &loginThrottle{
+		window:        window,
+		limitPerEmail: limitPerEmail,
+		limitPerIP:    limitPerIP,
+		attempts:      make(map[string][]time.Time),
+		failures:      make(map[string]*loginFailures),
+		lastSweep:     time.Now(),
+	}
+}
+
+func normalizeLoginEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// remoteHost strips the port from an http.Request RemoteAddr.
+func remoteHost(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// allow records an attempt for email and ip and reports whether it may
+// proceed. When it may not, it returns the reason and how long the caller
+// should wait before retrying.
+func (t *loginThrottle) allow(email, ip string) (bool, string, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.sweep(now)
+
+	if f, ok := t.failures[email]; ok && now.Before(f.lockedUntil) {
+		return false, throttleReasonLocked, f.lockedUntil.Sub(now)
+	}
+
+	if wait := t.windowWait("email:"+email, t.limitPerEmail, now); wait > 0 {
+		return false, throttleReasonEmailLimit, wait
+	}
+	if wait := t.windowWait("ip:"+ip, t.limitPerIP, now); wait > 0 {
+		return false, throttleReasonIPRateLimit, wait
+	}
+
+	t.attempts["email:"+email] = append(t.attempts["email:"+email], now)
+	t.attempts["ip:"+ip] = append(t.attempts["ip:"+ip], now)
+	return true, "", 0
+}
+
+// windowWait prunes attempts older than the window and returns how long until
+// the oldest remaining attempt leaves it, or zero if there is room.
+func (t *loginThrottle) windowWait(key string, limit int, now time.Time) time.Duration {
+	cutoff := now.Add(-t.window)
+	window := t.attempts[key]
+	i := 0
+	for i < len(window) && !window[i].After(cutoff) {
+		i++
+	}
+	window = window[i:]
+	if len(window) == 0 {
+		delete(t.attempts, key)
+		return 0
+	}
+	t.attempts[key] = window
+
+	if len(window) < limit {
+		return 0
+	}
+	return window[0].Sub(cutoff)
+}
+
+// delay is the progressive delay applied before checking credentials,
+// doubling with each consecutive failure for the email.
+func (t *loginThrottle) delay(email string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.failures[email]
+	if !ok || f.count == 0 {
+		return 0
+	}
+	d := loginDelayBase << (f.count - 1)
+	if d > loginDelayMax || d <= 0 {
+		d = loginDelayMax
+	}
+	return d
+}
+
+// recordFailure counts a failed login and locks the account once the
+// threshold is reached. It returns the lockout expiry when one was started.
+func (t *loginThrottle) recordFailure(email string) (bool, time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	f, ok := t.failures[email]
+	if !ok || now.Sub(f.lastFailure) > loginLockoutDuration {
+		f = &loginFailures{}
+		t.failures[email] = f
+	}
+	f.count++
+	f.lastFailure = now
+
+	if f.count >= loginLockoutThreshold {
+		f.lockedUntil = now.Add(loginLockoutDuration)
+		f.count = 0
+		return true, f.lockedUntil
+	}
+	return false, time.Time{}
+}
+
+func (t *loginThrottle) recordSuccess(email string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, email)
+}
+
+// sweep drops stale entries so the maps do not grow with every address or
+// email ever seen. Callers must hold t.mu.
+func (t *loginThrottle) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < t.window {
+		return
+	}
+	t.lastSweep = now
+
+	cutoff := now.Add(-t.window)
+	for key, window := range t.attempts {
+		if len(window) == 0 || !window[len(window)-1].After(cutoff) {
+			delete(t.attempts, key)
+		}
+	}
+	for email, f := range t.failures {
+		if now.After(f.lockedUntil) && now.Sub(f.lastFailure) > loginLockoutDuration {
+			delete(t.failures, email)
+		}
+	}
+}
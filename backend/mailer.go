@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type MailMessage struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// MailSender delivers transactional email such as verification links.
+type MailSender interface {
+	Send(ctx context.Context, msg MailMessage) error
+	Transport() string
+}
+
+var mailer MailSender = newMailSenderFromEnv()
+
+// newMailSenderFromEnv selects the sender with MAIL_SENDER. "smtp" delivers
+// through SMTP_HOST; anything else appends to a local outbox file so the
+// flows can be exercised without a mail server.
+func newMailSenderFromEnv() MailSender {
+	from := getEnv("MAIL_FROM", "no-reply@stock-tracker.local")
+
+	if getEnv("MAIL_SENDER", "file") == "smtp" {
+		return &SMTPMailSender{
+			Host:     getEnv("SMTP_HOST", "localhost"),
+			Port:     getEnv("SMTP_PORT", "587"),
+			Username: getEnv("SMTP_USERNAME", ""),
+			Password: getEnv("SMTP_PASSWORD", ""),
+			From:     from,
+		}
+	}
+	return &FileMailSender{
+		Path: getEnv("MAIL_OUTBOX_FILE", "outbox/mail.jsonl"),
+		From: from,
+	}
+}
+
+type SMTPMailSender struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s *SMTPMailSender) Transport() string { return "smtp" }
+
+func (s *SMTPMailSender) Send(ctx context.Context, msg MailMessage) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", s.From)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(msg.Body)
+
+	if err := smtp.SendMail(net.JoinHostPort(s.Host, s.Port), auth, s.From, []string{msg.To}, []byte(b.String())); err != nil {
+		return fmt.Errorf("error sending mail via smtp: %w", err)
+	}
+	return nil
+}
+
+// FileMailSender appends each message as a JSON line to Path.
+type FileMailSender struct {
+	Path string
+	From string
+	mu   sync.Mutex
+}
+
+func (s *FileMailSender) Transport() string { return "file" }
+
+func (s *FileMailSender) Send(ctx context.Context, msg MailMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0755); err != nil {
+		return fmt.Errorf("error creating outbox dir: %w", err)
+	}
+	f, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening outbox: %w", err)
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(struct {
+		From string `json:"from"`
+		MailMessage
+		SentAt time.Time `json:"sent_at"`
+	}{s.From, msg, time.Now().UTC()})
+}
+
+// sendMail delivers msg through the configured sender inside a mail.send
+// span, so it shows up as a child of the calling operation.
+func sendMail(ctx context.Context, msg MailMessage) error {
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	ctx, span := tracer.Start(ctx, "mail.send",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("mail.transport", mailer.Transport()),
+			attribute.String("mail.subject", msg.Subject),
+		),
+	)
+	defer span.End()
+
+	if err := mailer.Send(ctx, msg); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Mail delivery failed")
+		return err
+	}
+	span.SetStatus(codes.Ok, "Mail sent")
+	return nil
+}
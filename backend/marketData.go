@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sony/gobreaker/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Market data providers are picked per environment with STOCK_PROVIDER and
+// CRYPTO_PROVIDER. Base URLs can point at a local stand-in during tests.
+var (
+	stockProviderName  = getEnv("STOCK_PROVIDER", "alphavantage")
+	cryptoProviderName = getEnv("CRYPTO_PROVIDER", "coingecko")
+	marketDataTimeout  = getEnvDuration("MARKET_DATA_HTTP_TIMEOUT", 15*time.Second)
+)
+
+// StockProvider serves stock listings and price series. Series may return
+// bars outside the requested range; handlers trim them.
+type StockProvider interface {
+	Name() string
+	ListSymbols(ctx context.Context) ([]StockListing, error)
+	Series(ctx context.Context, symbol string, query SeriesQuery) (*Quote, error)
+}
+
+// CryptoProvider serves the coin list, per-coin quotes and price series.
+// ListCoins returns the top coins by market cap, in rank order; CoinList
+// returns every coin the provider knows. CoinSeries needs a bounded query.
+type CryptoProvider interface {
+	Name() string
+	ListCoins(ctx context.Context) ([]coinData, error)
+	CoinList(ctx context.Context) ([]CryptoListing, error)
+	CoinQuote(ctx context.Context, id string) (*Quote, error)
+	CoinSeries(ctx context.Context, id string, query SeriesQuery) (*Quote, error)
+}
+
+var (
+	stockProvider  StockProvider
+	cryptoProvider CryptoProvider
+)
+
+func initMarketData() error {
+	client := &http.Client{Timeout: marketDataTimeout}
+
+	switch stockProviderName {
+	case "alphavantage":
+		provider, err := newAlphaVantageProvider(client)
+		if err != nil {
+			return err
+		}
+		stockProvider = provider
+	default:
+		return fmt.Errorf("unknown STOCK_PROVIDER %q", stockProviderName)
+	}
+
+	switch cryptoProviderName {
+	case "coingecko":
+		cryptoProvider = newCoinGeckoProvider(client)
+	default:
+		return fmt.Errorf("unknown CRYPTO_PROVIDER %q", cryptoProviderName)
+	}
+
+	// Created up front so the breaker state gauge reports both from the start.
+	breakerFor(stockProvider.Name())
+	breakerFor(cryptoProvider.Name())
+	return nil
+}
+
+// ProviderError is returned when a provider answers with a non-OK status.
+// Handlers pass the status on to the client, as they did before providers
+// were split out.
+type ProviderError struct {
+	Provider   string
+	Operation  string
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("API returned non-OK status: %d, body: %s", e.StatusCode, e.Body)
+}
+
+// RateLimitError is returned when a provider quota is used up, either by our
+// own pacing or because the provider said so. RetryAfter is zero when the
+// wait is unknown.
+type RateLimitError struct {
+	Provider   string
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s rate limit: %s", e.Provider, e.Reason)
+}
+
+// writeProviderError responds to a failed provider call.
+func writeProviderError(w http.ResponseWriter, err error) {
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		if rateLimitErr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rateLimitErr.RetryAfter.Seconds()))))
+		}
+		http.Error(w, rateLimitErr.Error(), http.StatusTooManyRequests)
+		return
+	}
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		if providerErr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(providerErr.RetryAfter.Seconds()))))
+		}
+		http.Error(w, providerErr.Error(), providerErr.StatusCode)
+		return
+	}
+	if errors.Is(err, errProviderUnavailable) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(providerBreakerOpenTimeout.Seconds()))))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	var payloadErr *PayloadError
+	if errors.As(err, &payloadErr) {
+		http.Error(w, payloadErr.Error(), http.StatusBadGateway)
+		return
+	}
+	if errors.Is(err, errUnsupportedQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errUnknownSymbol) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// providerCall describes one outbound request to a market data provider.
+type providerCall struct {
+	api       string // api.name on spans, e.g. alphavantage
+	operation string // api.operation, e.g. TIME_SERIES_DAILY
+	spanName  string
+	url       string
+	header    http.Header
+	attrs     []attribute.KeyValue
+
+	// before, when set, runs ahead of every attempt and may fill in url and
+	// check, e.g. to pick an API key.
+	before func(ctx context.Context, c *providerCall) error
+
+	// check, when set, inspects an OK body and turns payloads that are
+	// really errors into one.
+	check func(body []byte) error
+}
+
+// fetch performs the call inside its own client span and returns the body of
+// an OK response, retrying transient failures through the provider's circuit
+// breaker. Every attempt is an event on the span. The span and the external
+// API duration metric look the same for every provider.
+func (c *providerCall) fetch(ctx context.Context, client *http.Client) ([]byte, error) {
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	ctx, span := tracer.Start(ctx, c.spanName,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(append([]attribute.KeyValue{
+			attribute.String("http.method", "GET"),
+			attribute.String("api.name", c.api),
+			attribute.String("api.operation", c.operation),
+		}, c.attrs...)...),
+	)
+	defer span.End()
+
+	breaker := breakerFor(c.api)
+	var body []byte
+	var err error
+	attempts := 0
+	for attempt := 1; ; attempt++ {
+		// A retry that cannot get going reports why the last attempt failed.
+		if c.before != nil {
+			if beforeErr := c.before(ctx, c); beforeErr != nil {
+				if attempt == 1 {
+					err = beforeErr
+				}
+				break
+			}
+		}
+		span.SetAttributes(attribute.String("http.url", c.url))
+		attempts = attempt
+
+		body, err = breaker.Execute(func() ([]byte, error) {
+			return c.attempt(ctx, client, attempt)
+		})
+		if err == nil {
+			break
+		}
+		if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+			span.AddEvent("circuit_breaker.rejected", trace.WithAttributes(
+				attribute.Int("http.attempt", attempt),
+				attribute.String("circuit_breaker.state", breaker.State().String()),
+			))
+			err = fmt.Errorf("%w: %s circuit breaker is %s", errProviderUnavailable, c.api, breaker.State())
+			break
+		}
+		if attempt >= marketDataMaxAttempts || !isRetryable(ctx, err) {
+			break
+		}
+
+		var retryAfter time.Duration
+		var providerErr *ProviderError
+		if errors.As(err, &providerErr) {
+			retryAfter = providerErr.RetryAfter
+		}
+		delay := retryDelay(attempt, retryAfter)
+		if deadline, ok := ctx.Deadline(); delay > marketDataRetryMaxDelay || (ok && time.Now().Add(delay).After(deadline)) {
+			break
+		}
+		span.AddEvent("http.retry_scheduled", trace.WithAttributes(
+			attribute.Int("http.attempt", attempt),
+			attribute.Float64("retry.delay_sec", delay.Seconds()),
+		))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			err = ctx.Err()
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	span.SetAttributes(attribute.Int("http.attempts", attempts))
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		var providerErr *ProviderError
+		if errors.As(err, &providerErr) {
+			Logger.ErrorContext(ctx, "Provider returned non-OK status",
+				"provider", c.api,
+				"operation", c.operation,
+				"status_code", providerErr.StatusCode,
+				"response_body", providerErr.Body,
+				"api_url", c.url)
+		} else {
+			Logger.ErrorContext(ctx, "Provider call failed", "provider", c.api, "operation", c.operation, "error", err)
+		}
+		return nil, err
+	}
+
+	if c.check != nil {
+		if err := c.check(body); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			Logger.WarnContext(ctx, "Provider returned an error payload", "provider", c.api, "operation", c.operation, "error", err)
+			return nil, err
+		}
+	}
+
+	span.SetStatus(codes.Ok, "API call successful")
+	return body, nil
+}
+
+// attempt performs one request and returns the body of an OK response.
+func (c *providerCall) attempt(ctx context.Context, client *http.Client, attempt int) ([]byte, error) {
+	span := trace.SpanFromContext(ctx)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range c.header {
+		req.Header[key] = values
+	}
+
+	startTime := time.Now()
+	response, err := client.Do(req)
+	var body []byte
+	if err == nil {
+		body, err = io.ReadAll(response.Body)
+		response.Body.Close()
+	}
+	duration := time.Since(startTime).Seconds()
+
+	Logger.InfoContext(ctx, "External API call completed", "url", c.url, "duration_sec", duration, "error_present", err != nil, "attempt", attempt)
+
+	if externalAPICallDuration != nil {
+		externalAPICallDuration.Record(ctx, duration, metric.WithAttributes(
+			attribute.String("api.name", c.api+"_api"),
+			attribute.String("api.operation", c.operation),
+			attribute.Bool("api.error", err != nil),
+		))
+	}
+
+	attrs := []attribute.KeyValue{
+		attribute.Int("http.attempt", attempt),
+		attribute.Float64("http.duration_sec", duration),
+	}
+	if err != nil {
+		span.AddEvent("http.attempt", trace.WithAttributes(append(attrs, attribute.String("error", err.Error()))...))
+		return nil, err
+	}
+	span.AddEvent("http.attempt", trace.WithAttributes(append(attrs, attribute.Int("http.status_code", response.StatusCode))...))
+	span.SetAttributes(
+		attribute.Int("http.status_code", response.StatusCode),
+		attribute.String("http.response_content_type", response.Header.Get("Content-Type")),
+	)
+
+	if response.StatusCode != http.StatusOK {
+		return nil, &ProviderError{
+			Provider:   c.api,
+			Operation:  c.operation,
+			StatusCode: response.StatusCode,
+			Body:       string(body),
+			RetryAfter: parseRetryAfter(response.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	return body, nil
+}
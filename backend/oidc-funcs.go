@@ -0,0 +1,534 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+)
+
+var (
+	errInvalidOIDCState      = errors.New("invalid or expired oidc state")
+	errOIDCEmailUnverified   = errors.New("oidc provider did not return a verified email")
+	errOIDCAccountUnverified = errors.New("local account with the oidc email is not verified")
+)
+
+var usernameDisallowedChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// oidcStateCookie binds a login to the browser that started it: it holds
+// the hash of the state, and the callback only accepts the state it matches.
+const oidcStateCookie = "oidc_state"
+
+func setOIDCStateCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     "/users/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(oidcRedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// oidcStateMatchesCookie reports whether the request carries the state
+// cookie set for state.
+func oidcStateMatchesCookie(r *http.Request, state string) bool {
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(hashOpaqueToken(state))) == 1
+}
+
+type OIDCClaims struct {
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+}
+
+func consumeOIDCState(ctx context.Context, state string) (*OIDCLoginState, error) {
+	var loginState OIDCLoginState
+	err := DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("state_hash = ? AND used_at IS NULL AND expires_at > ?", hashOpaqueToken(state), time.Now().UTC()).
+			First(&loginState).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errInvalidOIDCState
+		}
+		if err != nil {
+			return err
+		}
+
+		result := tx.Model(&OIDCLoginState{}).
+			Where("id = ? AND used_at IS NULL", loginState.ID).
+			Update("used_at", time.Now().UTC())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errInvalidOIDCState
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &loginState, nil
+}
+
+// availableUsername derives a username from the identity claims, adding a
+// random suffix when the preferred one is taken.
+func availableUsername(tx *gorm.DB, claims OIDCClaims) (string, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(claims.Email, "@")
+	}
+	base = strings.TrimLeft(usernameDisallowedChars.ReplaceAllString(base, ""), "._-")
+	if len(base) > 40 {
+		base = base[:40]
+	}
+	if len(base) < usernameMinLength {
+		base = "user"
+	}
+
+	candidate := base
+	for i := 0; i < 5; i++ {
+		var count int64
+		if err := tx.Model(&User{}).Where("username = ?", candidate).Count(&count).Error; err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return candidate, nil
+		}
+		suffix, err := generateRandomID()
+		if err != nil {
+			return "", err
+		}
+		candidate = base + "-" + suffix[:6]
+	}
+	return "", fmt.Errorf("could not find a free username for %q", base)
+}
+
+// resolveOIDCUser returns the user linked to the external identity. On the
+// first login the identity is linked to the user with the same verified
+// email, or a new user is provisioned. The boolean reports provisioning.
+// A local account that never verified its email is not linked: whoever
+// registered it may not own the address.
+func resolveOIDCUser(ctx context.Context, subject string, claims OIDCClaims) (*User, bool, error) {
+	var (
+		user        User
+		provisioned bool
+	)
+	err := DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now().UTC()
+
+		var identity UserIdentity
+		err := tx.Where("provider = ? AND subject = ?", oidcProviderName, subject).First(&identity).Error
+		if err == nil {
+			if err := tx.First(&user, "id = ?", identity.UserID).Error; err != nil {
+				return err
+			}
+			return tx.Model(&identity).Updates(map[string]interface{}{
+				"last_login_at": now,
+				"email":         claims.Email,
+			}).Error
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		// Linking by email is only safe when the provider vouches for it,
+		// otherwise anyone could claim an existing account.
+		if claims.Email == "" || !claims.EmailVerified {
+			return errOIDCEmailUnverified
+		}
+
+		err = tx.Where("email = ?", claims.Email).First(&user).Error
+		switch {
+		case err == nil:
+			if user.EmailVerifiedAt == nil {
+				return errOIDCAccountUnverified
+			}
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			username, err := availableUsername(tx, claims)
+			if err != nil {
+				return err
+			}
+			user = User{
+				Username:        username,
+				Email:           claims.Email,
+				EmailVerifiedAt: &now,
+			}
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+			provisioned = true
+		default:
+			return err
+		}
+
+		return tx.Create(&UserIdentity{
+			UserID:      user.ID,
+			Provider:    oidcProviderName,
+			Subject:     subject,
+			Email:       claims.Email,
+			LastLoginAt: now,
+		}).Error
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return &user, provisioned, nil
+}
+
+// writeOIDCResult hands the login result to the frontend. With
+// OIDC_POST_LOGIN_URL set the browser is redirected there with the result in
+// the URL fragment, which is never sent to servers; otherwise it is returned
+// as JSON like the password login.
+func writeOIDCResult(w http.ResponseWriter, r *http.Request, resp AuthResponse) {
+	if oidcPostLoginURL == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	values := url.Values{}
+	if resp.TwoFactorRequired {
+		values.Set("twoFactorRequired", "true")
+		values.Set("challenge", resp.Challenge)
+	} else {
+		values.Set("token", resp.Token)
+		values.Set("refreshToken", resp.RefreshToken)
+		values.Set("expiresIn", fmt.Sprint(resp.ExpiresIn))
+	}
+	http.Redirect(w, r, oidcPostLoginURL+"#"+values.Encode(), http.StatusFound)
+}
+
+func startOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+
+	ctx, span := tracer.Start(ctx, "auth.oidc.start",
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", "/users/oidc/login"),
+			attribute.String("component", "auth_service"),
+			attribute.String("operation", "oidc_login_start"),
+			attribute.String("oidc.provider", oidcProviderName),
+		),
+	)
+	defer span.End()
+
+	if httpRequestCount != nil {
+		httpRequestCount.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("endpoint", "oidc_login"),
+			attribute.String("method", r.Method),
+			attribute.String("component", "auth_service"),
+		))
+	}
+
+	client, err := getOIDCClient(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "OIDC unavailable")
+		if errors.Is(err, errOIDCDisabled) {
+			writeAuthError(w, http.StatusNotFound, "OIDC login is not enabled", "OIDC_DISABLED")
+			return
+		}
+		Logger.ErrorContext(ctx, "OIDC provider discovery failed",
+			slog.String("issuer", oidcIssuerURL),
+			slog.String("error", err.Error()),
+		)
+		writeAuthError(w, http.StatusBadGateway, "Identity provider unavailable", "OIDC_UNAVAILABLE")
+		return
+	}
+
+	state, stateHash, err := generateOpaqueToken()
+	var nonce string
+	if err == nil {
+		nonce, err = generateRandomID()
+	}
+	verifier := oauth2.GenerateVerifier()
+	if err == nil {
+		err = DB.WithContext(ctx).Create(&OIDCLoginState{
+			StateHash:    stateHash,
+			CodeVerifier: verifier,
+			Nonce:        nonce,
+			ExpiresAt:    time.Now().UTC().Add(oidcStateTTL),
+		}).Error
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to store login state")
+		Logger.ErrorContext(ctx, "Failed to store OIDC login state",
+			slog.String("error", err.Error()),
+		)
+		writeAuthError(w, http.StatusInternalServerError, "Login failed", "DB_ERROR")
+		return
+	}
+
+	authURL := client.oauth2.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier), oidc.Nonce(nonce))
+	setOIDCStateCookie(w, stateHash, int(oidcStateTTL.Seconds()))
+
+	span.SetStatus(codes.Ok, "Redirecting to identity provider")
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func oidcCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	startTime := time.Now()
+
+	ctx, span := tracer.Start(ctx, "auth.oidc.callback",
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", "/users/oidc/callback"),
+			attribute.String("component", "auth_service"),
+			attribute.String("operation", "oidc_login_callback"),
+			attribute.String("oidc.provider", oidcProviderName),
+			attribute.String("user_agent", r.UserAgent()),
+			attribute.String("remote_addr", r.RemoteAddr),
+		),
+	)
+	defer span.End()
+
+	baseAttrs := []attribute.KeyValue{
+		attribute.String("endpoint", "oidc_callback"),
+		attribute.String("method", r.Method),
+		attribute.String("component", "auth_service"),
+	}
+
+	if httpRequestCount != nil {
+		httpRequestCount.Add(ctx, 1, metric.WithAttributes(baseAttrs...))
+	}
+
+	outcome := "error"
+	auditUserID := 0
+	defer func() {
+		if loginAttempts != nil {
+			loginAttempts.Add(ctx, 1, metric.WithAttributes(append(baseAttrs,
+				attribute.String("outcome", outcome),
+			)...))
+		}
+		recordAuthEvent(ctx, r, auditUserID, auditLoginOIDC, outcome, nil)
+	}()
+
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		outcome = "provider_error"
+		span.SetStatus(codes.Error, "Provider returned an error")
+		Logger.InfoContext(ctx, "OIDC login rejected by provider",
+			slog.String("error", providerErr),
+			slog.String("description", query.Get("error_description")),
+		)
+		writeAuthError(w, http.StatusUnauthorized, "Login was cancelled or rejected by the identity provider", "OIDC_PROVIDER_ERROR")
+		return
+	}
+	if query.Get("state") == "" || query.Get("code") == "" {
+		outcome = "invalid_request"
+		span.SetStatus(codes.Error, "Missing state or code")
+		writeAuthError(w, http.StatusBadRequest, "State and code are required", "MISSING_FIELDS")
+		return
+	}
+
+	client, err := getOIDCClient(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "OIDC unavailable")
+		if errors.Is(err, errOIDCDisabled) {
+			writeAuthError(w, http.StatusNotFound, "OIDC login is not enabled", "OIDC_DISABLED")
+			return
+		}
+		writeAuthError(w, http.StatusBadGateway, "Identity provider unavailable", "OIDC_UNAVAILABLE")
+		return
+	}
+
+	// A callback carrying a state this browser did not start is someone
+	// else's login being replayed into it.
+	if !oidcStateMatchesCookie(r, query.Get("state")) {
+		outcome = "invalid_state"
+		span.SetStatus(codes.Error, "State does not match the browser")
+		Logger.WarnContext(ctx, "OIDC login rejected - state not bound to this browser",
+			slog.String("remote_addr", r.RemoteAddr),
+		)
+		writeAuthError(w, http.StatusBadRequest, "Invalid or expired login state, please try again", "INVALID_STATE")
+		return
+	}
+	setOIDCStateCookie(w, "", -1)
+
+	loginState, err := consumeOIDCState(ctx, query.Get("state"))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Invalid state")
+		if errors.Is(err, errInvalidOIDCState) {
+			outcome = "invalid_state"
+			Logger.InfoContext(ctx, "OIDC login rejected - invalid or expired state")
+			writeAuthError(w, http.StatusBadRequest, "Invalid or expired login state, please try again", "INVALID_STATE")
+			return
+		}
+		writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+		return
+	}
+
+	exchangeCtx, exchangeSpan := tracer.Start(ctx, "auth.oidc.exchange_code",
+		trace.WithAttributes(attribute.String("operation", "oidc_code_exchange")),
+	)
+	oauthToken, err := client.oauth2.Exchange(client.clientContext(exchangeCtx), query.Get("code"),
+		oauth2.VerifierOption(loginState.CodeVerifier))
+	var idToken *oidc.IDToken
+	if err == nil {
+		rawIDToken, ok := oauthToken.Extra("id_token").(string)
+		if !ok {
+			err = errors.New("token response did not contain an id_token")
+		} else {
+			idToken, err = client.verifier.Verify(client.clientContext(exchangeCtx), rawIDToken)
+		}
+	}
+	if err == nil && idToken.Nonce != loginState.Nonce {
+		err = errors.New("id_token nonce mismatch")
+	}
+	if err != nil {
+		exchangeSpan.RecordError(err)
+		exchangeSpan.SetStatus(codes.Error, "Code exchange failed")
+		exchangeSpan.End()
+		span.SetStatus(codes.Error, "Code exchange failed")
+
+		outcome = "exchange_failed"
+		Logger.WarnContext(ctx, "OIDC code exchange failed",
+			slog.String("error", err.Error()),
+		)
+		writeAuthError(w, http.StatusUnauthorized, "Login with the identity provider failed", "OIDC_EXCHANGE_FAILED")
+		return
+	}
+	exchangeSpan.SetStatus(codes.Ok, "Code exchanged")
+	exchangeSpan.End()
+
+	var claims OIDCClaims
+	if err := idToken.Claims(&claims); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Invalid id_token claims")
+		writeAuthError(w, http.StatusUnauthorized, "Login with the identity provider failed", "OIDC_EXCHANGE_FAILED")
+		return
+	}
+
+	user, provisioned, err := resolveOIDCUser(ctx, idToken.Subject, claims)
+	if user != nil {
+		auditUserID = user.ID
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "User resolution failed")
+		if errors.Is(err, errOIDCEmailUnverified) {
+			outcome = "email_not_verified"
+			writeAuthError(w, http.StatusForbidden, "The identity provider did not confirm your email address", "OIDC_EMAIL_NOT_VERIFIED")
+			return
+		}
+		if errors.Is(err, errOIDCAccountUnverified) {
+			outcome = "account_not_verified"
+			writeAuthError(w, http.StatusConflict, "An account with this email exists but its email is not verified; log in with your password and verify it first", "ACCOUNT_NOT_VERIFIED")
+			return
+		}
+		Logger.ErrorContext(ctx, "Failed to resolve OIDC user",
+			slog.String("error", err.Error()),
+		)
+		writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+		return
+	}
+	span.SetAttributes(
+		attribute.Int("user_id", user.ID),
+		attribute.Bool("oidc.provisioned", provisioned),
+	)
+	if provisioned {
+		span.AddEvent("oidc.user_provisioned")
+		Logger.InfoContext(ctx, "User provisioned from OIDC login",
+			slog.Int("user_id", user.ID),
+			slog.String("provider", oidcProviderName),
+		)
+	}
+
+	if user.DisabledAt != nil {
+		outcome = "account_disabled"
+		span.SetStatus(codes.Error, "Account disabled")
+		Logger.WarnContext(ctx, "OIDC login blocked - account disabled",
+			slog.Int("user_id", user.ID),
+			slog.String("disabled_reason", user.DisabledReason),
+		)
+		writeAuthError(w, http.StatusForbidden, "This account has been disabled", "ACCOUNT_DISABLED")
+		return
+	}
+
+	if user.TwoFactorEnabledAt != nil {
+		challenge, err := createTwoFactorChallenge(ctx, user, r)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Two-factor challenge failed")
+			writeAuthError(w, http.StatusInternalServerError, "Login failed", "DB_ERROR")
+			return
+		}
+		outcome = "two_factor_required"
+		span.SetStatus(codes.Ok, "Two-factor challenge issued")
+		writeOIDCResult(w, r, AuthResponse{
+			Success:           true,
+			Message:           "Two-factor authentication required",
+			TwoFactorRequired: true,
+			Challenge:         challenge,
+		})
+		return
+	}
+
+	token, refreshToken, err := issueSession(ctx, user, r)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Token generation failed")
+		Logger.ErrorContext(ctx, "JWT generation failed",
+			slog.Int("user_id", user.ID),
+			slog.String("error", err.Error()),
+		)
+		writeAuthError(w, http.StatusInternalServerError, "Token generation failed", "TOKEN_GENERATION_FAILED")
+		return
+	}
+
+	outcome = "success"
+	if authDuration != nil {
+		authDuration.Record(ctx, time.Since(startTime).Seconds(),
+			metric.WithAttributes(append(baseAttrs,
+				attribute.String("status", "success"),
+				attribute.Int("user_id", user.ID),
+			)...),
+		)
+	}
+
+	span.SetStatus(codes.Ok, "Login successful")
+	Logger.InfoContext(ctx, "OIDC login successful",
+		slog.Int("user_id", user.ID),
+		slog.String("provider", oidcProviderName),
+		slog.Duration("total_duration", time.Since(startTime)),
+	)
+
+	writeOIDCResult(w, r, AuthResponse{
+		Success:      true,
+		Message:      "Login successful",
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(jwtTTL.Seconds()),
+		User:         user,
+	})
+}
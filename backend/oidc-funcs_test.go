@@ -0,0 +1,356 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testOIDCClientID = "stock-tracker-test"
+
+type testAuthorization struct {
+	challenge string
+	nonce     string
+}
+
+// testOIDCProvider is a minimal stand-in identity provider: discovery, an
+// authorize endpoint that approves every request, a PKCE-checking token
+// endpoint and the key set its ID tokens are signed with.
+type testOIDCProvider struct {
+	server *httptest.Server
+	key    *signingKey
+
+	mu            sync.Mutex
+	codes         map[string]testAuthorization
+	subject       string
+	email         string
+	emailVerified bool
+}
+
+func newTestOIDCProvider(t *testing.T) *testOIDCProvider {
+	t.Helper()
+
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testOIDCProvider{
+		key:           &signingKey{ID: "test-key", Signer: private, Method: jwt.SigningMethodES256},
+		codes:         map[string]testAuthorization{},
+		subject:       "subject-1",
+		email:         "alice@example.com",
+		emailVerified: true,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/jwks", p.jwks)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+
+	setVar(t, &oidcIssuerURL, p.server.URL)
+	setVar(t, &oidcClientID, testOIDCClientID)
+	setVar(t, &oidcClientSecret, "secret")
+	setVar(t, &oidcRedirectURL, "http://localhost:8000/users/oidc/callback")
+	setVar(t, &oidcPostLoginURL, "")
+	setVar(t, &oidcCached, nil)
+	return p
+}
+
+func (p *testOIDCProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                p.server.URL,
+		"authorization_endpoint":                p.server.URL + "/authorize",
+		"token_endpoint":                        p.server.URL + "/token",
+		"jwks_uri":                              p.server.URL + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"ES256"},
+	})
+}
+
+func (p *testOIDCProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != testOIDCClientID || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+	code, _ := generateRandomID()
+
+	p.mu.Lock()
+	p.codes[code] = testAuthorization{challenge: query.Get("code_challenge"), nonce: query.Get("nonce")}
+	p.mu.Unlock()
+
+	redirect, _ := url.Parse(query.Get("redirect_uri"))
+	redirect.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (p *testOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	p.mu.Lock()
+	auth, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	subject, email, emailVerified := p.subject, p.email, p.emailVerified
+	p.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != auth.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	idToken := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss":            p.server.URL,
+		"sub":            subject,
+		"aud":            testOIDCClientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Minute).Unix(),
+		"nonce":          auth.nonce,
+		"email":          email,
+		"email_verified": emailVerified,
+	})
+	idToken.Header["kid"] = p.key.ID
+	signed, err := idToken.SignedString(p.key.Signer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "provider-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     signed,
+	})
+}
+
+func (p *testOIDCProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	jwk, _ := publicJWK(p.key)
+	json.NewEncoder(w).Encode(JWKSet{Keys: []JWK{jwk}})
+}
+
+// startLogin runs startOIDCLogin and the provider's authorize step, and
+// returns the state cookie set for the browser and the callback request the
+// provider redirected it to.
+func (p *testOIDCProvider) startLogin(t *testing.T) (*http.Cookie, *http.Request) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	startOIDCLogin(rec, httptest.NewRequest(http.MethodGet, "/users/oidc/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login start returned %d: %s", rec.Code, rec.Body)
+	}
+	var cookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("login start did not set the state cookie")
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize returned %d", resp.StatusCode)
+	}
+	return cookie, httptest.NewRequest(http.MethodGet, resp.Header.Get("Location"), nil)
+}
+
+func runOIDCCallback(req *http.Request, cookie *http.Cookie) *httptest.ResponseRecorder {
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	oidcCallback(rec, req)
+	return rec
+}
+
+func TestOIDCLoginProvisionsUser(t *testing.T) {
+	setupTestDB(t)
+	setupTestSigningKeys(t)
+	provider := newTestOIDCProvider(t)
+
+	cookie, callback := provider.startLogin(t)
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("state cookie must be HttpOnly and SameSite=Lax, got %+v", cookie)
+	}
+	if cookie.Value != hashOpaqueToken(callback.URL.Query().Get("state")) {
+		t.Error("state cookie does not hold the hash of the state")
+	}
+
+	rec := runOIDCCallback(callback, cookie)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("callback returned %d: %s", rec.Code, rec.Body)
+	}
+	var resp AuthResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	_, userID, err := parseJWT(resp.Token)
+	if err != nil {
+		t.Fatalf("issued token does not verify: %v", err)
+	}
+
+	var user User
+	if err := DB.First(&user, "id = ?", userID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != provider.email || user.EmailVerifiedAt == nil {
+		t.Errorf("provisioned user = %q verified %v, want %q verified", user.Email, user.EmailVerifiedAt, provider.email)
+	}
+	var identity UserIdentity
+	if err := DB.First(&identity, "provider = ? AND subject = ?", oidcProviderName, provider.subject).Error; err != nil {
+		t.Fatalf("identity not linked: %v", err)
+	}
+	if identity.UserID != userID {
+		t.Errorf("identity linked to user %d, want %d", identity.UserID, userID)
+	}
+
+	cleared := false
+	for _, c := range rec.Result().Cookies() {
+		cleared = cleared || (c.Name == oidcStateCookie && c.MaxAge < 0)
+	}
+	if !cleared {
+		t.Error("callback did not clear the state cookie")
+	}
+}
+
+func TestOIDCLoginLinksExistingUserByVerifiedEmail(t *testing.T) {
+	setupTestDB(t)
+	setupTestSigningKeys(t)
+	provider := newTestOIDCProvider(t)
+
+	verifiedAt := time.Now().UTC()
+	existing := User{Username: "alice", Email: provider.email, EmailVerifiedAt: &verifiedAt}
+	if err := DB.Create(&existing).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	cookie, callback := provider.startLogin(t)
+	if rec := runOIDCCallback(callback, cookie); rec.Code != http.StatusOK {
+		t.Fatalf("callback returned %d: %s", rec.Code, rec.Body)
+	}
+
+	var identity UserIdentity
+	if err := DB.First(&identity, "subject = ?", provider.subject).Error; err != nil {
+		t.Fatal(err)
+	}
+	if identity.UserID != existing.ID {
+		t.Errorf("identity linked to user %d, want existing user %d", identity.UserID, existing.ID)
+	}
+	var users int64
+	DB.Model(&User{}).Count(&users)
+	if users != 1 {
+		t.Errorf("got %d users, want the existing one only", users)
+	}
+}
+
+// Anyone can register a local account with someone else's email and leave
+// it unverified. A later login by the owner of that address must not hand
+// the attacker's account, password included, to the owner.
+func TestOIDCLoginRefusesUnverifiedLocalAccount(t *testing.T) {
+	setupTestDB(t)
+	setupTestSigningKeys(t)
+	provider := newTestOIDCProvider(t)
+
+	squatter := User{Username: "squatter", Email: provider.email, Password: "hashed"}
+	if err := DB.Create(&squatter).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	cookie, callback := provider.startLogin(t)
+	rec := runOIDCCallback(callback, cookie)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("callback returned %d, want 409: %s", rec.Code, rec.Body)
+	}
+	var resp ErrorResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.Error != "ACCOUNT_NOT_VERIFIED" {
+		t.Errorf("error code = %q, want ACCOUNT_NOT_VERIFIED", resp.Error)
+	}
+
+	var identities, sessions int64
+	DB.Model(&UserIdentity{}).Count(&identities)
+	DB.Model(&RefreshToken{}).Count(&sessions)
+	if identities != 0 || sessions != 0 {
+		t.Errorf("got %d identities and %d sessions, want none", identities, sessions)
+	}
+	var user User
+	if err := DB.First(&user, squatter.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.EmailVerifiedAt != nil {
+		t.Error("local account was marked verified")
+	}
+}
+
+func TestOIDCLoginRejectsUnverifiedEmail(t *testing.T) {
+	setupTestDB(t)
+	setupTestSigningKeys(t)
+	provider := newTestOIDCProvider(t)
+	provider.emailVerified = false
+
+	cookie, callback := provider.startLogin(t)
+	if rec := runOIDCCallback(callback, cookie); rec.Code != http.StatusForbidden {
+		t.Fatalf("callback returned %d, want 403: %s", rec.Code, rec.Body)
+	}
+}
+
+// An attacker can start a login, stop before their own callback and hand
+// the callback URL to a victim. The victim's browser must not be logged in
+// to the attacker's account.
+func TestOIDCCallbackRejectsStateFromAnotherBrowser(t *testing.T) {
+	setupTestDB(t)
+	setupTestSigningKeys(t)
+	provider := newTestOIDCProvider(t)
+
+	attackerCookie, attackerCallback := provider.startLogin(t)
+	victimCookie, _ := provider.startLogin(t)
+
+	for name, cookie := range map[string]*http.Cookie{"no cookie": nil, "other login's cookie": victimCookie} {
+		req := httptest.NewRequest(http.MethodGet, attackerCallback.URL.String(), nil)
+		rec := runOIDCCallback(req, cookie)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: callback returned %d, want 400: %s", name, rec.Code, rec.Body)
+		}
+		var resp ErrorResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if resp.Error != "INVALID_STATE" {
+			t.Errorf("%s: error = %q, want INVALID_STATE", name, resp.Error)
+		}
+	}
+
+	var sessions int64
+	DB.Model(&RefreshToken{}).Count(&sessions)
+	if sessions != 0 {
+		t.Errorf("rejected callbacks created %d sessions", sessions)
+	}
+
+	// The rejected attempts must not spend the state of the real login.
+	if rec := runOIDCCallback(attackerCallback, attackerCookie); rec.Code != http.StatusOK {
+		t.Fatalf("callback from the starting browser returned %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
+)
+
+// OIDC login is enabled by setting OIDC_ISSUER_URL. Any provider that serves
+// discovery at <issuer>/.well-known/openid-configuration works, including a
+// local stand-in provider during development and tests.
+var (
+	oidcIssuerURL     = getEnv("OIDC_ISSUER_URL", "")
+	oidcProviderName  = getEnv("OIDC_PROVIDER_NAME", "oidc")
+	oidcClientID      = getEnv("OIDC_CLIENT_ID", "")
+	oidcClientSecret  = getEnv("OIDC_CLIENT_SECRET", "")
+	oidcRedirectURL   = getEnv("OIDC_REDIRECT_URL", appBaseURL+"/users/oidc/callback")
+	oidcScopes        = strings.Fields(getEnv("OIDC_SCOPES", "openid email profile"))
+	oidcPostLoginURL  = getEnv("OIDC_POST_LOGIN_URL", "")
+	oidcStateTTL      = getEnvDuration("OIDC_STATE_TTL", 10*time.Minute)
+	oidcClientTimeout = getEnvDuration("OIDC_HTTP_TIMEOUT", 10*time.Second)
+)
+
+var errOIDCDisabled = errors.New("oidc login is not configured")
+
+// oidcClient bundles the discovered provider with the OAuth2 configuration
+// derived from it.
+type oidcClient struct {
+	provider   *oidc.Provider
+	oauth2     oauth2.Config
+	verifier   *oidc.IDTokenVerifier
+	httpClient *http.Client
+}
+
+var (
+	oidcMu     sync.Mutex
+	oidcCached *oidcClient
+)
+
+// getOIDCClient runs discovery on first use and caches the result. A failed
+// discovery is not cached, so the provider being down at startup does not
+// disable OIDC login until the next restart.
+func getOIDCClient(ctx context.Context) (*oidcClient, error) {
+	if oidcIssuerURL == "" || oidcClientID == "" {
+		return nil, errOIDCDisabled
+	}
+
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if oidcCached != nil {
+		return oidcCached, nil
+	}
+
+	transport := &oidcTransport{base: http.DefaultTransport}
+	httpClient := &http.Client{Transport: transport, Timeout: oidcClientTimeout}
+
+	// The provider keeps the context given to NewProvider for later key set
+	// refreshes, so it must not carry the span of the request that happened
+	// to trigger discovery.
+	providerCtx := oidc.ClientContext(context.Background(), httpClient)
+	provider, err := oidc.NewProvider(providerCtx, oidcIssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery failed: %w", err)
+	}
+
+	var metadata struct {
+		JWKSURL     string `json:"jwks_uri"`
+		UserInfoURL string `json:"userinfo_endpoint"`
+	}
+	if err := provider.Claims(&metadata); err != nil {
+		return nil, fmt.Errorf("error reading oidc provider metadata: %w", err)
+	}
+	transport.setEndpoints(metadata.JWKSURL, provider.Endpoint().TokenURL, metadata.UserInfoURL)
+
+	oidcCached = &oidcClient{
+		provider: provider,
+		oauth2: oauth2.Config{
+			ClientID:     oidcClientID,
+			ClientSecret: oidcClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  oidcRedirectURL,
+			Scopes:       oidcScopes,
+		},
+		verifier:   provider.Verifier(&oidc.Config{ClientID: oidcClientID}),
+		httpClient: httpClient,
+	}
+	return oidcCached, nil
+}
+
+// clientContext makes the oauth2 and oidc packages use the traced client for
+// calls made on behalf of ctx.
+func (c *oidcClient) clientContext(ctx context.Context) context.Context {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, c.httpClient)
+	return oidc.ClientContext(ctx, c.httpClient)
+}
+
+// oidcTransport wraps every request to the provider in a client span named
+// after the protocol step, so discovery, key fetches and the token exchange
+// are visible in traces of the login that caused them.
+type oidcTransport struct {
+	base http.RoundTripper
+
+	mu          sync.RWMutex
+	jwksURL     string
+	tokenURL    string
+	userInfoURL string
+}
+
+func (t *oidcTransport) setEndpoints(jwksURL, tokenURL, userInfoURL string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.jwksURL, t.tokenURL, t.userInfoURL = jwksURL, tokenURL, userInfoURL
+}
+
+func (t *oidcTransport) operation(req *http.Request) string {
+	url := req.URL.Scheme + "://" + req.URL.Host + req.URL.Path
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/.well-known/openid-configuration"):
+		return "discovery"
+	case url == t.jwksURL:
+		return "jwks_fetch"
+	case url == t.tokenURL:
+		return "token_exchange"
+	case url == t.userInfoURL:
+		return "userinfo"
+	}
+	return "request"
+}
+
+func (t *oidcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	operation := t.operation(req)
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+
+	ctx, span := tracer.Start(req.Context(), "oidc."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.url", req.URL.Scheme+"://"+req.URL.Host+req.URL.Path),
+			attribute.String("api.name", "oidc"),
+			attribute.String("api.operation", operation),
+			attribute.String("oidc.provider", oidcProviderName),
+		),
+	)
+	defer span.End()
+
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+
+	if externalAPICallDuration != nil {
+		externalAPICallDuration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(
+			attribute.String("api.name", "oidc"),
+			attribute.String("api.operation", operation),
+			attribute.Bool("api.error", err != nil || resp.StatusCode >= 400),
+		))
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "OIDC request failed")
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, fmt.Sprintf("OIDC provider returned status %d", resp.StatusCode))
+	} else {
+		span.SetStatus(codes.Ok, "OIDC request successful")
+	}
+	return resp, nil
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"time"
 
 	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
@@ -28,8 +29,14 @@ var (
 	dbQueryCount            metric.Int64Counter
 	dbQueryDuration         metric.Float64Histogram
 	loginAttempts           metric.Int64Counter
+	loginLockouts           metric.Int64Counter
 	registerAttempts        metric.Int64Counter
+	passwordResetAttempts   metric.Int64Counter
 	authDuration            metric.Float64Histogram
+	symbolCacheRequests     metric.Int64Counter
+	priceHistoryRowsWritten metric.Int64Counter
+	alphaVantageQueueDepth  metric.Int64UpDownCounter
+	alphaVantageQueueWait   metric.Float64Histogram
 )
 
 var (
@@ -41,16 +48,19 @@ var (
 func initTelemetry() (func(), error) {
 	ctx := context.Background()
 
-	logDir := "/fluentd/log"
 	if err := os.MkdirAll(logDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create log dir: %w", err)
 	}
-	logFile, err := os.OpenFile(logDir+"/app.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	logFile, err := os.OpenFile(filepath.Join(logDir, appLogName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open log file: %w", err)
 	}
+	piiRedactor, err = loadRedactor()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load redaction rules: %w", err)
+	}
 	baseHandler := slog.NewJSONHandler(logFile, nil)
-	otelHandler := NewOtelHandler(baseHandler)
+	otelHandler := NewOtelHandler(baseHandler, piiRedactor)
 	Logger = slog.New(otelHandler)
 	// Logger = slog.New(slog.NewJSONHandler(logFile, nil))
 
@@ -83,7 +93,7 @@ func initTelemetry() (func(), error) {
 	tracerProvider = trace.NewTracerProvider(
 		trace.WithResource(res),
 		trace.WithSampler(trace.AlwaysSample()),
-		trace.WithSpanProcessor(bsp),
+		trace.WithSpanProcessor(NewRedactingSpanProcessor(bsp, piiRedactor)),
 	)
 	otel.SetTracerProvider(tracerProvider)
 
@@ -101,6 +111,7 @@ func initTelemetry() (func(), error) {
 	meterProvider = sdkmetric.NewMeterProvider(
 		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)),
 		sdkmetric.WithResource(res),
+		sdkmetric.WithView(piiRedactor.MetricView()),
 	)
 	otel.SetMeterProvider(meterProvider)
 
@@ -116,6 +127,15 @@ func initTelemetry() (func(), error) {
 		return nil, fmt.Errorf("failed to create app_login_attempts instrument: %w", err)
 	}
 
+	loginLockouts, err = meter.Int64Counter(
+		"app_login_lockouts",
+		metric.WithDescription("Total number of temporary account lockouts after repeated failed logins."),
+		metric.WithUnit("{lockout}"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create app_login_lockouts instrument: %w", err)
+	}
+
 	registerAttempts, err = meter.Int64Counter(
 		"app_register_attempts",
 		metric.WithDescription("Total number of user registration attempts."),
@@ -124,6 +144,14 @@ func initTelemetry() (func(), error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create app_register_attempts instrument: %w", err)
 	}
+	passwordResetAttempts, err = meter.Int64Counter(
+		"app_password_reset_attempts",
+		metric.WithDescription("Total number of password reset requests and completions."),
+		metric.WithUnit("{attempt}"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create app_password_reset_attempts instrument: %w", err)
+	}
 	authDuration, err = meter.Float64Histogram(
 		"app_auth_duration",
 		metric.WithDescription("Duration of user authentication operations."),
@@ -168,6 +196,46 @@ func initTelemetry() (func(), error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create app.external.api_call_duration instrument: %w", err)
 	}
+
+	symbolCacheRequests, err = meter.Int64Counter(
+		"app_symbol_cache_requests",
+		metric.WithDescription("Symbol catalog lookups by cache outcome: hit, miss or stale."),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create app_symbol_cache_requests instrument: %w", err)
+	}
+	priceHistoryRowsWritten, err = meter.Int64Counter(
+		"app_price_history_rows_written",
+		metric.WithDescription("Price history rows written, by asset type and what triggered the write."),
+		metric.WithUnit("{row}"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create app_price_history_rows_written instrument: %w", err)
+	}
+	alphaVantageQueueDepth, err = meter.Int64UpDownCounter(
+		"app_alphavantage_queue_depth",
+		metric.WithDescription("AlphaVantage calls waiting for their API key's rate limit."),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create app_alphavantage_queue_depth instrument: %w", err)
+	}
+	alphaVantageQueueWait, err = meter.Float64Histogram(
+		"app_alphavantage_queue_wait",
+		metric.WithDescription("Time AlphaVantage calls waited for their API key's rate limit, by outcome."),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create app_alphavantage_queue_wait instrument: %w", err)
+	}
+	if _, err = meter.Int64ObservableGauge(
+		"app_circuit_breaker_state",
+		metric.WithDescription("Market data provider circuit breaker state: 0 closed, 1 half-open, 2 open."),
+		metric.WithInt64Callback(observeBreakerStates),
+	); err != nil {
+		return nil, fmt.Errorf("failed to create app_circuit_breaker_state instrument: %w", err)
+	}
 	log.Println("Application metrics instruments initialized.")
 
 	// mux := http.NewServeMux()
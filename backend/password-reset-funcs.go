@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	passwordResetTTL = getEnvDuration("PASSWORD_RESET_TTL", time.Hour)
+	passwordResetURL = getEnv("PASSWORD_RESET_URL", "http://localhost:6600/reset-password")
+)
+
+var (
+	errInvalidResetToken = errors.New("invalid or expired reset token")
+	errPasswordRejected  = errors.New("new password does not meet the password policy")
+)
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+const forgotPasswordResponse = "If an account exists for that email, a password reset link has been sent"
+
+func forgotPassword(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	startTime := time.Now()
+
+	ctx, span := tracer.Start(ctx, "auth.password_forgot",
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", "/users/password/forgot"),
+			attribute.String("component", "auth_service"),
+			attribute.String("operation", "password_forgot"),
+			attribute.String("user_agent", r.UserAgent()),
+			attribute.String("remote_addr", r.RemoteAddr),
+		),
+	)
+	defer span.End()
+
+	baseAttrs := []attribute.KeyValue{
+		attribute.String("endpoint", "password_forgot"),
+		attribute.String("method", r.Method),
+		attribute.String("component", "auth_service"),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if httpRequestCount != nil {
+		httpRequestCount.Add(ctx, 1, metric.WithAttributes(baseAttrs...))
+	}
+	if passwordResetAttempts != nil {
+		passwordResetAttempts.Add(ctx, 1, metric.WithAttributes(append(baseAttrs,
+			attribute.String("stage", "forgot"),
+		)...))
+	}
+
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		span.SetStatus(codes.Error, "Missing email")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Success: false,
+			Message: "Email is required",
+		})
+		return
+	}
+	if rejectMailThrottled(ctx, span, w, r, req.Email) {
+		return
+	}
+
+	// The lookup, token and mail happen after the response so that latency
+	// does not reveal whether the email is registered.
+	go issuePasswordReset(trace.ContextWithSpan(context.WithoutCancel(ctx), span), req.Email, r.RemoteAddr)
+
+	if authDuration != nil {
+		authDuration.Record(ctx, time.Since(startTime).Seconds(),
+			metric.WithAttributes(append(baseAttrs,
+				attribute.String("status", "accepted"),
+			)...),
+		)
+	}
+
+	span.SetStatus(codes.Ok, "Password reset requested")
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(AuthResponse{
+		Success: true,
+		Message: forgotPasswordResponse,
+	})
+}
+
+func issuePasswordReset(ctx context.Context, email, remoteAddr string) {
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	ctx, span := tracer.Start(ctx, "auth.password_forgot.issue_token",
+		trace.WithAttributes(
+			attribute.String("operation", "issue_reset_token"),
+			attribute.String("table", "password_reset_tokens"),
+		),
+	)
+	defer span.End()
+
+	var user User
+	err := DB.WithContext(ctx).Where("email = ?", email).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		span.SetAttributes(attribute.Bool("user.found", false))
+		span.SetStatus(codes.Ok, "No matching account")
+		Logger.InfoContext(ctx, "Password reset requested for unknown email")
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Database error")
+		Logger.ErrorContext(ctx, "Database error during password reset request",
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+	span.SetAttributes(
+		attribute.Bool("user.found", true),
+		attribute.Int("user_id", user.ID),
+	)
+
+	raw, hash, err := generateOpaqueToken()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Token generation failed")
+		return
+	}
+
+	err = DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&PasswordResetToken{}).
+			Where("user_id = ? AND used_at IS NULL", user.ID).
+			Update("used_at", time.Now().UTC()).Error; err != nil {
+			return err
+		}
+		return tx.Create(&PasswordResetToken{
+			UserID:     user.ID,
+			TokenHash:  hash,
+			ExpiresAt:  time.Now().UTC().Add(passwordResetTTL),
+			RemoteAddr: remoteAddr,
+		}).Error
+	})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Storing reset token failed")
+		Logger.ErrorContext(ctx, "Failed to store password reset token",
+			slog.Int("user_id", user.ID),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	link := fmt.Sprintf("%s?token=%s", passwordResetURL, url.QueryEscape(raw))
+	err = sendMail(ctx, MailMessage{
+		To:      user.Email,
+		Subject: "Reset your Stock Tracker password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password for your account. If it was you, open the link below:\n\n%s\n\nThe link expires in %s and can be used once. If you did not ask for this, you can ignore this email.\n",
+			user.Username, link, passwordResetTTL),
+	})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Reset email failed")
+		Logger.ErrorContext(ctx, "Failed to send password reset email",
+			slog.Int("user_id", user.ID),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	span.SetStatus(codes.Ok, "Reset token issued")
+	Logger.InfoContext(ctx, "Password reset email sent",
+		slog.Int("user_id", user.ID),
+	)
+}
+
+// consumePasswordReset spends a reset token, stores the new password hash and
+// revokes every session of the user in one transaction. The token row is
+// locked before newPassword runs, so the expensive hash is only computed
+// for a valid token; an error from newPassword leaves the token unused.
+func consumePasswordReset(ctx context.Context, raw string, newPassword func(*User) (string, error)) (*User, int64, error) {
+	var user User
+	var revoked int64
+	err := DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var token PasswordResetToken
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashOpaqueToken(raw), time.Now().UTC()).
+			First(&token).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errInvalidResetToken
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := tx.First(&user, "id = ?", token.UserID).Error; err != nil {
+			return err
+		}
+		hashedPassword, err := newPassword(&user)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		result := tx.Model(&PasswordResetToken{}).
+			Where("id = ? AND used_at IS NULL", token.ID).
+			Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errInvalidResetToken
+		}
+
+		updates := map[string]interface{}{"password": hashedPassword}
+		// Following the emailed link proves control of the mailbox.
+		if user.EmailVerifiedAt == nil {
+			updates["email_verified_at"] = now
+		}
+		if err := tx.Model(&user).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		revoked, err = revokeUserSessions(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return &user, revoked, nil
+}
+
+func resetPassword(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	startTime := time.Now()
+
+	ctx, span := tracer.Start(ctx, "auth.password_reset",
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", "/users/password/reset"),
+			attribute.String("component", "auth_service"),
+			attribute.String("operation", "password_reset"),
+			attribute.String("user_agent", r.UserAgent()),
+			attribute.String("remote_addr", r.RemoteAddr),
+		),
+	)
+	defer span.End()
+
+	baseAttrs := []attribute.KeyValue{
+		attribute.String("endpoint", "password_reset"),
+		attribute.String("method", r.Method),
+		attribute.String("component", "auth_service"),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if httpRequestCount != nil {
+		httpRequestCount.Add(ctx, 1, metric.WithAttributes(baseAttrs...))
+	}
+
+	status := "failure"
+	defer func() {
+		if passwordResetAttempts != nil {
+			passwordResetAttempts.Add(ctx, 1, metric.WithAttributes(append(baseAttrs,
+				attribute.String("stage", "reset"),
+				attribute.String("status", status),
+			)...))
+		}
+	}()
+
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" || req.Password == "" {
+		span.SetStatus(codes.Error, "Missing required fields")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Success: false,
+			Message: "Token and password are required",
+		})
+		return
+	}
+	dbCtx, consumeSpan := tracer.Start(ctx, "auth.password_reset.consume_token",
+		trace.WithAttributes(
+			attribute.String("operation", "consume_reset_token"),
+			attribute.String("table", "password_reset_tokens"),
+		),
+	)
+	// The password can only be checked against the account's identifiers, and
+	// the hash is only computed, once the token has been found and locked. A
+	// rejected password rolls the transaction back and leaves the token unused.
+	var v Validator
+	var hashErr error
+	user, revoked, err := consumePasswordReset(dbCtx, req.Token, func(user *User) (string, error) {
+		v.Password("password", req.Password, user.Username, user.Email)
+		if !v.Valid() {
+			return "", errPasswordRejected
+		}
+
+		_, hashSpan := tracer.Start(dbCtx, "auth.password_reset.hash_password",
+			trace.WithAttributes(
+				attribute.String("operation", "password_hashing"),
+				attribute.String("password.algorithm", passwordHashAlgorithm),
+				attribute.Int("password.memory_kib", int(passwordParams.Memory)),
+				attribute.Int("password.iterations", int(passwordParams.Iterations)),
+				attribute.Int("password.parallelism", int(passwordParams.Parallelism)),
+			),
+		)
+		defer hashSpan.End()
+
+		hashedPwd, err := hashPassword(req.Password)
+		if err != nil {
+			hashErr = err
+			hashSpan.RecordError(err)
+			hashSpan.SetStatus(codes.Error, "Password hashing failed")
+			return "", err
+		}
+		hashSpan.SetStatus(codes.Ok, "Password hashed successfully")
+		return hashedPwd, nil
+	})
+	if err != nil {
+		consumeSpan.RecordError(err)
+		consumeSpan.SetStatus(codes.Error, "Reset token rejected")
+		consumeSpan.End()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Password reset failed")
+
+		if errors.Is(err, errPasswordRejected) {
+			status = "invalid_password"
+			recordValidationFailure(span, v.Errors)
+			writeValidationError(w, v.Errors)
+			return
+		}
+		if hashErr != nil {
+			Logger.ErrorContext(ctx, "Password hashing failed during reset",
+				slog.String("error", err.Error()),
+			)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ErrorResponse{
+				Success: false,
+				Message: "Password hashing failed",
+				Error:   err.Error(),
+			})
+			return
+		}
+		if errors.Is(err, errInvalidResetToken) {
+			status = "invalid_token"
+			Logger.InfoContext(ctx, "Password reset rejected - invalid or expired token")
+
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{
+				Success: false,
+				Message: "Invalid or expired reset token",
+				Error:   "INVALID_RESET_TOKEN",
+			})
+			return
+		}
+
+		Logger.ErrorContext(ctx, "Database error during password reset",
+			slog.String("error", err.Error()),
+		)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Success: false,
+			Message: "Database error",
+			Error:   err.Error(),
+		})
+		return
+	}
+	consumeSpan.SetAttributes(
+		attribute.Int("user_id", user.ID),
+		attribute.Int64("session.tokens_revoked", revoked),
+	)
+	consumeSpan.SetStatus(codes.Ok, "Password updated")
+	consumeSpan.End()
+
+	loginLimiter.recordSuccess(normalizeLoginEmail(user.Email))
+	status = "success"
+
+	if authDuration != nil {
+		authDuration.Record(ctx, time.Since(startTime).Seconds(),
+			metric.WithAttributes(append(baseAttrs,
+				attribute.String("status", "success"),
+				attribute.Int("user_id", user.ID),
+			)...),
+		)
+	}
+
+	span.SetStatus(codes.Ok, "Password reset successful")
+	span.SetAttributes(attribute.Int("user_id", user.ID))
+
+	Logger.InfoContext(ctx, "Password reset successful",
+		slog.Int("user_id", user.ID),
+		slog.Int64("sessions_revoked", revoked),
+		slog.Duration("total_duration", time.Since(startTime)),
+	)
+
+	json.NewEncoder(w).Encode(AuthResponse{
+		Success: true,
+		Message: "Password has been reset, please log in again",
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runResetPassword(token, password string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(ResetPasswordRequest{Token: token, Password: password})
+	rec := httptest.NewRecorder()
+	resetPassword(rec, httptest.NewRequest(http.MethodPost, "/users/password/reset", strings.NewReader(string(body))))
+	return rec
+}
+
+func TestResetPasswordRejectsPasswordContainingIdentifiers(t *testing.T) {
+	setupTestDB(t)
+
+	user := User{Username: "alice", Email: "wonderland@example.com", Password: "unused"}
+	if err := DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	raw, hash, err := generateOpaqueToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.Create(&PasswordResetToken{UserID: user.ID, TokenHash: hash, ExpiresAt: time.Now().UTC().Add(time.Hour)}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, password := range []string{"alice-2024-pass", "Wonderland99"} {
+		rec := runResetPassword(raw, password)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("reset with %q returned %d, want 400: %s", password, rec.Code, rec.Body)
+		}
+		var resp ErrorResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if len(resp.Fields) != 1 || resp.Fields[0].Code != "CONTAINS_IDENTIFIER" {
+			t.Errorf("reset with %q: fields = %+v, want CONTAINS_IDENTIFIER", password, resp.Fields)
+		}
+	}
+
+	var token PasswordResetToken
+	DB.First(&token, "token_hash = ?", hash)
+	if token.UsedAt != nil {
+		t.Fatal("a rejected password spent the reset token")
+	}
+
+	if rec := runResetPassword(raw, "correct-horse-7"); rec.Code != http.StatusOK {
+		t.Fatalf("reset with a valid password returned %d: %s", rec.Code, rec.Body)
+	}
+	DB.First(&user, "id = ?", user.ID)
+	if !verifyPassword(user.Password, "correct-horse-7") {
+		t.Error("the new password was not stored")
+	}
+}
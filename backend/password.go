@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const passwordHashAlgorithm = "argon2id"
+
+var (
+	errInvalidPasswordHash      = errors.New("invalid password hash encoding")
+	errUnsupportedPasswordHash  = errors.New("unsupported password hash algorithm")
+	errIncompatibleArgonVersion = errors.New("incompatible argon2 version")
+)
+
+// passwordHashParams are the argon2id cost parameters. They are encoded into
+// every stored hash so that older hashes keep verifying after the defaults
+// change, and can be upgraded on the next successful login.
+type passwordHashParams struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+var passwordParams = passwordHashParams{
+	Memory:      uint32(getEnvInt("PASSWORD_ARGON2_MEMORY_KIB", 64*1024)),
+	Iterations:  uint32(getEnvInt("PASSWORD_ARGON2_ITERATIONS", 3)),
+	Parallelism: uint8(getEnvInt("PASSWORD_ARGON2_PARALLELISM", 2)),
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// hashPassword returns a PHC-style encoded argon2id hash:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, passwordParams.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("error generating salt: %w", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, passwordParams.Iterations, passwordParams.Memory, passwordParams.Parallelism, passwordParams.KeyLength)
+
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		passwordHashAlgorithm,
+		argon2.Version,
+		passwordParams.Memory,
+		passwordParams.Iterations,
+		passwordParams.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func verifyPassword(hashedPassword, password string) bool {
+	params, salt, key, err := decodePasswordHash(hashedPassword)
+	if err != nil {
+		return false
+	}
+
+	candidate := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	return subtle.ConstantTimeCompare(key, candidate) == 1
+}
+
+var (
+	dummyPasswordHash     string
+	dummyPasswordHashOnce sync.Once
+)
+
+// burnPasswordCheck spends roughly the same time as a real verification so an
+// unknown email cannot be told apart from a wrong password by latency.
+func burnPasswordCheck(password string) {
+	dummyPasswordHashOnce.Do(func() {
+		dummyPasswordHash, _ = hashPassword("not-a-real-password")
+	})
+	verifyPassword(dummyPasswordHash, password)
+}
+
+// passwordNeedsRehash reports whether a stored hash was produced with
+// parameters other than the current defaults.
+func passwordNeedsRehash(hashedPassword string) bool {
+	params, _, _, err := decodePasswordHash(hashedPassword)
+	if err != nil {
+		return true
+	}
+	return params != passwordParams
+}
+
+// passwordHashInfo returns the cost parameters of an encoded hash without
+// touching the salt or key, for use in span attributes.
+func passwordHashInfo(hashedPassword string) (passwordHashParams, error) {
+	params, _, _, err := decodePasswordHash(hashedPassword)
+	return params, err
+}
+
+func decodePasswordHash(encoded string) (passwordHashParams, []byte, []byte, error) {
+	var params passwordHashParams
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+	if parts[1] != passwordHashAlgorithm {
+		return params, nil, nil, errUnsupportedPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+	if version != argon2.Version {
+		return params, nil, nil, errIncompatibleArgonVersion
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+	params.SaltLength = uint32(len(salt))
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, errInvalidPasswordHash
+	}
+	params.KeyLength = uint32(len(key))
+
+	return params, salt, key, nil
+}
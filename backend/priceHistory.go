@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Daily candles are kept in price_history. Every PRICE_HISTORY_SYNC_INTERVAL
+// the sync job backfills PRICE_HISTORY_BACKFILL_DAYS for newly watchlisted
+// symbols, fetches the days since its last run and repairs gaps. Daily price
+// requests read through the table: the provider is only asked for the part of
+// the range not fetched yet, and for the latest days once the last fetch is
+// older than PRICE_HISTORY_MAX_AGE.
+var (
+	priceHistorySyncInterval = getEnvDuration("PRICE_HISTORY_SYNC_INTERVAL", 24*time.Hour)
+	priceHistorySyncTimeout  = getEnvDuration("PRICE_HISTORY_SYNC_TIMEOUT", 30*time.Minute)
+	priceHistoryBackfillDays = getEnvInt("PRICE_HISTORY_BACKFILL_DAYS", 365)
+	priceHistoryMaxAge       = getEnvDuration("PRICE_HISTORY_MAX_AGE", time.Hour)
+)
+
+const priceHistoryBatchSize = 1000
+
+// What caused rows to be written, the trigger attribute of
+// app_price_history_rows_written.
+const (
+	historyTriggerRequest = "read_through"
+	historyTriggerSync    = "sync"
+	historyTriggerRepair  = "gap_repair"
+)
+
+// historyRange is a half-open range of days to fetch. A zero end reaches up
+// to now.
+type historyRange struct {
+	start time.Time
+	end   time.Time
+}
+
+func (r historyRange) contains(t time.Time) bool {
+	return !t.Before(r.start) && (r.end.IsZero() || t.Before(r.end))
+}
+
+func dayStart(t time.Time) time.Time {
+	return bucketStart(t, "daily")
+}
+
+// historySymbol is the key a symbol's history is stored under.
+func historySymbol(assetType, symbol string) string {
+	if assetType == "STOCK" {
+		return strings.ToUpper(symbol)
+	}
+	return symbol
+}
+
+// historyDefaultFrom is where an unbounded daily request starts: about the
+// 100 bars the providers return by default. Stocks trade five days a week;
+// their window stays within what the compact AlphaVantage series reaches.
+func historyDefaultFrom(assetType string, to time.Time) time.Time {
+	if assetType == "STOCK" {
+		return dayStart(to).AddDate(0, 0, -alphaVantageCompactDays)
+	}
+	return dayStart(to).AddDate(0, 0, -100)
+}
+
+// historyLocks serializes fetches per symbol, so concurrent requests for the
+// same uncovered range trigger one upstream call and the later ones find the
+// range covered. An entry lives only while someone holds or waits for it,
+// so the table stays as small as the number of symbols in flight.
+var (
+	historyLocksMu sync.Mutex
+	historyLocks   = map[string]*historyLock{}
+)
+
+type historyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func lockHistory(assetType, symbol string) func() {
+	key := assetType + ":" + symbol
+	historyLocksMu.Lock()
+	lock, ok := historyLocks[key]
+	if !ok {
+		lock = &historyLock{}
+		historyLocks[key] = lock
+	}
+	lock.refs++
+	historyLocksMu.Unlock()
+
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+		historyLocksMu.Lock()
+		if lock.refs--; lock.refs == 0 {
+			delete(historyLocks, key)
+		}
+		historyLocksMu.Unlock()
+	}
+}
+
+// fetchHistory asks the provider for the daily candles of the range.
+func fetchHistory(ctx context.Context, assetType, symbol string, r historyRange) ([]Candle, error) {
+	query := SeriesQuery{Interval: "daily", From: r.start, To: r.end}
+	var quote *Quote
+	var err error
+	if assetType == "STOCK" {
+		quote, err = stockProvider.Series(ctx, symbol, query)
+	} else {
+		quote, err = cryptoProvider.CoinSeries(ctx, symbol, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Providers may return more than asked for, and a crypto bucket at the
+	// end of a range only holds part of that day.
+	candles := quote.Candles[:0]
+	for _, c := range quote.Candles {
+		if r.contains(c.Timestamp) {
+			candles = append(candles, c)
+		}
+	}
+	return candles, nil
+}
+
+// storeHistory upserts candles and, when coverage is given, records it in the
+// same transaction.
+func storeHistory(ctx context.Context, assetType, symbol string, candles []Candle, coverage *PriceHistoryCoverage, trigger string) (int, error) {
+	now := time.Now().UTC()
+	rows := make([]PriceBar, 0, len(candles))
+	for _, c := range candles {
+		rows = append(rows, PriceBar{
+			Type:      assetType,
+			Symbol:    symbol,
+			Timestamp: c.Timestamp,
+			Open:      c.Open,
+			High:      c.High,
+			Low:       c.Low,
+			Close:     c.Close,
+			Volume:    c.Volume,
+			Currency:  c.Currency,
+			Source:    c.Source,
+			SyncedAt:  now,
+		})
+	}
+
+	err := DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if len(rows) > 0 {
+			if err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "type"}, {Name: "symbol"}, {Name: "ts"}},
+				DoUpdates: clause.AssignmentColumns([]string{"open", "high", "low", "close", "volume", "currency", "source", "synced_at"}),
+			}).CreateInBatches(rows, priceHistoryBatchSize).Error; err != nil {
+				return err
+			}
+		}
+		if coverage == nil {
+			return nil
+		}
+		coverage.SyncedAt = now
+		return tx.Save(coverage).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if priceHistoryRowsWritten != nil && len(rows) > 0 {
+		priceHistoryRowsWritten.Add(ctx, int64(len(rows)), metric.WithAttributes(
+			attribute.String("type", assetType),
+			attribute.String("trigger", trigger),
+		))
+	}
+	return len(rows), nil
+}
+
+// ensureHistory makes sure [from, to] is covered, fetching only what is
+// missing. Coverage is kept contiguous: an earlier start is fetched up to the
+// covered range, and a stale end is fetched from the last covered day to now.
+func ensureHistory(ctx context.Context, assetType, symbol string, from, to time.Time, trigger string) (int, error) {
+	unlock := lockHistory(assetType, symbol)
+	defer unlock()
+
+	var coverage PriceHistoryCoverage
+	err := DB.WithContext(ctx).Where("type = ? AND symbol = ?", assetType, symbol).Take(&coverage).Error
+	found := err == nil
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, err
+	}
+
+	from = dayStart(from)
+	head := !found || from.Before(coverage.From)
+	tail := !found || (to.After(coverage.To) && time.Since(coverage.To) > priceHistoryMaxAge)
+
+	var fetch historyRange
+	switch {
+	case head && tail:
+		fetch = historyRange{start: from}
+	case head:
+		fetch = historyRange{start: from, end: coverage.From}
+	case tail:
+		fetch = historyRange{start: dayStart(coverage.To)}
+	default:
+		return 0, nil
+	}
+
+	fetchedAt := time.Now().UTC()
+	candles, err := fetchHistory(ctx, assetType, symbol, fetch)
+	if err != nil {
+		return 0, err
+	}
+
+	updated := PriceHistoryCoverage{Type: assetType, Symbol: symbol, From: coverage.From, To: coverage.To}
+	if head {
+		updated.From = from
+	}
+	if tail {
+		updated.To = fetchedAt
+	}
+	return storeHistory(ctx, assetType, symbol, candles, &updated, trigger)
+}
+
+// readDailyHistory serves a daily price request from price_history, fetching
+// the parts of the range that are not stored yet.
+func readDailyHistory(ctx context.Context, assetType, symbol string, query SeriesQuery) (*Quote, error) {
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	ctx, span := tracer.Start(ctx, "priceHistory.read",
+		trace.WithAttributes(
+			attribute.String("asset.type", assetType),
+			attribute.String("asset.symbol", symbol),
+		),
+	)
+	defer span.End()
+
+	symbol = historySymbol(assetType, symbol)
+	to := query.To
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+	from := dayStart(query.From)
+	if query.From.IsZero() {
+		from = historyDefaultFrom(assetType, to)
+	}
+
+	written, err := ensureHistory(ctx, assetType, symbol, from, to, historyTriggerRequest)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Filling price history failed")
+		return nil, err
+	}
+
+	var bars []PriceBar
+	if err := DB.WithContext(ctx).
+		Where("type = ? AND symbol = ? AND ts BETWEEN ? AND ?", assetType, symbol, from, to).
+		Order("ts").Find(&bars).Error; err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Reading price history failed")
+		return nil, fmt.Errorf("error reading price history: %w", err)
+	}
+
+	span.SetAttributes(
+		attribute.Int("history.rows_written", written),
+		attribute.Int("candles.count", len(bars)),
+	)
+	span.SetStatus(codes.Ok, "Price history read")
+
+	quote := &Quote{Symbol: symbol, Type: assetType, Interval: "daily", Candles: make([]Candle, 0, len(bars))}
+	for _, b := range bars {
+		quote.Candles = append(quote.Candles, Candle{
+			Timestamp: b.Timestamp.UTC(),
+			Open:      b.Open,
+			High:      b.High,
+			Low:       b.Low,
+			Close:     b.Close,
+			Volume:    b.Volume,
+			Currency:  b.Currency,
+			Source:    b.Source,
+		})
+	}
+	if len(bars) > 0 {
+		last := bars[len(bars)-1]
+		quote.Currency, quote.Source = last.Currency, last.Source
+	}
+	return quote, nil
+}
+
+// findGaps returns the runs of days between the first stored bar and the
+// last fully covered day that should have a bar but do not. Crypto trades
+// every day. Stocks trade on weekdays, and a single missing weekday is taken
+// to be a market holiday, so only longer runs count.
+func findGaps(assetType string, coverage PriceHistoryCoverage, days []time.Time) []historyRange {
+	if len(days) == 0 {
+		return nil
+	}
+	stored := make(map[time.Time]bool, len(days))
+	for _, d := range days {
+		stored[dayStart(d)] = true
+	}
+	minRun := 1
+	if assetType == "STOCK" {
+		minRun = 2
+	}
+
+	var gaps []historyRange
+	var run historyRange
+	missing := 0
+	last := dayStart(coverage.To)
+	for d := dayStart(days[0]); d.Before(last); d = d.AddDate(0, 0, 1) {
+		if assetType == "STOCK" && (d.Weekday() == time.Saturday || d.Weekday() == time.Sunday) {
+			continue
+		}
+		if !stored[d] {
+			if missing == 0 {
+				run.start = d
+			}
+			missing++
+			run.end = d.AddDate(0, 0, 1)
+			continue
+		}
+		if missing >= minRun {
+			gaps = append(gaps, run)
+		}
+		missing = 0
+	}
+	if missing >= minRun {
+		gaps = append(gaps, run)
+	}
+	return gaps
+}
+
+// repairGaps refetches the gaps of a symbol's history in one call spanning
+// all of them.
+func repairGaps(ctx context.Context, assetType, symbol string) ([]historyRange, int, error) {
+	unlock := lockHistory(assetType, symbol)
+	defer unlock()
+
+	var coverage PriceHistoryCoverage
+	if err := DB.WithContext(ctx).Where("type = ? AND symbol = ?", assetType, symbol).Take(&coverage).Error; err != nil {
+		return nil, 0, err
+	}
+	var days []time.Time
+	if err := DB.WithContext(ctx).Model(&PriceBar{}).
+		Where("type = ? AND symbol = ? AND ts >= ?", assetType, symbol, coverage.From).
+		Order("ts").Pluck("ts", &days).Error; err != nil {
+		return nil, 0, err
+	}
+
+	gaps := findGaps(assetType, coverage, days)
+	if len(gaps) == 0 {
+		return nil, 0, nil
+	}
+	candles, err := fetchHistory(ctx, assetType, symbol, historyRange{start: gaps[0].start, end: gaps[len(gaps)-1].end})
+	if err != nil {
+		return gaps, 0, err
+	}
+	written, err := storeHistory(ctx, assetType, symbol, candles, nil, historyTriggerRepair)
+	return gaps, written, err
+}
+
+// historyTarget is a symbol on at least one watchlist.
+type historyTarget struct {
+	Type   string
+	Symbol string
+}
+
+func watchlistedSymbols(ctx context.Context) ([]historyTarget, error) {
+	var targets []historyTarget
+	err := DB.WithContext(ctx).Model(&UserSymbols{}).
+		Select("DISTINCT type, CASE WHEN type = 'CRYPTO' THEN crypto_id ELSE UPPER(symbol) END AS symbol").
+		Where("type = 'STOCK' OR (crypto_id IS NOT NULL AND crypto_id <> '')").
+		Scan(&targets).Error
+	return targets, err
+}
+
+// startPriceHistorySync starts the sync loop. The first run starts right
+// away, so new deployments backfill without waiting a day. The returned func
+// stops the loop.
+func startPriceHistorySync() func() {
+	stop := make(chan struct{})
+	go func() {
+		runPriceHistorySync()
+
+		ticker := time.NewTicker(priceHistorySyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				runPriceHistorySync()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+func runPriceHistorySync() {
+	ctx, cancel := context.WithTimeout(context.Background(), priceHistorySyncTimeout)
+	defer cancel()
+
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	ctx, span := tracer.Start(ctx, "priceHistory.sync")
+	defer span.End()
+
+	targets, err := watchlistedSymbols(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Listing watchlisted symbols failed")
+		Logger.ErrorContext(ctx, "Price history sync could not list watchlisted symbols", "error", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	from := dayStart(now).AddDate(0, 0, -priceHistoryBackfillDays)
+	var rows, failures, gapCount int
+	for _, target := range targets {
+		written, err := ensureHistory(ctx, target.Type, target.Symbol, from, now, historyTriggerSync)
+		rows += written
+		if err != nil {
+			failures++
+			Logger.WarnContext(ctx, "Price history sync failed for symbol", "type", target.Type, "symbol", target.Symbol, "error", err)
+			continue
+		}
+
+		gaps, repaired, err := repairGaps(ctx, target.Type, target.Symbol)
+		rows += repaired
+		gapCount += len(gaps)
+		for _, gap := range gaps {
+			span.AddEvent("price_history.gap", trace.WithAttributes(
+				attribute.String("asset.type", target.Type),
+				attribute.String("asset.symbol", target.Symbol),
+				attribute.String("gap.from", gap.start.Format("2006-01-02")),
+				attribute.String("gap.to", gap.end.AddDate(0, 0, -1).Format("2006-01-02")),
+			))
+		}
+		if len(gaps) > 0 {
+			Logger.InfoContext(ctx, "Price history gaps found", "type", target.Type, "symbol", target.Symbol, "gaps", len(gaps), "rows_repaired", repaired)
+		}
+		if err != nil {
+			failures++
+			Logger.WarnContext(ctx, "Price history gap repair failed for symbol", "type", target.Type, "symbol", target.Symbol, "error", err)
+		}
+	}
+
+	span.SetAttributes(
+		attribute.Int("history.symbols", len(targets)),
+		attribute.Int("history.rows_written", rows),
+		attribute.Int("history.gaps", gapCount),
+		attribute.Int("history.failures", failures),
+	)
+	if failures > 0 {
+		span.SetStatus(codes.Error, "Price history sync failed for some symbols")
+	} else {
+		span.SetStatus(codes.Ok, "Price history synced")
+	}
+	Logger.InfoContext(ctx, "Price history sync finished", "symbols", len(targets), "rows_written", rows, "gaps", gapCount, "failures", failures)
+}
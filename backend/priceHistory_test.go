@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestLockHistorySerializesAndForgetsSymbols(t *testing.T) {
+	var holders, overlaps atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := lockHistory("STOCK", "IBM")
+			defer unlock()
+			if holders.Add(1) > 1 {
+				overlaps.Add(1)
+			}
+			time.Sleep(time.Millisecond)
+			holders.Add(-1)
+		}()
+	}
+	// A different symbol is not held up by IBM.
+	unlock := lockHistory("STOCK", "MSFT")
+	unlock()
+	wg.Wait()
+
+	if overlaps.Load() != 0 {
+		t.Errorf("%d fetches of the same symbol overlapped", overlaps.Load())
+	}
+	historyLocksMu.Lock()
+	defer historyLocksMu.Unlock()
+	if len(historyLocks) != 0 {
+		t.Errorf("lock table holds %d entries after every lock was released", len(historyLocks))
+	}
+}
+
+// The default window of a daily stock request must fit the compact series,
+// or every chart without a range downloads the full history.
+func TestDefaultStockHistoryStaysCompact(t *testing.T) {
+	setupTestDB(t)
+	var outputsize []string
+	provider := newTestAlphaVantage(t, "test-key", func(w http.ResponseWriter, r *http.Request) {
+		outputsize = append(outputsize, r.URL.Query().Get("outputsize"))
+		w.Write([]byte(`{"Meta Data": {"5. Time Zone": "US/Eastern"}, "Time Series (Daily)": {}}`))
+	})
+	setVar[StockProvider](t, &stockProvider, provider)
+
+	if _, err := readDailyHistory(context.Background(), "STOCK", "IBM", SeriesQuery{Interval: "daily"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(outputsize) != 1 || outputsize[0] != "compact" {
+		t.Errorf("outputsize = %v, want one compact request", outputsize)
+	}
+
+	// A day before the window needs the full series.
+	from := historyDefaultFrom("STOCK", time.Now().UTC()).AddDate(0, 0, -1)
+	if _, params, _ := seriesFunction(SeriesQuery{Interval: "daily", From: from}); params.Get("outputsize") != "full" {
+		t.Errorf("outputsize = %q from %s, want full", params.Get("outputsize"), from)
+	}
+}
+
+func TestFindGaps(t *testing.T) {
+	// March 4, 2024 is a Monday.
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC) }
+	days := func(ds ...int) []time.Time {
+		out := make([]time.Time, len(ds))
+		for i, d := range ds {
+			out[i] = day(d)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name      string
+		assetType string
+		days      []time.Time
+		to        time.Time
+		want      []historyRange
+	}{
+		{"no bars", "STOCK", nil, day(15), nil},
+		{"full trading week", "STOCK", days(4, 5, 6, 7, 8, 11), day(12), nil},
+		{"weekend is not a gap", "STOCK", days(8, 11), day(12), nil},
+		{"single weekday is a holiday", "STOCK", days(4, 5, 7, 8), day(9), nil},
+		{"two weekdays", "STOCK", days(4, 7, 8), day(9), []historyRange{{day(5), day(7)}}},
+		{"run across a weekend", "STOCK", days(4, 5, 6, 7, 12), day(13), []historyRange{{day(8), day(12)}}},
+		{"several gaps", "STOCK", days(4, 7, 8, 13, 14), day(15), []historyRange{{day(5), day(7)}, {day(11), day(13)}}},
+		{"missing up to coverage end", "STOCK", days(4, 5), day(8), []historyRange{{day(6), day(8)}}},
+		{"day of coverage end is not checked", "STOCK", days(4, 5, 6), day(7).Add(10 * time.Hour), nil},
+		{"crypto trades on weekends", "CRYPTO", days(8, 11), day(12), []historyRange{{day(9), day(11)}}},
+		{"single crypto day is a gap", "CRYPTO", days(4, 6), day(7), []historyRange{{day(5), day(6)}}},
+	}
+	for _, tt := range tests {
+		coverage := PriceHistoryCoverage{Type: tt.assetType, Symbol: "TEST", From: day(4), To: tt.to}
+		if got := findGaps(tt.assetType, coverage, tt.days); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: gaps = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// stubStockProvider serves a daily bar for every weekday of a query and
+// records the queries.
+type stubStockProvider struct {
+	queries []SeriesQuery
+}
+
+func (p *stubStockProvider) Name() string { return "stub" }
+
+func (p *stubStockProvider) ListSymbols(ctx context.Context) ([]StockListing, error) {
+	return nil, nil
+}
+
+func (p *stubStockProvider) Series(ctx context.Context, symbol string, query SeriesQuery) (*Quote, error) {
+	p.queries = append(p.queries, query)
+	end := query.To
+	if end.IsZero() {
+		end = time.Now().UTC()
+	}
+	quote := &Quote{Symbol: symbol, Interval: "daily"}
+	for d := dayStart(query.From); d.Before(end); d = d.AddDate(0, 0, 1) {
+		if d.Weekday() != time.Saturday && d.Weekday() != time.Sunday {
+			quote.Candles = append(quote.Candles, Candle{Timestamp: d, Close: 100, Source: p.Name()})
+		}
+	}
+	return quote, nil
+}
+
+func weekdaysBetween(from, to time.Time) int {
+	n := 0
+	for d := from; d.Before(to); d = d.AddDate(0, 0, 1) {
+		if d.Weekday() != time.Saturday && d.Weekday() != time.Sunday {
+			n++
+		}
+	}
+	return n
+}
+
+func TestEnsureHistory(t *testing.T) {
+	today := dayStart(time.Now().UTC())
+	now := time.Now().UTC()
+
+	tests := []struct {
+		name     string
+		coverage *PriceHistoryCoverage
+		from, to time.Time
+		// want is the range fetched, or nil when nothing should be.
+		want *historyRange
+		// wantFrom and wantTo tell whether the coverage should move.
+		wantFrom bool
+		wantTo   bool
+	}{
+		{
+			name: "nothing stored", from: today.AddDate(0, 0, -30), to: now,
+			want: &historyRange{start: today.AddDate(0, 0, -30)}, wantFrom: true, wantTo: true,
+		},
+		{
+			name:     "covered and fresh",
+			coverage: &PriceHistoryCoverage{From: today.AddDate(0, 0, -60), To: now.Add(-time.Minute)},
+			from:     today.AddDate(0, 0, -30), to: now,
+		},
+		{
+			name:     "earlier start fetches the head",
+			coverage: &PriceHistoryCoverage{From: today.AddDate(0, 0, -30), To: now.Add(-time.Minute)},
+			from:     today.AddDate(0, 0, -60), to: now,
+			want: &historyRange{start: today.AddDate(0, 0, -60), end: today.AddDate(0, 0, -30)}, wantFrom: true,
+		},
+		{
+			name:     "stale end fetches the tail",
+			coverage: &PriceHistoryCoverage{From: today.AddDate(0, 0, -30), To: now.AddDate(0, 0, -4)},
+			from:     today.AddDate(0, 0, -10), to: now,
+			want: &historyRange{start: today.AddDate(0, 0, -4)}, wantTo: true,
+		},
+		{
+			name:     "end within the max age",
+			coverage: &PriceHistoryCoverage{From: today.AddDate(0, 0, -30), To: now.Add(-priceHistoryMaxAge / 2)},
+			from:     today.AddDate(0, 0, -10), to: now,
+		},
+		{
+			name:     "stale end after to",
+			coverage: &PriceHistoryCoverage{From: today.AddDate(0, 0, -30), To: today.AddDate(0, 0, -5)},
+			from:     today.AddDate(0, 0, -20), to: today.AddDate(0, 0, -10),
+		},
+		{
+			name:     "head and stale tail in one fetch",
+			coverage: &PriceHistoryCoverage{From: today.AddDate(0, 0, -30), To: today.AddDate(0, 0, -5)},
+			from:     today.AddDate(0, 0, -60), to: now,
+			want: &historyRange{start: today.AddDate(0, 0, -60)}, wantFrom: true, wantTo: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			provider := &stubStockProvider{}
+			setVar[StockProvider](t, &stockProvider, provider)
+			reader := sdkmetric.NewManualReader()
+			meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+			counter, err := meter.Int64Counter("app_price_history_rows_written")
+			if err != nil {
+				t.Fatal(err)
+			}
+			setVar(t, &priceHistoryRowsWritten, counter)
+
+			var before PriceHistoryCoverage
+			if tt.coverage != nil {
+				before = *tt.coverage
+				before.Type, before.Symbol = "STOCK", "IBM"
+				if err := DB.Create(&before).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			written, err := ensureHistory(context.Background(), "STOCK", "IBM", tt.from, tt.to, historyTriggerRequest)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.want == nil {
+				if len(provider.queries) != 0 || written != 0 {
+					t.Fatalf("fetched %v and wrote %d rows, want nothing", provider.queries, written)
+				}
+				return
+			}
+			if len(provider.queries) != 1 {
+				t.Fatalf("got %d fetches, want 1", len(provider.queries))
+			}
+			if q := provider.queries[0]; !q.From.Equal(tt.want.start) || !q.To.Equal(tt.want.end) {
+				t.Errorf("fetched %s to %s, want %s to %s", q.From, q.To, tt.want.start, tt.want.end)
+			}
+			end := tt.want.end
+			if end.IsZero() {
+				end = time.Now().UTC()
+			}
+			if want := weekdaysBetween(tt.want.start, end); written != want {
+				t.Errorf("wrote %d rows, want %d", written, want)
+			}
+
+			var after PriceHistoryCoverage
+			if err := DB.Take(&after, "type = ? AND symbol = ?", "STOCK", "IBM").Error; err != nil {
+				t.Fatal(err)
+			}
+			if moved := !after.From.Equal(before.From); moved != tt.wantFrom {
+				t.Errorf("coverage start %s -> %s, want moved %v", before.From, after.From, tt.wantFrom)
+			}
+			if moved := !after.To.Equal(before.To); moved != tt.wantTo {
+				t.Errorf("coverage end %s -> %s, want moved %v", before.To, after.To, tt.wantTo)
+			}
+			if tt.wantFrom && !after.From.Equal(tt.from) {
+				t.Errorf("coverage start = %s, want %s", after.From, tt.from)
+			}
+
+			var data metricdata.ResourceMetrics
+			if err := reader.Collect(context.Background(), &data); err != nil {
+				t.Fatal(err)
+			}
+			sum := data.ScopeMetrics[0].Metrics[0].Data.(metricdata.Sum[int64])
+			point := sum.DataPoints[0]
+			if trigger, _ := point.Attributes.Value(attribute.Key("trigger")); point.Value != int64(written) || trigger.AsString() != historyTriggerRequest {
+				t.Errorf("rows written metric = %d with trigger %q, want %d with %q", point.Value, trigger.AsString(), written, historyTriggerRequest)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+type DeleteAccountRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	Confirm         string `json:"confirm"`
+}
+
+type WatchlistExport struct {
+	Symbol    string     `json:"symbol"`
+	Type      string     `json:"type"`
+	CryptoID  string     `json:"cryptoId,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+}
+
+type IdentityExport struct {
+	Provider    string    `json:"provider"`
+	Subject     string    `json:"subject"`
+	Email       string    `json:"email"`
+	LastLoginAt time.Time `json:"lastLoginAt"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// AccountExport is everything stored about a user. Each field becomes its
+// own file in the ZIP form of the export.
+type AccountExport struct {
+	ExportedAt  time.Time         `json:"exportedAt"`
+	User        User              `json:"user"`
+	Watchlist   []WatchlistExport `json:"watchlist"`
+	Identities  []IdentityExport  `json:"identities"`
+	APITokens   []APITokenView    `json:"apiTokens"`
+	Sessions    []SessionView     `json:"sessions"`
+	AuditEvents []AuditEvent      `json:"auditEvents"`
+}
+
+func buildAccountExport(ctx context.Context, user *User) (*AccountExport, error) {
+	export := &AccountExport{
+		ExportedAt:  time.Now().UTC(),
+		User:        *user,
+		Watchlist:   []WatchlistExport{},
+		Identities:  []IdentityExport{},
+		APITokens:   []APITokenView{},
+		AuditEvents: []AuditEvent{},
+	}
+	db := DB.WithContext(ctx)
+
+	// Unscoped so symbols removed from the watchlist, which gorm.Model only
+	// soft-deletes, are part of the export too.
+	var symbols []UserSymbols
+	if err := db.Unscoped().Where("user_id = ?", user.ID).Order("id").Find(&symbols).Error; err != nil {
+		return nil, fmt.Errorf("error exporting watchlist: %w", err)
+	}
+	for _, s := range symbols {
+		item := WatchlistExport{Symbol: s.Symbol, Type: s.Type, CryptoID: s.CryptoId, CreatedAt: s.CreatedAt}
+		if s.DeletedAt.Valid {
+			item.DeletedAt = &s.DeletedAt.Time
+		}
+		export.Watchlist = append(export.Watchlist, item)
+	}
+
+	var identities []UserIdentity
+	if err := db.Where("user_id = ?", user.ID).Find(&identities).Error; err != nil {
+		return nil, fmt.Errorf("error exporting identities: %w", err)
+	}
+	for _, i := range identities {
+		export.Identities = append(export.Identities, IdentityExport{
+			Provider: i.Provider, Subject: i.Subject, Email: i.Email, LastLoginAt: i.LastLoginAt, CreatedAt: i.CreatedAt,
+		})
+	}
+
+	var tokens []APIToken
+	if err := db.Where("user_id = ?", user.ID).Order("id").Find(&tokens).Error; err != nil {
+		return nil, fmt.Errorf("error exporting api tokens: %w", err)
+	}
+	for i := range tokens {
+		export.APITokens = append(export.APITokens, tokens[i].view())
+	}
+
+	sessions, err := listUserSessions(db, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error exporting sessions: %w", err)
+	}
+	export.Sessions = sessions
+
+	if err := db.Where("user_id = ?", user.ID).Order("id").Find(&export.AuditEvents).Error; err != nil {
+		return nil, fmt.Errorf("error exporting audit events: %w", err)
+	}
+	return export, nil
+}
+
+func writeExportZip(w http.ResponseWriter, export *AccountExport) error {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="stock-tracker-export-%d.zip"`, export.User.ID))
+
+	archive := zip.NewWriter(w)
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"user.json", export.User},
+		{"watchlist.json", export.Watchlist},
+		{"identities.json", export.Identities},
+		{"api_tokens.json", export.APITokens},
+		{"sessions.json", export.Sessions},
+		{"audit_events.json", export.AuditEvents},
+	}
+	for _, file := range files {
+		f, err := archive.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: export.ExportedAt})
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(file.data); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+func exportAccount(w http.ResponseWriter, r *http.Request) {
+	ctx, span, user, ok := startAccountSpan(w, r, "privacy.export", "/users/me/export", "account_export")
+	defer span.End()
+	if !ok {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "zip" {
+		span.SetStatus(codes.Error, "Unsupported format")
+		writeAuthError(w, http.StatusBadRequest, "format must be json or zip", "INVALID_FORMAT")
+		return
+	}
+	span.SetAttributes(attribute.String("export.format", format))
+
+	export, err := buildAccountExport(ctx, user)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Export failed")
+		Logger.ErrorContext(ctx, "Account export failed",
+			slog.Int("user_id", user.ID),
+			slog.String("error", err.Error()),
+		)
+		writeAuthError(w, http.StatusInternalServerError, "Export failed", "DB_ERROR")
+		return
+	}
+	span.SetAttributes(
+		attribute.Int("export.watchlist_items", len(export.Watchlist)),
+		attribute.Int("export.audit_events", len(export.AuditEvents)),
+	)
+
+	if err := recordAudit(ctx, DB.WithContext(ctx), r, user.ID, user.ID, auditAccountExported, map[string]interface{}{
+		"format": format,
+	}); err != nil {
+		Logger.WarnContext(ctx, "Failed to audit account export",
+			slog.Int("user_id", user.ID),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	if format == "zip" {
+		if err := writeExportZip(w, export); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Writing export failed")
+			return
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="stock-tracker-export-%d.json"`, user.ID))
+		json.NewEncoder(w).Encode(export)
+	}
+
+	span.SetStatus(codes.Ok, "Account exported")
+	Logger.InfoContext(ctx, "Account exported",
+		slog.Int("user_id", user.ID),
+		slog.String("format", format),
+	)
+}
+
+// hardDeleteUser removes the user and every row referencing it. Only an
+// account.deleted audit event holding the bare user id is kept, as a record
+// that the deletion was carried out. Events the user caused on other
+// accounts belong to those accounts' trails; they are kept with the actor
+// and its client details cleared.
+func hardDeleteUser(ctx context.Context, userID int) error {
+	return DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Each statement starts from tx; chaining them off one Unscoped()
+		// result would carry the table and conditions of the first over.
+		for _, model := range []interface{}{
+			&UserSymbols{}, &RefreshToken{}, &EmailVerificationToken{}, &PasswordResetToken{},
+			&RecoveryCode{}, &TwoFactorChallenge{}, &APIToken{}, &UserIdentity{}, &AuditEvent{},
+		} {
+			if err := tx.Unscoped().Where("user_id = ?", userID).Delete(model).Error; err != nil {
+				return fmt.Errorf("error deleting %T: %w", model, err)
+			}
+		}
+		if err := tx.Model(&AuditEvent{}).Where("actor_id = ?", userID).Updates(map[string]interface{}{
+			"actor_id":    0,
+			"remote_addr": "",
+			"user_agent":  "",
+		}).Error; err != nil {
+			return fmt.Errorf("error anonymising audit events: %w", err)
+		}
+		if err := tx.Unscoped().Delete(&User{}, "id = ?", userID).Error; err != nil {
+			return fmt.Errorf("error deleting user: %w", err)
+		}
+		return recordAudit(ctx, tx, nil, userID, userID, auditAccountDeleted, nil)
+	})
+}
+
+func deleteAccount(w http.ResponseWriter, r *http.Request) {
+	ctx, span, user, ok := startAccountSpan(w, r, "privacy.delete_account", "/users/me", "account_delete")
+	defer span.End()
+	if !ok {
+		return
+	}
+
+	var req DeleteAccountRequest
+	json.NewDecoder(r.Body).Decode(&req)
+
+	// Accounts created through OIDC may have no password; they confirm by
+	// typing their username instead.
+	if user.Password != "" {
+		if !checkCurrentPassword(ctx, w, r, span, user, req.CurrentPassword) {
+			return
+		}
+	} else if req.Confirm != user.Username {
+		span.SetStatus(codes.Error, "Deletion not confirmed")
+		writeAuthError(w, http.StatusBadRequest, "Set confirm to your username to delete the account", "CONFIRMATION_REQUIRED")
+		return
+	}
+
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	deleteCtx, deleteSpan := tracer.Start(ctx, "privacy.delete_account.delete_rows",
+		trace.WithAttributes(
+			attribute.String("operation", "hard_delete"),
+			attribute.Int("user_id", user.ID),
+		),
+	)
+	if err := hardDeleteUser(deleteCtx, user.ID); err != nil {
+		deleteSpan.RecordError(err)
+		deleteSpan.SetStatus(codes.Error, "Deletion failed")
+		deleteSpan.End()
+		span.SetStatus(codes.Error, "Deletion failed")
+		Logger.ErrorContext(ctx, "Account deletion failed",
+			slog.Int("user_id", user.ID),
+			slog.String("error", err.Error()),
+		)
+		writeAuthError(w, http.StatusInternalServerError, "Account deletion failed", "DB_ERROR")
+		return
+	}
+	deleteSpan.SetStatus(codes.Ok, "Rows deleted")
+	deleteSpan.End()
+
+	// Rewriting rotated logs can take a while, so it runs after responding.
+	go func(userID int, identifiers []string) {
+		redactCtx := trace.ContextWithSpan(context.WithoutCancel(ctx), span)
+		if err := redactUserLogs(redactCtx, userID, identifiers...); err != nil {
+			Logger.ErrorContext(redactCtx, "Log redaction after account deletion failed",
+				slog.Int("user_id", userID),
+				slog.String("error", err.Error()),
+			)
+		}
+	}(user.ID, []string{user.Email, user.PendingEmail, user.Username})
+
+	span.SetStatus(codes.Ok, "Account deleted")
+	Logger.InfoContext(ctx, "Account deleted",
+		slog.Int("user_id", user.ID),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AuthResponse{
+		Success: true,
+		Message: "Account deleted",
+	})
+}
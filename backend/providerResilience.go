@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sony/gobreaker/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Provider calls are attempted up to MARKET_DATA_MAX_ATTEMPTS times when they
+// fail with a network error, a 5xx or a 429. Retries back off exponentially
+// from MARKET_DATA_RETRY_BASE_DELAY with full jitter, wait at least as long
+// as a Retry-After header asks, and give up when the wait would pass
+// MARKET_DATA_RETRY_MAX_DELAY or the caller's deadline.
+//
+// Each provider has a circuit breaker. It opens after
+// PROVIDER_BREAKER_FAILURES consecutive failed attempts, rejects calls for
+// PROVIDER_BREAKER_OPEN_TIMEOUT, then lets PROVIDER_BREAKER_PROBES calls
+// through to decide whether to close again.
+var (
+	marketDataMaxAttempts      = getEnvInt("MARKET_DATA_MAX_ATTEMPTS", 3)
+	marketDataRetryBaseDelay   = getEnvDuration("MARKET_DATA_RETRY_BASE_DELAY", 500*time.Millisecond)
+	marketDataRetryMaxDelay    = getEnvDuration("MARKET_DATA_RETRY_MAX_DELAY", 10*time.Second)
+	providerBreakerFailures    = getEnvInt("PROVIDER_BREAKER_FAILURES", 5)
+	providerBreakerOpenTimeout = getEnvDuration("PROVIDER_BREAKER_OPEN_TIMEOUT", 30*time.Second)
+	providerBreakerProbes      = getEnvInt("PROVIDER_BREAKER_PROBES", 1)
+)
+
+// errProviderUnavailable is returned while a provider's breaker rejects
+// calls.
+var errProviderUnavailable = errors.New("provider unavailable")
+
+var (
+	providerBreakersMu sync.Mutex
+	providerBreakers   = map[string]*gobreaker.CircuitBreaker[[]byte]{}
+)
+
+// breakerFor returns the breaker of a provider, creating it on first use.
+func breakerFor(api string) *gobreaker.CircuitBreaker[[]byte] {
+	providerBreakersMu.Lock()
+	defer providerBreakersMu.Unlock()
+
+	if breaker, ok := providerBreakers[api]; ok {
+		return breaker
+	}
+	breaker := gobreaker.NewCircuitBreaker[[]byte](gobreaker.Settings{
+		Name:        api,
+		MaxRequests: uint32(max(providerBreakerProbes, 1)),
+		Timeout:     providerBreakerOpenTimeout,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= uint32(max(providerBreakerFailures, 1))
+		},
+		IsSuccessful: func(err error) bool {
+			return err == nil || !isProviderFailure(err)
+		},
+		IsExcluded: func(err error) bool {
+			return errors.Is(err, context.Canceled)
+		},
+		OnStateChange: func(name string, from, to gobreaker.State) {
+			Logger.Warn("Provider circuit breaker changed state", "provider", name, "from", from.String(), "to", to.String())
+		},
+	})
+	providerBreakers[api] = breaker
+	return breaker
+}
+
+// isProviderFailure reports whether an attempt's error says the provider is
+// unhealthy. Client errors, including 429, say nothing about its health.
+func isProviderFailure(err error) bool {
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		return providerErr.StatusCode >= http.StatusInternalServerError
+	}
+	var rateLimitErr *RateLimitError
+	return !errors.As(err, &rateLimitErr)
+}
+
+// isRetryable reports whether another attempt could succeed. Provider calls
+// are all GETs, so repeating them is safe.
+func isRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		return providerErr.StatusCode >= http.StatusInternalServerError || providerErr.StatusCode == http.StatusTooManyRequests
+	}
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		return false
+	}
+	return !errors.Is(err, gobreaker.ErrOpenState) && !errors.Is(err, gobreaker.ErrTooManyRequests)
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP
+// date. It returns zero when the header is missing or unreadable.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(t.Sub(now), 0)
+	}
+	return 0
+}
+
+// retryDelay is the wait before the attempt after the given one: a random
+// duration up to the exponential ceiling, but no less than retryAfter.
+func retryDelay(attempt int, retryAfter time.Duration) time.Duration {
+	ceiling := marketDataRetryBaseDelay << min(attempt-1, 20)
+	if ceiling <= 0 || ceiling > marketDataRetryMaxDelay {
+		ceiling = marketDataRetryMaxDelay
+	}
+	delay := time.Duration(rand.Int64N(int64(ceiling) + 1))
+	return max(delay, retryAfter)
+}
+
+// observeBreakerStates reports each breaker as 0 closed, 1 half-open or
+// 2 open.
+func observeBreakerStates(_ context.Context, observer metric.Int64Observer) error {
+	providerBreakersMu.Lock()
+	defer providerBreakersMu.Unlock()
+	for name, breaker := range providerBreakers {
+		observer.Observe(int64(breaker.State()), metric.WithAttributes(attribute.String("provider", name)))
+	}
+	return nil
+}
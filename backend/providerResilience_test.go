@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sony/gobreaker/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans routes the global tracer to a recorder for the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+// newTestProviderCall points a call at a server answering with the given
+// responses in turn, repeating the last one. The call gets a breaker of its
+// own, built from the settings in force.
+func newTestProviderCall(t *testing.T, responses ...func(w http.ResponseWriter)) (*providerCall, *httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(hits.Add(1))
+		responses[min(n, len(responses))-1](w)
+	}))
+	t.Cleanup(server.Close)
+
+	api := "test_" + strings.ReplaceAll(t.Name(), "/", "_")
+	t.Cleanup(func() {
+		providerBreakersMu.Lock()
+		delete(providerBreakers, api)
+		providerBreakersMu.Unlock()
+	})
+	return &providerCall{api: api, operation: "TEST", spanName: "test.fetch", url: server.URL}, server, &hits
+}
+
+func respond(status int, retryAfter string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(`{"ok":true}`))
+	}
+}
+
+// spanEvents returns the attributes of the named events on the only span.
+func spanEvents(t *testing.T, recorder *tracetest.SpanRecorder, name string) []map[attribute.Key]attribute.Value {
+	t.Helper()
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	var events []map[attribute.Key]attribute.Value
+	for _, e := range spans[0].Events() {
+		if e.Name != name {
+			continue
+		}
+		attrs := map[attribute.Key]attribute.Value{}
+		for _, kv := range e.Attributes {
+			attrs[kv.Key] = kv.Value
+		}
+		events = append(events, attrs)
+	}
+	return events
+}
+
+func TestRetryDelay(t *testing.T) {
+	setVar(t, &marketDataRetryBaseDelay, 100*time.Millisecond)
+	setVar(t, &marketDataRetryMaxDelay, time.Second)
+
+	for _, tt := range []struct {
+		attempt int
+		ceiling time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{100, time.Second},
+	} {
+		seen := map[time.Duration]bool{}
+		for i := 0; i < 200; i++ {
+			delay := retryDelay(tt.attempt, 0)
+			if delay < 0 || delay > tt.ceiling {
+				t.Fatalf("attempt %d: delay %s, want up to %s", tt.attempt, delay, tt.ceiling)
+			}
+			seen[delay] = true
+		}
+		if len(seen) < 10 {
+			t.Errorf("attempt %d: %d distinct delays in 200 tries, want jitter", tt.attempt, len(seen))
+		}
+	}
+
+	// Retry-After is a floor, even above the ceiling.
+	for i := 0; i < 50; i++ {
+		if delay := retryDelay(1, 3*time.Second); delay != 3*time.Second {
+			t.Fatalf("delay %s with Retry-After 3s, want 3s", delay)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"5", 5 * time.Second},
+		{"120", 2 * time.Minute},
+		{"0", 0},
+		{"-3", 0},
+		{"soon", 0},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestProviderErrorClassification(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		err       error
+		retryable bool
+		failure   bool
+	}{
+		{"503", context.Background(), &ProviderError{StatusCode: 503}, true, true},
+		{"500", context.Background(), &ProviderError{StatusCode: 500}, true, true},
+		{"429", context.Background(), &ProviderError{StatusCode: 429}, true, false},
+		{"404", context.Background(), &ProviderError{StatusCode: 404}, false, false},
+		{"400", context.Background(), &ProviderError{StatusCode: 400}, false, false},
+		{"quota", context.Background(), &RateLimitError{Provider: "alphavantage"}, false, false},
+		{"network", context.Background(), errors.New("connection reset"), true, true},
+		{"breaker open", context.Background(), gobreaker.ErrOpenState, false, true},
+		{"canceled", canceled, &ProviderError{StatusCode: 503}, false, true},
+	}
+	for _, tt := range tests {
+		if got := isRetryable(tt.ctx, tt.err); got != tt.retryable {
+			t.Errorf("%s: isRetryable = %v, want %v", tt.name, got, tt.retryable)
+		}
+		if got := isProviderFailure(tt.err); got != tt.failure {
+			t.Errorf("%s: isProviderFailure = %v, want %v", tt.name, got, tt.failure)
+		}
+	}
+}
+
+func TestProviderCallRetriesServerErrors(t *testing.T) {
+	recorder := recordSpans(t)
+	setVar(t, &marketDataMaxAttempts, 3)
+	setVar(t, &marketDataRetryBaseDelay, time.Millisecond)
+	call, server, hits := newTestProviderCall(t, respond(503, ""), respond(503, ""), respond(200, ""))
+
+	body, err := call.fetch(context.Background(), server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != `{"ok":true}` || hits.Load() != 3 {
+		t.Errorf("got %q after %d requests, want the body after 3", body, hits.Load())
+	}
+
+	attempts := spanEvents(t, recorder, "http.attempt")
+	if len(attempts) != 3 {
+		t.Fatalf("got %d http.attempt events, want 3", len(attempts))
+	}
+	for i, want := range []int64{503, 503, 200} {
+		if got := attempts[i]["http.status_code"].AsInt64(); got != want || attempts[i]["http.attempt"].AsInt64() != int64(i+1) {
+			t.Errorf("event %d: attempt %d status %d, want attempt %d status %d", i, attempts[i]["http.attempt"].AsInt64(), got, i+1, want)
+		}
+	}
+	if retries := spanEvents(t, recorder, "http.retry_scheduled"); len(retries) != 2 {
+		t.Errorf("got %d http.retry_scheduled events, want 2", len(retries))
+	}
+}
+
+func TestProviderCallWaitsForRetryAfter(t *testing.T) {
+	recorder := recordSpans(t)
+	setVar(t, &marketDataMaxAttempts, 3)
+	setVar(t, &marketDataRetryBaseDelay, time.Millisecond)
+	setVar(t, &marketDataRetryMaxDelay, 5*time.Second)
+	call, server, _ := newTestProviderCall(t, respond(429, "1"), respond(200, ""))
+
+	start := time.Now()
+	if _, err := call.fetch(context.Background(), server.Client()); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < time.Second {
+		t.Errorf("retried after %s, want at least the 1s Retry-After", waited)
+	}
+	retries := spanEvents(t, recorder, "http.retry_scheduled")
+	if len(retries) != 1 || retries[0]["retry.delay_sec"].AsFloat64() < 1 {
+		t.Errorf("retry events = %v, want one delayed by at least 1s", retries)
+	}
+}
+
+func TestProviderCallGivesUp(t *testing.T) {
+	setVar(t, &marketDataMaxAttempts, 3)
+	setVar(t, &marketDataRetryBaseDelay, time.Millisecond)
+	setVar(t, &marketDataRetryMaxDelay, 100*time.Millisecond)
+
+	tests := []struct {
+		name     string
+		response func(w http.ResponseWriter)
+		attempts int32
+		status   int
+	}{
+		{"client error", respond(404, ""), 1, 404},
+		{"Retry-After past the max delay", respond(503, "60"), 1, 503},
+		{"attempts exhausted", respond(502, ""), 3, 502},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := recordSpans(t)
+			call, server, hits := newTestProviderCall(t, tt.response)
+
+			_, err := call.fetch(context.Background(), server.Client())
+			var providerErr *ProviderError
+			if !errors.As(err, &providerErr) || providerErr.StatusCode != tt.status {
+				t.Fatalf("err = %v, want a %d ProviderError", err, tt.status)
+			}
+			if hits.Load() != tt.attempts {
+				t.Errorf("server hit %d times, want %d", hits.Load(), tt.attempts)
+			}
+			if events := spanEvents(t, recorder, "http.attempt"); len(events) != int(tt.attempts) {
+				t.Errorf("got %d http.attempt events, want %d", len(events), tt.attempts)
+			}
+		})
+	}
+}
+
+func TestProviderBreaker(t *testing.T) {
+	setVar(t, &marketDataMaxAttempts, 1)
+	setVar(t, &providerBreakerFailures, 2)
+	setVar(t, &providerBreakerOpenTimeout, 50*time.Millisecond)
+	setVar(t, &providerBreakerProbes, 1)
+
+	var status atomic.Int32
+	call, server, hits := newTestProviderCall(t, func(w http.ResponseWriter) {
+		respond(int(status.Load()), "")(w)
+	})
+	fetch := func() error {
+		_, err := call.fetch(context.Background(), server.Client())
+		return err
+	}
+	breaker := breakerFor(call.api)
+
+	// Rate limiting says nothing about the provider's health.
+	status.Store(429)
+	for i := 0; i < 3; i++ {
+		fetch()
+	}
+	if state := breaker.State(); state != gobreaker.StateClosed {
+		t.Fatalf("breaker %s after 429s, want closed", state)
+	}
+
+	status.Store(503)
+	fetch()
+	fetch()
+	if state := breaker.State(); state != gobreaker.StateOpen {
+		t.Fatalf("breaker %s after 2 failures, want open", state)
+	}
+	before := hits.Load()
+	recorder := recordSpans(t)
+	if err := fetch(); !errors.Is(err, errProviderUnavailable) {
+		t.Fatalf("err = %v while open, want errProviderUnavailable", err)
+	}
+	if hits.Load() != before {
+		t.Error("open breaker let a request through")
+	}
+	if events := spanEvents(t, recorder, "circuit_breaker.rejected"); len(events) != 1 {
+		t.Errorf("got %d circuit_breaker.rejected events, want 1", len(events))
+	}
+
+	// After the timeout one probe goes through; a failed probe opens the
+	// breaker again and a good one closes it.
+	time.Sleep(60 * time.Millisecond)
+	if state := breaker.State(); state != gobreaker.StateHalfOpen {
+		t.Fatalf("breaker %s after the open timeout, want half-open", state)
+	}
+	if err := fetch(); errors.Is(err, errProviderUnavailable) {
+		t.Fatal("half-open breaker rejected the probe")
+	}
+	if state := breaker.State(); state != gobreaker.StateOpen {
+		t.Fatalf("breaker %s after a failed probe, want open", state)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	status.Store(200)
+	if err := fetch(); err != nil {
+		t.Fatalf("probe failed: %v", err)
+	}
+	if state := breaker.State(); state != gobreaker.StateClosed {
+		t.Errorf("breaker %s after a good probe, want closed", state)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Candle is one OHLCV bar. Currency and source travel with every bar so
+// candles from different providers can be stored and merged side by side.
+type Candle struct {
+	Timestamp time.Time `json:"timestamp"`
+	Open      float64   `json:"open"`
+	High      float64   `json:"high"`
+	Low       float64   `json:"low"`
+	Close     float64   `json:"close"`
+	Volume    float64   `json:"volume"`
+	Currency  string    `json:"currency"`
+	Source    string    `json:"source"`
+}
+
+// Quote is the normalized response of /stocks/{symbol} and /crypto/{symbol}.
+// Candles are ordered oldest first. Raw keeps the provider payload for
+// clients that ask for ?format=raw.
+type Quote struct {
+	Symbol   string   `json:"symbol"`
+	Type     string   `json:"type"`
+	Interval string   `json:"interval"`
+	Currency string   `json:"currency"`
+	Source   string   `json:"source"`
+	Candles  []Candle `json:"candles"`
+
+	Raw []byte `json:"-"`
+}
+
+// Response formats of the price endpoints.
+const (
+	quoteFormatNormalized = "normalized"
+	quoteFormatRaw        = "raw"
+)
+
+// errUnknownSymbol is returned when a provider does not know the requested
+// symbol or coin id.
+var errUnknownSymbol = errors.New("unknown symbol")
+
+// PayloadError is returned when a provider answers OK with a body that cannot
+// be read as price data.
+type PayloadError struct {
+	Provider  string
+	Operation string
+	Reason    string
+}
+
+func (e *PayloadError) Error() string {
+	return fmt.Sprintf("%s %s returned an unusable payload: %s", e.Provider, e.Operation, e.Reason)
+}
+
+// Series intervals accepted by the price endpoints, with the length of one
+// bar. Months are taken as 30 days where only an estimate is needed.
+var seriesIntervals = map[string]time.Duration{
+	"1min":    time.Minute,
+	"5min":    5 * time.Minute,
+	"15min":   15 * time.Minute,
+	"30min":   30 * time.Minute,
+	"60min":   time.Hour,
+	"daily":   24 * time.Hour,
+	"weekly":  7 * 24 * time.Hour,
+	"monthly": 30 * 24 * time.Hour,
+}
+
+var seriesIntervalNames = []string{"1min", "5min", "15min", "30min", "60min", "daily", "weekly", "monthly"}
+
+// isIntraday reports whether bars of the interval are shorter than a day.
+func isIntraday(interval string) bool {
+	return seriesIntervals[interval] < 24*time.Hour
+}
+
+// SeriesQuery selects the bars of a price series. From and To are zero when
+// the client did not bound the range.
+type SeriesQuery struct {
+	Interval string
+	From     time.Time
+	To       time.Time
+}
+
+// Bounded reports whether the client asked for a range.
+func (q SeriesQuery) Bounded() bool {
+	return !q.From.IsZero() || !q.To.IsZero()
+}
+
+// Start is From floored to the start of the bar containing it. Bars are
+// stamped with their start, so a bar that opens before From but runs past it
+// is still in range.
+func (q SeriesQuery) Start() time.Time {
+	if q.From.IsZero() {
+		return q.From
+	}
+	return bucketStart(q.From, q.Interval)
+}
+
+// Contains reports whether the bar stamped t overlaps the requested range.
+func (q SeriesQuery) Contains(t time.Time) bool {
+	return (q.From.IsZero() || !t.Before(q.Start())) && (q.To.IsZero() || !t.After(q.To))
+}
+
+// errUnsupportedQuery is returned when a provider cannot serve the requested
+// interval and range combination.
+var errUnsupportedQuery = errors.New("unsupported series query")
+
+// quoteRequest holds the query parameters of a price endpoint.
+type quoteRequest struct {
+	Format string
+	Series SeriesQuery
+}
+
+// parseQueryTime reads an RFC 3339 timestamp or a YYYY-MM-DD date. A date
+// used as the end of a range covers that whole day.
+func parseQueryTime(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return t, nil
+}
+
+// readQueryRange reads the from and to parameters into series. Values that
+// do not parse and a from after to are added to v.
+func readQueryRange(v *Validator, query url.Values, series *SeriesQuery) {
+	for _, bound := range []struct {
+		field string
+		dest  *time.Time
+	}{{"from", &series.From}, {"to", &series.To}} {
+		value := query.Get(bound.field)
+		if value == "" {
+			continue
+		}
+		t, err := parseQueryTime(value, bound.field == "to")
+		if err != nil {
+			v.Add(bound.field, "INVALID_TIME", bound.field+" must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+			continue
+		}
+		*bound.dest = t
+	}
+	if !series.From.IsZero() && !series.To.IsZero() && series.From.After(series.To) {
+		v.Add("from", "INVALID_RANGE", "from must not be after to")
+	}
+}
+
+// readQuoteRequest reads format, interval, from and to. An empty interval
+// is left empty for the handler to default. On invalid values it writes the
+// validation error and returns false.
+func readQuoteRequest(w http.ResponseWriter, r *http.Request, span trace.Span) (quoteRequest, bool) {
+	query := r.URL.Query()
+	req := quoteRequest{
+		Format: query.Get("format"),
+		Series: SeriesQuery{Interval: query.Get("interval")},
+	}
+	if req.Format == "" {
+		req.Format = quoteFormatNormalized
+	}
+
+	var v Validator
+	v.OneOf("format", req.Format, []string{quoteFormatNormalized, quoteFormatRaw})
+	if req.Series.Interval != "" {
+		v.OneOf("interval", req.Series.Interval, seriesIntervalNames)
+	}
+	readQueryRange(&v, query, &req.Series)
+	if !v.Valid() {
+		recordValidationFailure(span, v.Errors)
+		writeValidationError(w, v.Errors)
+		return quoteRequest{}, false
+	}
+
+	span.SetAttributes(attribute.String("response.format", req.Format))
+	return req, true
+}
+
+// trim drops the candles outside the requested range. The raw payload is
+// left as the provider sent it.
+func (q *Quote) trim(series SeriesQuery) {
+	kept := q.Candles[:0]
+	for _, c := range q.Candles {
+		if series.Contains(c.Timestamp) {
+			kept = append(kept, c)
+		}
+	}
+	q.Candles = kept
+}
+
+// writeQuote writes the quote in the requested format.
+func writeQuote(w http.ResponseWriter, quote *Quote, format string) error {
+	w.Header().Set("Content-Type", "application/json")
+	if format == quoteFormatRaw {
+		_, err := w.Write(quote.Raw)
+		return err
+	}
+	return json.NewEncoder(w).Encode(quote)
+}
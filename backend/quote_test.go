@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSeriesQueryKeepsBarsOverlappingTheStart(t *testing.T) {
+	day := func(d, h int) time.Time { return time.Date(2024, 3, d, h, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		interval string
+		from     time.Time
+		bars     []time.Time
+		want     int
+	}{
+		// The bar of March 5 opens at midnight and covers from.
+		{"daily", day(5, 15), []time.Time{day(4, 0), day(5, 0), day(6, 0)}, 2},
+		{"daily", day(5, 0), []time.Time{day(4, 0), day(5, 0), day(6, 0)}, 2},
+		{"60min", day(5, 15).Add(30 * time.Minute), []time.Time{day(5, 14), day(5, 15), day(5, 16)}, 2},
+		// March 6, 2024 is a Wednesday; its week opens on Monday March 4.
+		{"weekly", day(6, 9), []time.Time{time.Date(2024, 2, 26, 0, 0, 0, 0, time.UTC), day(4, 0), day(11, 0)}, 2},
+		{"monthly", day(20, 0), []time.Time{time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), day(1, 0)}, 1},
+	}
+	for _, tt := range tests {
+		quote := &Quote{}
+		for _, ts := range tt.bars {
+			quote.Candles = append(quote.Candles, Candle{Timestamp: ts})
+		}
+		quote.trim(SeriesQuery{Interval: tt.interval, From: tt.from})
+
+		if len(quote.Candles) != tt.want {
+			t.Errorf("%s from %s: kept %d bars, want %d", tt.interval, tt.from, len(quote.Candles), tt.want)
+			continue
+		}
+		if first := quote.Candles[0].Timestamp; first.After(tt.from) {
+			t.Errorf("%s from %s: first bar %s starts after from, want the bar covering it", tt.interval, tt.from, first)
+		}
+	}
+}
+
+func TestSeriesQueryTo(t *testing.T) {
+	query := SeriesQuery{Interval: "daily", To: time.Date(2024, 3, 5, 23, 59, 59, 0, time.UTC)}
+	if !query.Contains(time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)) {
+		t.Error("bar of the last day is out of range")
+	}
+	if query.Contains(time.Date(2024, 3, 6, 0, 0, 0, 0, time.UTC)) {
+		t.Error("bar after to is in range")
+	}
+}
+
+func TestReadQueryRange(t *testing.T) {
+	tests := []struct {
+		query    string
+		from, to time.Time
+		errors   []string
+	}{
+		{query: ""},
+		{
+			query: "from=2024-03-04&to=2024-03-05",
+			from:  time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC),
+			to:    time.Date(2024, 3, 6, 0, 0, 0, 0, time.UTC).Add(-time.Nanosecond),
+		},
+		{
+			query: "from=2024-03-04T09:30:00-05:00",
+			from:  time.Date(2024, 3, 4, 14, 30, 0, 0, time.UTC),
+		},
+		{query: "from=yesterday&to=2024-13-01", errors: []string{"from:INVALID_TIME", "to:INVALID_TIME"}},
+		{query: "from=2024-03-05&to=2024-03-04", errors: []string{"from:INVALID_RANGE"}},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		var v Validator
+		var series SeriesQuery
+		readQueryRange(&v, query, &series)
+
+		var got []string
+		for _, e := range v.Errors {
+			got = append(got, e.Field+":"+e.Code)
+		}
+		if len(got) != len(tt.errors) {
+			t.Errorf("%q: errors %v, want %v", tt.query, got, tt.errors)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.errors[i] {
+				t.Errorf("%q: errors %v, want %v", tt.query, got, tt.errors)
+				break
+			}
+		}
+		if len(tt.errors) == 0 && (!series.From.Equal(tt.from) || !series.To.Equal(tt.to)) {
+			t.Errorf("%q: range %s to %s, want %s to %s", tt.query, series.From, series.To, tt.from, tt.to)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Redaction actions. Hashing keeps values correlatable across spans and logs
+// without exposing them; masking replaces them outright; drop removes the
+// attribute.
+const (
+	redactActionHash = "hash"
+	redactActionMask = "mask"
+	redactActionDrop = "drop"
+)
+
+// RedactionRule matches attributes by exact key, by key pattern, or by a
+// pattern found inside string values. A value pattern with the mask action
+// only replaces the matching part of the value.
+type RedactionRule struct {
+	Keys         []string `json:"keys"`
+	KeyPattern   string   `json:"keyPattern"`
+	ValuePattern string   `json:"valuePattern"`
+	Action       string   `json:"action"`
+}
+
+// RedactionConfig is read from REDACTION_RULES_FILE when set. QueryParams
+// lists URL query parameters whose values are scrubbed from every string.
+type RedactionConfig struct {
+	Rules       []RedactionRule `json:"rules"`
+	QueryParams []string        `json:"queryParams"`
+}
+
+var defaultRedactionConfig = RedactionConfig{
+	Rules: []RedactionRule{
+		{Keys: []string{"email", "username", "remote_addr", "client_ip", "new_email", "previous_email"}, Action: redactActionHash},
+		{KeyPattern: `(?i)(^|[._])(password|secret|authorization|cookie|refresh_token|access_token)$`, Action: redactActionDrop},
+		{ValuePattern: `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`, Action: redactActionMask},
+	},
+	QueryParams: []string{"apikey", "api_key", "token", "access_token", "code", "state"},
+}
+
+type compiledRedactionRule struct {
+	keys         map[string]bool
+	keyPattern   *regexp.Regexp
+	valuePattern *regexp.Regexp
+	action       string
+}
+
+type Redactor struct {
+	rules      []compiledRedactionRule
+	queryParam *regexp.Regexp
+	hashKey    []byte
+}
+
+var piiRedactor *Redactor
+
+// loadRedactor builds the redactor from REDACTION_RULES_FILE, falling back to
+// the defaults. REDACTION_HASH_KEY should be set in production so hashed
+// values stay comparable across restarts and replicas.
+func loadRedactor() (*Redactor, error) {
+	config := defaultRedactionConfig
+	if path := getEnv("REDACTION_RULES_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading redaction rules: %w", err)
+		}
+		config = RedactionConfig{}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("error parsing redaction rules: %w", err)
+		}
+	}
+
+	hashKey := []byte(getEnv("REDACTION_HASH_KEY", ""))
+	if len(hashKey) == 0 {
+		log.Printf("REDACTION_HASH_KEY is not set; hashed attributes will differ between processes")
+		hashKey = make([]byte, 32)
+		if _, err := rand.Read(hashKey); err != nil {
+			return nil, fmt.Errorf("error generating redaction hash key: %w", err)
+		}
+	}
+	return newRedactor(config, hashKey)
+}
+
+func newRedactor(config RedactionConfig, hashKey []byte) (*Redactor, error) {
+	r := &Redactor{hashKey: hashKey}
+	for i, rule := range config.Rules {
+		switch rule.Action {
+		case redactActionHash, redactActionMask, redactActionDrop:
+		default:
+			return nil, fmt.Errorf("redaction rule %d: unknown action %q", i, rule.Action)
+		}
+
+		compiled := compiledRedactionRule{action: rule.Action, keys: map[string]bool{}}
+		for _, key := range rule.Keys {
+			compiled.keys[key] = true
+		}
+		var err error
+		if rule.KeyPattern != "" {
+			if compiled.keyPattern, err = regexp.Compile(rule.KeyPattern); err != nil {
+				return nil, fmt.Errorf("redaction rule %d: invalid keyPattern: %w", i, err)
+			}
+		}
+		if rule.ValuePattern != "" {
+			if compiled.valuePattern, err = regexp.Compile(rule.ValuePattern); err != nil {
+				return nil, fmt.Errorf("redaction rule %d: invalid valuePattern: %w", i, err)
+			}
+		}
+		r.rules = append(r.rules, compiled)
+	}
+
+	if len(config.QueryParams) > 0 {
+		names := make([]string, len(config.QueryParams))
+		for i, name := range config.QueryParams {
+			names[i] = regexp.QuoteMeta(name)
+		}
+		r.queryParam = regexp.MustCompile(`(?i)([?&](?:` + strings.Join(names, "|") + `)=)[^&#\s"]*`)
+	}
+	return r, nil
+}
+
+func (r *Redactor) hash(value string) string {
+	mac := hmac.New(sha256.New, r.hashKey)
+	mac.Write([]byte(value))
+	return "sha256:" + hex.EncodeToString(mac.Sum(nil)[:12])
+}
+
+// keyAction returns the action of the first key rule matching key.
+func (r *Redactor) keyAction(key string) (string, bool) {
+	for _, rule := range r.rules {
+		if rule.keys[key] || (rule.keyPattern != nil && rule.keyPattern.MatchString(key)) {
+			return rule.action, true
+		}
+	}
+	return "", false
+}
+
+// scrubString applies the query parameter and value pattern rules to value.
+func (r *Redactor) scrubString(value string) string {
+	if r.queryParam != nil {
+		value = r.queryParam.ReplaceAllString(value, "${1}"+redactedPlaceholder)
+	}
+	for _, rule := range r.rules {
+		if rule.valuePattern == nil {
+			continue
+		}
+		switch rule.action {
+		case redactActionMask:
+			value = rule.valuePattern.ReplaceAllString(value, redactedPlaceholder)
+		case redactActionHash:
+			value = rule.valuePattern.ReplaceAllStringFunc(value, r.hash)
+		case redactActionDrop:
+			if rule.valuePattern.MatchString(value) {
+				return redactedPlaceholder
+			}
+		}
+	}
+	return value
+}
+
+// RedactString redacts a value stored under key, reporting false when the
+// value should be dropped altogether.
+func (r *Redactor) RedactString(key, value string) (string, bool) {
+	if action, ok := r.keyAction(key); ok {
+		switch action {
+		case redactActionDrop:
+			return "", false
+		case redactActionMask:
+			return redactedPlaceholder, true
+		case redactActionHash:
+			return r.hash(value), true
+		}
+	}
+	return r.scrubString(value), true
+}
+
+// RedactAttributes returns attrs with every rule applied. The input slice is
+// not modified.
+func (r *Redactor) RedactAttributes(attrs []attribute.KeyValue) []attribute.KeyValue {
+	if r == nil || len(attrs) == 0 {
+		return attrs
+	}
+	out := make([]attribute.KeyValue, 0, len(attrs))
+	for _, kv := range attrs {
+		key := string(kv.Key)
+		switch kv.Value.Type() {
+		case attribute.STRING:
+			if value, keep := r.RedactString(key, kv.Value.AsString()); keep {
+				out = append(out, attribute.String(key, value))
+			}
+		case attribute.STRINGSLICE:
+			values := kv.Value.AsStringSlice()
+			redacted := make([]string, 0, len(values))
+			keep := true
+			for _, v := range values {
+				var value string
+				if value, keep = r.RedactString(key, v); !keep {
+					break
+				}
+				redacted = append(redacted, value)
+			}
+			if keep {
+				out = append(out, attribute.StringSlice(key, redacted))
+			}
+		default:
+			action, ok := r.keyAction(key)
+			switch {
+			case !ok:
+				out = append(out, kv)
+			case action == redactActionHash:
+				out = append(out, attribute.String(key, r.hash(kv.Value.Emit())))
+			case action == redactActionMask:
+				out = append(out, attribute.String(key, redactedPlaceholder))
+			}
+		}
+	}
+	return out
+}
+
+// MetricView drops attributes matched by key rules from every metric stream.
+// Metric attributes cannot be rewritten per data point, and sensitive values
+// make poor dimensions anyway.
+func (r *Redactor) MetricView() sdkmetric.View {
+	return sdkmetric.NewView(
+		sdkmetric.Instrument{Name: "*"},
+		sdkmetric.Stream{AttributeFilter: func(kv attribute.KeyValue) bool {
+			_, sensitive := r.keyAction(string(kv.Key))
+			return !sensitive
+		}},
+	)
+}
+
+// RedactingSpanProcessor applies the redactor to spans before handing them to
+// the next processor, so nothing unredacted reaches an exporter.
+type RedactingSpanProcessor struct {
+	next     sdktrace.SpanProcessor
+	redactor *Redactor
+}
+
+func NewRedactingSpanProcessor(next sdktrace.SpanProcessor, redactor *Redactor) *RedactingSpanProcessor {
+	return &RedactingSpanProcessor{next: next, redactor: redactor}
+}
+
+func (p *RedactingSpanProcessor) OnStart(parent context.Context, s sdktrace.ReadWriteSpan) {
+	p.next.OnStart(parent, s)
+}
+
+func (p *RedactingSpanProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	p.next.OnEnd(&redactedSpan{ReadOnlySpan: s, redactor: p.redactor})
+}
+
+func (p *RedactingSpanProcessor) Shutdown(ctx context.Context) error {
+	return p.next.Shutdown(ctx)
+}
+
+func (p *RedactingSpanProcessor) ForceFlush(ctx context.Context) error {
+	return p.next.ForceFlush(ctx)
+}
+
+// redactedSpan presents a finished span with its attributes, events and
+// status description redacted.
+type redactedSpan struct {
+	sdktrace.ReadOnlySpan
+	redactor *Redactor
+}
+
+func (s *redactedSpan) Attributes() []attribute.KeyValue {
+	return s.redactor.RedactAttributes(s.ReadOnlySpan.Attributes())
+}
+
+func (s *redactedSpan) Events() []sdktrace.Event {
+	events := s.ReadOnlySpan.Events()
+	out := make([]sdktrace.Event, len(events))
+	for i, event := range events {
+		event.Attributes = s.redactor.RedactAttributes(event.Attributes)
+		out[i] = event
+	}
+	return out
+}
+
+func (s *redactedSpan) Status() sdktrace.Status {
+	status := s.ReadOnlySpan.Status()
+	status.Description = s.redactor.scrubString(status.Description)
+	return status
+}
+
+// RedactSlogAttr applies the rules to a log attribute, recursing into groups.
+// A zero Attr is returned for dropped attributes, which slog handlers skip.
+func (r *Redactor) RedactSlogAttr(a slog.Attr) slog.Attr {
+	if r == nil {
+		return a
+	}
+	a.Value = a.Value.Resolve()
+	switch a.Value.Kind() {
+	case slog.KindGroup:
+		group := a.Value.Group()
+		redacted := make([]slog.Attr, 0, len(group))
+		for _, ga := range group {
+			if ga = r.RedactSlogAttr(ga); !ga.Equal(slog.Attr{}) {
+				redacted = append(redacted, ga)
+			}
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	case slog.KindString:
+		value, keep := r.RedactString(a.Key, a.Value.String())
+		if !keep {
+			return slog.Attr{}
+		}
+		return slog.String(a.Key, value)
+	default:
+		action, ok := r.keyAction(a.Key)
+		switch {
+		case !ok:
+			return a
+		case action == redactActionHash:
+			return slog.String(a.Key, r.hash(a.Value.String()))
+		case action == redactActionMask:
+			return slog.String(a.Key, redactedPlaceholder)
+		}
+		return slog.Attr{}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func testRedactor(t *testing.T) *Redactor {
+	t.Helper()
+	r, err := newRedactor(defaultRedactionConfig, []byte("test-hash-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func attributeMap(attrs []attribute.KeyValue) map[string]attribute.Value {
+	m := make(map[string]attribute.Value, len(attrs))
+	for _, kv := range attrs {
+		m[string(kv.Key)] = kv.Value
+	}
+	return m
+}
+
+// exportRedactedSpan records one span through the redacting processor into
+// an in-memory exporter and returns what the exporter received.
+func exportRedactedSpan(t *testing.T, r *Redactor, record func(trace.Span)) tracetest.SpanStub {
+	t.Helper()
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(NewRedactingSpanProcessor(sdktrace.NewSimpleSpanProcessor(exporter), r)),
+	)
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+
+	_, span := provider.Tracer("test").Start(context.Background(), "test")
+	record(span)
+	span.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("exported %d spans, want 1", len(spans))
+	}
+	return spans[0]
+}
+
+func TestRedactingSpanProcessor(t *testing.T) {
+	r := testRedactor(t)
+
+	span := exportRedactedSpan(t, r, func(span trace.Span) {
+		span.SetAttributes(
+			attribute.String("email", "alice@example.com"),
+			attribute.String("remote_addr", "10.0.0.1:5555"),
+			attribute.String("password", "hunter2"),
+			attribute.String("http.request.authorization", "Bearer abc"),
+			attribute.String("http.url", "https://api.example.com/query?function=DAILY&apikey=SECRET123&symbol=IBM"),
+			attribute.String("note", "mail sent to bob@example.com today"),
+			attribute.StringSlice("recipients", []string{"carol@example.com", "nobody"}),
+			attribute.Int("user_id", 42),
+		)
+		span.AddEvent("login.failed", trace.WithAttributes(
+			attribute.String("email", "alice@example.com"),
+			attribute.String("refresh_token", "raw-refresh-token"),
+			attribute.String("reason", "bad password"),
+		))
+		span.SetStatus(codes.Error, "callback failed for /users/oidc/callback?code=C0DE&state=S7ATE")
+	})
+
+	attrs := attributeMap(span.Attributes)
+	if got, want := attrs["email"].AsString(), r.hash("alice@example.com"); got != want {
+		t.Errorf("email = %q, want hash %q", got, want)
+	}
+	if got := attrs["remote_addr"].AsString(); !strings.HasPrefix(got, "sha256:") {
+		t.Errorf("remote_addr = %q, want a hash", got)
+	}
+	for _, key := range []string{"password", "http.request.authorization"} {
+		if _, ok := attrs[key]; ok {
+			t.Errorf("%s was exported, want it dropped", key)
+		}
+	}
+	if got, want := attrs["http.url"].AsString(), "https://api.example.com/query?function=DAILY&apikey=[redacted]&symbol=IBM"; got != want {
+		t.Errorf("http.url = %q, want %q", got, want)
+	}
+	if got, want := attrs["note"].AsString(), "mail sent to [redacted] today"; got != want {
+		t.Errorf("note = %q, want %q", got, want)
+	}
+	if got := attrs["recipients"].AsStringSlice(); len(got) != 2 || got[0] != redactedPlaceholder || got[1] != "nobody" {
+		t.Errorf("recipients = %q, want the address masked", got)
+	}
+	if got := attrs["user_id"].AsInt64(); got != 42 {
+		t.Errorf("user_id = %d, want it untouched", got)
+	}
+
+	if len(span.Events) != 1 {
+		t.Fatalf("exported %d events, want 1", len(span.Events))
+	}
+	eventAttrs := attributeMap(span.Events[0].Attributes)
+	if got := eventAttrs["email"].AsString(); got != attrs["email"].AsString() {
+		t.Errorf("event email = %q, want the same hash as the span attribute", got)
+	}
+	if _, ok := eventAttrs["refresh_token"]; ok {
+		t.Error("event refresh_token was exported, want it dropped")
+	}
+	if got := eventAttrs["reason"].AsString(); got != "bad password" {
+		t.Errorf("event reason = %q, want it untouched", got)
+	}
+
+	if got, want := span.Status.Description, "callback failed for /users/oidc/callback?code=[redacted]&state=[redacted]"; got != want {
+		t.Errorf("status = %q, want %q", got, want)
+	}
+}
+
+func TestLoadRedactorRulesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	rules := `{
+		"rules": [
+			{"keys": ["account"], "action": "mask"},
+			{"keyPattern": "^ssn", "action": "drop"},
+			{"valuePattern": "\\d{4}-\\d{4}-\\d{4}-\\d{4}", "action": "hash"}
+		],
+		"queryParams": ["sig"]
+	}`
+	if err := os.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("REDACTION_RULES_FILE", path)
+	t.Setenv("REDACTION_HASH_KEY", "fixed-key")
+
+	r, err := loadRedactor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	span := exportRedactedSpan(t, r, func(span trace.Span) {
+		span.SetAttributes(
+			attribute.String("account", "12345"),
+			attribute.String("ssn_last4", "6789"),
+			attribute.String("card", "paid with 1111-2222-3333-4444"),
+			attribute.String("url", "/download?sig=abc&id=1"),
+			attribute.String("email", "alice@example.com"),
+		)
+	})
+	attrs := attributeMap(span.Attributes)
+
+	if got := attrs["account"].AsString(); got != redactedPlaceholder {
+		t.Errorf("account = %q, want it masked", got)
+	}
+	if _, ok := attrs["ssn_last4"]; ok {
+		t.Error("ssn_last4 was exported, want it dropped")
+	}
+	if got, want := attrs["card"].AsString(), "paid with "+r.hash("1111-2222-3333-4444"); got != want {
+		t.Errorf("card = %q, want %q", got, want)
+	}
+	if got, want := attrs["url"].AsString(), "/download?sig=[redacted]&id=1"; got != want {
+		t.Errorf("url = %q, want %q", got, want)
+	}
+	// The file replaces the defaults rather than adding to them.
+	if got := attrs["email"].AsString(); got != "alice@example.com" {
+		t.Errorf("email = %q, want it untouched by a rules file without email rules", got)
+	}
+
+	// The same hash key gives the same hashes in another process.
+	again, err := loadRedactor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.hash("x") != again.hash("x") {
+		t.Error("hashes differ between redactors loaded with the same REDACTION_HASH_KEY")
+	}
+}
+
+func TestLoadRedactorRejectsInvalidRules(t *testing.T) {
+	t.Setenv("REDACTION_HASH_KEY", "fixed-key")
+	for name, rules := range map[string]string{
+		"unknown action":   `{"rules": [{"keys": ["a"], "action": "encrypt"}]}`,
+		"bad key pattern":  `{"rules": [{"keyPattern": "(", "action": "drop"}]}`,
+		"bad value regexp": `{"rules": [{"valuePattern": "[", "action": "mask"}]}`,
+		"not json":         `rules: []`,
+	} {
+		path := filepath.Join(t.TempDir(), "rules.json")
+		if err := os.WriteFile(path, []byte(rules), 0600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("REDACTION_RULES_FILE", path)
+		if _, err := loadRedactor(); err == nil {
+			t.Errorf("%s: loadRedactor succeeded, want an error", name)
+		}
+	}
+}
+
+func TestOtelHandlerRedactsLogs(t *testing.T) {
+	r := testRedactor(t)
+	var buf bytes.Buffer
+	logger := slog.New(NewOtelHandler(slog.NewJSONHandler(&buf, nil), r))
+
+	spanCtx := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{2},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), spanCtx)
+
+	logger.With(slog.String("username", "alice"), slog.String("client_ip", "10.0.0.1")).
+		InfoContext(ctx, "reset link /users/verify?token=RAW sent to alice@example.com",
+			slog.String("email", "alice@example.com"),
+			slog.String("password", "hunter2"),
+			slog.Group("request", slog.String("access_token", "tok"), slog.String("path", "/users/me")),
+			slog.Int("user_id", 7),
+		)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("log line is not JSON: %v: %s", err, buf.String())
+	}
+
+	if got, want := entry["msg"], "reset link /users/verify?token=[redacted] sent to [redacted]"; got != want {
+		t.Errorf("msg = %q, want %q", got, want)
+	}
+	for key, value := range map[string]string{"email": "alice@example.com", "username": "alice", "client_ip": "10.0.0.1"} {
+		if got, want := entry[key], r.hash(value); got != want {
+			t.Errorf("%s = %v, want hash %q", key, got, want)
+		}
+	}
+	if _, ok := entry["password"]; ok {
+		t.Error("password was logged, want it dropped")
+	}
+	request, _ := entry["request"].(map[string]interface{})
+	if _, ok := request["access_token"]; ok || request["path"] != "/users/me" {
+		t.Errorf("request group = %v, want access_token dropped and path kept", request)
+	}
+	if entry["user_id"] != float64(7) {
+		t.Errorf("user_id = %v, want it untouched", entry["user_id"])
+	}
+	if entry["trace_id"] != spanCtx.TraceID().String() || entry["span_id"] != spanCtx.SpanID().String() {
+		t.Errorf("trace_id/span_id = %v/%v, want the span context ids", entry["trace_id"], entry["span_id"])
+	}
+}
+
+func TestMetricViewDropsSensitiveAttributes(t *testing.T) {
+	r := testRedactor(t)
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader), sdkmetric.WithView(r.MetricView()))
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+
+	counter, err := provider.Meter("test").Int64Counter("app_test_requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, email := range []string{"alice@example.com", "bob@example.com"} {
+		counter.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("endpoint", "login"),
+			attribute.String("email", email),
+			attribute.String("session.refresh_token", "tok"),
+		))
+	}
+
+	var data metricdata.ResourceMetrics
+	if err := reader.Collect(ctx, &data); err != nil {
+		t.Fatal(err)
+	}
+	sum := data.ScopeMetrics[0].Metrics[0].Data.(metricdata.Sum[int64])
+	if len(sum.DataPoints) != 1 {
+		t.Fatalf("got %d data points, want the emails folded into one", len(sum.DataPoints))
+	}
+	point := sum.DataPoints[0]
+	if point.Value != 2 {
+		t.Errorf("value = %d, want 2", point.Value)
+	}
+	if got := point.Attributes.Len(); got != 1 {
+		t.Errorf("data point has %d attributes (%v), want only endpoint", got, point.Attributes.ToSlice())
+	}
+	if v, ok := point.Attributes.Value("endpoint"); !ok || v.AsString() != "login" {
+		t.Errorf("endpoint attribute = %v, want login", v)
+	}
+}
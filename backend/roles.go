@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+)
+
+const (
+	permUsersRead      = "users:read"
+	permUsersWrite     = "users:write"
+	permSessionsRevoke = "sessions:revoke"
+	permWatchlistsRead = "watchlists:read"
+	permAuditRead      = "audit:read"
+)
+
+// rolePermissions lists what each role may do on top of managing its own
+// account, which every authenticated user can.
+var rolePermissions = map[string][]string{
+	roleUser:  {},
+	roleAdmin: {permUsersRead, permUsersWrite, permSessionsRevoke, permWatchlistsRead, permAuditRead},
+}
+
+// adminEmails are promoted to admin on startup so a fresh deployment has a
+// way in to the admin API.
+var adminEmails = strings.FieldsFunc(getEnv("ADMIN_EMAILS", ""), func(r rune) bool {
+	return r == ',' || r == ' '
+})
+
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func (u *User) hasPermission(permission string) bool {
+	return slices.Contains(rolePermissions[u.Role], permission)
+}
+
+// RequirePermission rejects requests whose authenticated user lacks any of
+// the given permissions. It must run after AuthMiddleware.
+func RequirePermission(permissions ...string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			user, ok := authUserFromContext(ctx)
+			if !ok {
+				writeAuthError(w, http.StatusUnauthorized, "Authentication required", "MISSING_TOKEN")
+				return
+			}
+
+			for _, permission := range permissions {
+				if user.hasPermission(permission) {
+					continue
+				}
+
+				trace.SpanFromContext(ctx).AddEvent("authorization.denied", trace.WithAttributes(
+					attribute.Int("user_id", user.ID),
+					attribute.String("role", user.Role),
+					attribute.String("permission", permission),
+				))
+				Logger.WarnContext(ctx, "Authorization denied - missing permission",
+					slog.Int("user_id", user.ID),
+					slog.String("role", user.Role),
+					slog.String("permission", permission),
+					slog.String("path", r.URL.Path),
+				)
+				writeAuthError(w, http.StatusForbidden, "You do not have permission to perform this action", "FORBIDDEN")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
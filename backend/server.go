@@ -43,20 +43,87 @@ func main() {
 	defer CloseDB()
 	fmt.Println("Database initialized")
 
+	stopKeyRotation, err := initSigningKeys()
+	if err != nil {
+		log.Fatal("Failed to initialize signing keys:", err)
+	}
+	defer stopKeyRotation()
+	fmt.Println("Signing keys loaded")
+	fmt.Printf("Mail sender: %s, email verification required: %t\n", mailer.Transport(), emailVerificationRequired)
+
+	if err := initMarketData(); err != nil {
+		log.Fatal("Failed to initialize market data providers:", err)
+	}
+	initSymbolCaches()
+	stopCatalogSync := startCatalogSync()
+	defer stopCatalogSync()
+	stopPriceHistorySync := startPriceHistorySync()
+	defer stopPriceHistorySync()
+	fmt.Println("Market data providers ready")
+
 	router.HandleFunc("/users/login", loginUser).Methods("POST")
+	router.HandleFunc("/users/login/2fa", loginTwoFactor).Methods("POST")
 	router.HandleFunc("/users/register", registerUser).Methods("POST")
+	router.HandleFunc("/users/verify", verifyEmail).Methods("GET", "POST")
+	router.HandleFunc("/users/verify/resend", resendEmailVerification).Methods("POST")
+	router.HandleFunc("/users/password/forgot", forgotPassword).Methods("POST")
+	router.HandleFunc("/users/password/reset", resetPassword).Methods("POST")
+	router.HandleFunc("/users/oidc/login", startOIDCLogin).Methods("GET")
+	router.HandleFunc("/users/oidc/callback", oidcCallback).Methods("GET")
+	router.HandleFunc("/users/refresh", refreshSession).Methods("POST")
+	router.HandleFunc("/users/logout", logoutUser).Methods("POST")
+	router.HandleFunc("/.well-known/jwks.json", getJWKS).Methods("GET")
 	router.HandleFunc("/stocks/symbols", getAllStockSymbols).Methods("GET")
 	router.HandleFunc("/stocks/{symbol}", getStockData).Methods("GET")
+	router.HandleFunc("/stocks/{symbol}/indicators", getStockIndicators).Methods("GET")
+	router.HandleFunc("/symbols/search", searchSymbols).Methods("GET")
 	router.HandleFunc("/crypto/symbols", getAllCryptoSymbols).Methods("GET")
 	router.HandleFunc("/crypto/{symbol}", getCryptoData).Methods("GET")
-	router.HandleFunc("/watchlist/add", addToWatchlist).Methods("POST")
-	router.HandleFunc("/watchlist/{userId}", getWatchlist).Methods("GET")
-	router.HandleFunc("/watchlist/remove/{userId}/{type}/{symbol}", removeFromWatchlist).Methods("POST")
+	router.HandleFunc("/crypto/{symbol}/indicators", getCryptoIndicators).Methods("GET")
+
+	watchlist := router.PathPrefix("/watchlist").Subrouter()
+	watchlist.Use(AuthMiddleware())
+	watchlist.Handle("/add", RequireScope(scopeWatchlistWrite)(http.HandlerFunc(addToWatchlist))).Methods("POST")
+	watchlist.Handle("/{userId}", RequireScope(scopeWatchlistRead)(http.HandlerFunc(getWatchlist))).Methods("GET")
+	watchlist.Handle("/remove/{userId}/{type}/{symbol}", RequireScope(scopeWatchlistWrite)(http.HandlerFunc(removeFromWatchlist))).Methods("POST")
+
+	twoFactor := router.PathPrefix("/users/2fa").Subrouter()
+	twoFactor.Use(AuthMiddleware(), RequireSession())
+	twoFactor.HandleFunc("/enroll", enrollTwoFactor).Methods("POST")
+	twoFactor.HandleFunc("/confirm", confirmTwoFactor).Methods("POST")
+
+	account := router.PathPrefix("/users/me").Subrouter()
+	account.Use(AuthMiddleware(), RequireSession())
+	account.HandleFunc("", getCurrentUser).Methods("GET")
+	account.HandleFunc("", updateCurrentUser).Methods("PATCH")
+	account.HandleFunc("", deleteAccount).Methods("DELETE")
+	account.HandleFunc("/export", exportAccount).Methods("GET")
+	account.HandleFunc("/password", changePassword).Methods("POST")
+	account.HandleFunc("/email", changeEmail).Methods("POST")
+	account.HandleFunc("/sessions", listSessions).Methods("GET")
+
+	apiTokens := router.PathPrefix("/users/tokens").Subrouter()
+	apiTokens.Use(AuthMiddleware(), RequireSession())
+	apiTokens.HandleFunc("", createAPIToken).Methods("POST")
+	apiTokens.HandleFunc("", listAPITokens).Methods("GET")
+	apiTokens.HandleFunc("/{id}", revokeAPIToken).Methods("DELETE")
+
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(AuthMiddleware(), RequireSession())
+	admin.Handle("/users", RequirePermission(permUsersRead)(http.HandlerFunc(adminListUsers))).Methods("GET")
+	admin.Handle("/users/{id}", RequirePermission(permUsersRead)(http.HandlerFunc(adminGetUser))).Methods("GET")
+	admin.Handle("/users/{id}/disable", RequirePermission(permUsersWrite)(http.HandlerFunc(adminDisableUser))).Methods("POST")
+	admin.Handle("/users/{id}/enable", RequirePermission(permUsersWrite)(http.HandlerFunc(adminEnableUser))).Methods("POST")
+	admin.Handle("/users/{id}/role", RequirePermission(permUsersWrite)(http.HandlerFunc(adminUpdateRole))).Methods("PUT")
+	admin.Handle("/users/{id}/logout", RequirePermission(permSessionsRevoke)(http.HandlerFunc(adminLogoutUser))).Methods("POST")
+	admin.Handle("/users/{id}/watchlist", RequirePermission(permWatchlistsRead)(http.HandlerFunc(adminGetWatchlist))).Methods("GET")
+	admin.Handle("/audit", RequirePermission(permAuditRead)(http.HandlerFunc(adminListAuditEvents))).Methods("GET")
+
 	router.HandleFunc("/log-event", logFrontendEvent).Methods("POST")
 
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"traceparent", "tracestate", "Content-Type", "Authorization"},
 		AllowCredentials: true,
 	})
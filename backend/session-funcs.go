@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+var refreshTokenTTL = getEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+
+var (
+	errRefreshTokenNotFound = errors.New("refresh token not found")
+	errRefreshTokenExpired  = errors.New("refresh token expired")
+	errRefreshTokenRevoked  = errors.New("refresh token revoked")
+	errRefreshTokenReused   = errors.New("refresh token reuse detected")
+)
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// issueSession starts a new refresh token family for user and returns the
+// access token and the first refresh token of the chain.
+func issueSession(ctx context.Context, user *User, r *http.Request) (string, string, error) {
+	familyID, err := generateRandomID()
+	if err != nil {
+		return "", "", err
+	}
+
+	refreshToken, err := createRefreshToken(DB.WithContext(ctx), user.ID, familyID, r)
+	if err != nil {
+		return "", "", err
+	}
+
+	accessToken, err := generateJWT(user, familyID)
+	if err != nil {
+		return "", "", err
+	}
+	return accessToken, refreshToken, nil
+}
+
+func createRefreshToken(db *gorm.DB, userID int, familyID string, r *http.Request) (string, error) {
+	raw, hash, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	token := RefreshToken{
+		UserID:     userID,
+		FamilyID:   familyID,
+		TokenHash:  hash,
+		ExpiresAt:  time.Now().UTC().Add(refreshTokenTTL),
+		UserAgent:  r.UserAgent(),
+		RemoteAddr: r.RemoteAddr,
+	}
+	if err := db.Create(&token).Error; err != nil {
+		return "", fmt.Errorf("error storing refresh token: %w", err)
+	}
+	return raw, nil
+}
+
+// rotateRefreshToken marks the presented token as used and issues its
+// successor in the same family. The returned token is the one that was
+// presented, so callers can revoke its family on reuse.
+func rotateRefreshToken(ctx context.Context, raw string, r *http.Request) (*RefreshToken, string, error) {
+	var current RefreshToken
+	err := DB.WithContext(ctx).Where("token_hash = ?", hashOpaqueToken(raw)).First(&current).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, "", errRefreshTokenNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch {
+	case current.RevokedAt != nil:
+		return &current, "", errRefreshTokenRevoked
+	case current.RotatedAt != nil:
+		return &current, "", errRefreshTokenReused
+	case time.Now().After(current.ExpiresAt):
+		return &current, "", errRefreshTokenExpired
+	}
+
+	var next string
+	err = DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// The rotated_at guard makes concurrent refreshes of the same token
+		// race on this row; only one of them gets a successor.
+		result := tx.Model(&RefreshToken{}).
+			Where("id = ? AND rotated_at IS NULL AND revoked_at IS NULL", current.ID).
+			Update("rotated_at", time.Now().UTC())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errRefreshTokenReused
+		}
+
+		var createErr error
+		next, createErr = createRefreshToken(tx, current.UserID, current.FamilyID, r)
+		return createErr
+	})
+	if err != nil {
+		return &current, "", err
+	}
+	return &current, next, nil
+}
+
+func revokeRefreshFamily(ctx context.Context, familyID string) (int64, error) {
+	result := DB.WithContext(ctx).Model(&RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now().UTC())
+	return result.RowsAffected, result.Error
+}
+
+// revokeUserSessions revokes every refresh token family of a user, which
+// also invalidates the access tokens issued from them.
+func revokeUserSessions(db *gorm.DB, userID int) (int64, error) {
+	result := db.Model(&RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now().UTC())
+	return result.RowsAffected, result.Error
+}
+
+// revokeOtherSessions revokes every session of a user except keepFamilyID,
+// typically the one making the request.
+func revokeOtherSessions(db *gorm.DB, userID int, keepFamilyID string) (int64, error) {
+	result := db.Model(&RefreshToken{}).
+		Where("user_id = ? AND family_id <> ? AND revoked_at IS NULL", userID, keepFamilyID).
+		Update("revoked_at", time.Now().UTC())
+	return result.RowsAffected, result.Error
+}
+
+// isSessionRevoked reports whether the refresh token family an access token
+// was issued from has been revoked.
+func isSessionRevoked(ctx context.Context, familyID string) (bool, error) {
+	var active int64
+	err := DB.WithContext(ctx).Model(&RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Count(&active).Error
+	return active == 0, err
+}
+
+// SessionView describes a session, i.e. a refresh token family. The first
+// token carries the details of the login that started it; later tokens show
+// when and from where it was last refreshed.
+type SessionView struct {
+	ID           string     `json:"sessionId"`
+	UserAgent    string     `json:"userAgent"`
+	RemoteAddr   string     `json:"remoteAddr"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	LastActiveAt time.Time  `json:"lastActiveAt"`
+	ExpiresAt    time.Time  `json:"expiresAt"`
+	RevokedAt    *time.Time `json:"revokedAt,omitempty"`
+	Current      bool       `json:"current,omitempty"`
+}
+
+func listUserSessions(db *gorm.DB, userID int) ([]SessionView, error) {
+	var tokens []RefreshToken
+	if err := db.Where("user_id = ?", userID).Order("id").Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+
+	sessions := []SessionView{}
+	seen := map[string]int{}
+	for _, t := range tokens {
+		if idx, ok := seen[t.FamilyID]; ok {
+			sessions[idx].LastActiveAt = t.CreatedAt
+			sessions[idx].ExpiresAt = t.ExpiresAt
+			if t.RevokedAt != nil {
+				sessions[idx].RevokedAt = t.RevokedAt
+			}
+			continue
+		}
+		seen[t.FamilyID] = len(sessions)
+		sessions = append(sessions, SessionView{
+			ID: t.FamilyID, UserAgent: t.UserAgent, RemoteAddr: t.RemoteAddr,
+			CreatedAt: t.CreatedAt, LastActiveAt: t.CreatedAt, ExpiresAt: t.ExpiresAt, RevokedAt: t.RevokedAt,
+		})
+	}
+	return sessions, nil
+}
+
+func refreshSession(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	startTime := time.Now()
+
+	ctx, span := tracer.Start(ctx, "auth.refresh",
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", "/users/refresh"),
+			attribute.String("component", "auth_service"),
+			attribute.String("operation", "token_refresh"),
+			attribute.String("user_agent", r.UserAgent()),
+			attribute.String("remote_addr", r.RemoteAddr),
+		),
+	)
+	defer span.End()
+
+	baseAttrs := []attribute.KeyValue{
+		attribute.String("endpoint", "refresh"),
+		attribute.String("method", r.Method),
+		attribute.String("component", "auth_service"),
+	}
+
+	if httpRequestCount != nil {
+		httpRequestCount.Add(ctx, 1, metric.WithAttributes(baseAttrs...))
+	}
+
+	outcome := "error"
+	auditUserID := 0
+	defer func() {
+		recordAuthEvent(ctx, r, auditUserID, auditTokenRefresh, outcome, nil)
+	}()
+
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		outcome = "invalid_request"
+		span.SetStatus(codes.Error, "Missing refresh token")
+		Logger.InfoContext(ctx, "Token refresh rejected - missing refresh token")
+		writeAuthError(w, http.StatusBadRequest, "Refresh token is required", "MISSING_REFRESH_TOKEN")
+		return
+	}
+
+	rotateCtx, rotateSpan := tracer.Start(ctx, "auth.refresh.rotate_token",
+		trace.WithAttributes(
+			attribute.String("operation", "rotate_refresh_token"),
+			attribute.String("table", "refresh_tokens"),
+		),
+	)
+
+	current, nextRefreshToken, err := rotateRefreshToken(rotateCtx, req.RefreshToken, r)
+	if current != nil {
+		auditUserID = current.UserID
+		rotateSpan.SetAttributes(
+			attribute.Int("user_id", current.UserID),
+			attribute.String("session.family_id", current.FamilyID),
+		)
+	}
+	if err != nil {
+		rotateSpan.RecordError(err)
+		rotateSpan.SetStatus(codes.Error, "Refresh token rotation failed")
+		rotateSpan.End()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Token refresh failed")
+
+		switch {
+		case errors.Is(err, errRefreshTokenReused):
+			outcome = "reuse_detected"
+			revoked, revokeErr := revokeRefreshFamily(ctx, current.FamilyID)
+			span.AddEvent("refresh_token_reuse_detected", trace.WithAttributes(
+				attribute.String("session.family_id", current.FamilyID),
+				attribute.Int64("session.tokens_revoked", revoked),
+			))
+
+			Logger.WarnContext(ctx, "Security: refresh token reuse detected, session family revoked",
+				slog.String("event", "refresh_token_reuse"),
+				slog.Int("user_id", current.UserID),
+				slog.String("family_id", current.FamilyID),
+				slog.Int64("tokens_revoked", revoked),
+				slog.Any("revoke_error", revokeErr),
+				slog.String("remote_addr", r.RemoteAddr),
+				slog.String("user_agent", r.UserAgent()),
+			)
+			writeAuthError(w, http.StatusUnauthorized, "Invalid refresh token", "REFRESH_TOKEN_REUSED")
+
+		case errors.Is(err, errRefreshTokenNotFound),
+			errors.Is(err, errRefreshTokenExpired),
+			errors.Is(err, errRefreshTokenRevoked):
+			outcome = "invalid_token"
+			Logger.InfoContext(ctx, "Token refresh rejected",
+				slog.String("reason", err.Error()),
+			)
+			writeAuthError(w, http.StatusUnauthorized, "Invalid refresh token", "INVALID_REFRESH_TOKEN")
+
+		default:
+			Logger.ErrorContext(ctx, "Database error during token refresh",
+				slog.String("error", err.Error()),
+			)
+			writeAuthError(w, http.StatusInternalServerError, "Token refresh failed", "DB_ERROR")
+		}
+		return
+	}
+	rotateSpan.SetStatus(codes.Ok, "Refresh token rotated")
+	rotateSpan.End()
+
+	var user User
+	if err := DB.WithContext(ctx).First(&user, "id = ?", current.UserID).Error; err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "User lookup failed")
+		Logger.ErrorContext(ctx, "User lookup failed during token refresh",
+			slog.Int("user_id", current.UserID),
+			slog.String("error", err.Error()),
+		)
+		writeAuthError(w, http.StatusUnauthorized, "Invalid refresh token", "INVALID_REFRESH_TOKEN")
+		return
+	}
+
+	// The token was rotated before the user was loaded; a disabled account
+	// must not keep the new one either.
+	if user.DisabledAt != nil {
+		outcome = "account_disabled"
+		if _, err := revokeRefreshFamily(ctx, current.FamilyID); err != nil {
+			Logger.ErrorContext(ctx, "Failed to revoke session of disabled user",
+				slog.Int("user_id", user.ID),
+				slog.String("family_id", current.FamilyID),
+				slog.String("error", err.Error()),
+			)
+		}
+		rejectDisabledUser(ctx, span, w, &user)
+		return
+	}
+
+	accessToken, err := generateJWT(&user, current.FamilyID)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Token generation failed")
+		Logger.ErrorContext(ctx, "JWT generation failed during token refresh",
+			slog.Int("user_id", user.ID),
+			slog.String("error", err.Error()),
+		)
+		writeAuthError(w, http.StatusInternalServerError, "Token generation failed", "TOKEN_GENERATION_FAILED")
+		return
+	}
+
+	if authDuration != nil {
+		authDuration.Record(ctx, time.Since(startTime).Seconds(),
+			metric.WithAttributes(append(baseAttrs,
+				attribute.String("status", "success"),
+			)...),
+		)
+	}
+
+	outcome = "success"
+	span.SetStatus(codes.Ok, "Token refreshed")
+	span.SetAttributes(attribute.Int("user_id", user.ID))
+
+	Logger.InfoContext(ctx, "Token refreshed",
+		slog.Int("user_id", user.ID),
+		slog.String("family_id", current.FamilyID),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AuthResponse{
+		Success:      true,
+		Message:      "Token refreshed",
+		Token:        accessToken,
+		RefreshToken: nextRefreshToken,
+		ExpiresIn:    int64(jwtTTL.Seconds()),
+		User:         &user,
+	})
+}
+
+// logoutUser revokes the refresh token family identified either by the
+// refresh token in the body or by the session of the bearer access token.
+func logoutUser(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+
+	ctx, span := tracer.Start(ctx, "auth.logout",
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", "/users/logout"),
+			attribute.String("component", "auth_service"),
+			attribute.String("operation", "user_logout"),
+		),
+	)
+	defer span.End()
+
+	if httpRequestCount != nil {
+		httpRequestCount.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("endpoint", "logout"),
+			attribute.String("method", r.Method),
+			attribute.String("component", "auth_service"),
+		))
+	}
+
+	var req RefreshRequest
+	json.NewDecoder(r.Body).Decode(&req)
+
+	familyID := ""
+	userID := 0
+	if req.RefreshToken != "" {
+		var token RefreshToken
+		if err := DB.WithContext(ctx).Where("token_hash = ?", hashOpaqueToken(req.RefreshToken)).First(&token).Error; err == nil {
+			familyID = token.FamilyID
+			userID = token.UserID
+		}
+	} else if bearer, err := bearerToken(r); err == nil {
+		if claims, claimsUserID, err := parseJWT(bearer); err == nil {
+			familyID = claims.SessionID
+			userID = claimsUserID
+		}
+	}
+
+	if familyID == "" {
+		span.SetStatus(codes.Ok, "No active session")
+		Logger.InfoContext(ctx, "Logout without an active session")
+	} else {
+		revoked, err := revokeRefreshFamily(ctx, familyID)
+		span.SetAttributes(
+			attribute.String("session.family_id", familyID),
+			attribute.Int64("session.tokens_revoked", revoked),
+		)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Session revocation failed")
+			Logger.ErrorContext(ctx, "Session revocation failed",
+				slog.String("family_id", familyID),
+				slog.String("error", err.Error()),
+			)
+			recordAuthEvent(ctx, r, userID, auditLogout, "error", nil)
+			writeAuthError(w, http.StatusInternalServerError, "Logout failed", "DB_ERROR")
+			return
+		}
+		recordAuthEvent(ctx, r, userID, auditLogout, "success", map[string]interface{}{
+			"session_id":     familyID,
+			"tokens_revoked": revoked,
+		})
+		span.SetStatus(codes.Ok, "Session revoked")
+		Logger.InfoContext(ctx, "User logged out",
+			slog.String("family_id", familyID),
+			slog.Int64("tokens_revoked", revoked),
+		)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AuthResponse{
+		Success: true,
+		Message: "Logged out",
+	})
+}
+
+const (
+	authEventsDefaultLimit = 50
+	authEventsMaxLimit     = 200
+)
+
+type SessionListResponse struct {
+	Success  bool          `json:"success"`
+	Sessions []SessionView `json:"sessions"`
+	Events   []AuditEvent  `json:"events"`
+}
+
+// listSessions returns the caller's sessions together with their recent
+// authentication events, newest first.
+func listSessions(w http.ResponseWriter, r *http.Request) {
+	ctx, span, user, ok := startAccountSpan(w, r, "auth.sessions.list", "/users/me/sessions", "list_sessions")
+	defer span.End()
+	if !ok {
+		return
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = authEventsDefaultLimit
+	}
+	if limit > authEventsMaxLimit {
+		limit = authEventsMaxLimit
+	}
+
+	db := DB.WithContext(ctx)
+	sessions, err := listUserSessions(db, user.ID)
+	events := []AuditEvent{}
+	if err == nil {
+		err = db.Where("user_id = ? AND action LIKE ?", user.ID, "auth.%").
+			Order("id DESC").Limit(limit).Find(&events).Error
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Database error")
+		Logger.ErrorContext(ctx, "Failed to list sessions",
+			slog.Int("user_id", user.ID),
+			slog.String("error", err.Error()),
+		)
+		writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+		return
+	}
+
+	if current, ok := authSessionFromContext(ctx); ok {
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == current
+		}
+	}
+
+	span.SetAttributes(
+		attribute.Int("result.sessions", len(sessions)),
+		attribute.Int("result.events", len(events)),
+	)
+	span.SetStatus(codes.Ok, "Sessions listed")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SessionListResponse{
+		Success:  true,
+		Sessions: sessions,
+		Events:   events,
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postRefresh(refreshToken string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(RefreshRequest{RefreshToken: refreshToken})
+	req := httptest.NewRequest(http.MethodPost, "/users/refresh", strings.NewReader(string(body)))
+	rec := httptest.NewRecorder()
+	refreshSession(rec, req)
+	return rec
+}
+
+func TestRefreshSessionRotatesToken(t *testing.T) {
+	setupTestDB(t)
+	setupTestSigningKeys(t)
+
+	user := User{Username: "alice", Email: "alice@example.com"}
+	if err := DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	_, refreshToken, err := issueSession(context.Background(), &user, httptest.NewRequest(http.MethodPost, "/users/login", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := postRefresh(refreshToken)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh returned %d: %s", rec.Code, rec.Body)
+	}
+	var resp AuthResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.Token == "" || resp.RefreshToken == "" || resp.RefreshToken == refreshToken {
+		t.Errorf("response = %+v, want an access token and a new refresh token", resp)
+	}
+}
+
+func TestRefreshSessionRejectsDisabledUser(t *testing.T) {
+	setupTestDB(t)
+	setupTestSigningKeys(t)
+
+	user := User{Username: "alice", Email: "alice@example.com"}
+	if err := DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	_, refreshToken, err := issueSession(context.Background(), &user, httptest.NewRequest(http.MethodPost, "/users/login", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Disabled directly, so the session is still live as it would be after
+	// a failed revocation or a race with the refresh.
+	if err := DB.Model(&user).Update("disabled_at", time.Now().UTC()).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	rec := postRefresh(refreshToken)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("refresh returned %d, want 403: %s", rec.Code, rec.Body)
+	}
+	var resp ErrorResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.Error != "ACCOUNT_DISABLED" {
+		t.Errorf("error code = %q, want ACCOUNT_DISABLED", resp.Error)
+	}
+
+	var live int64
+	DB.Model(&RefreshToken{}).Where("revoked_at IS NULL").Count(&live)
+	if live != 0 {
+		t.Errorf("%d refresh tokens still live, want the session revoked", live)
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// jwksMaxAge is how long clients may cache the JWKS.
+const jwksMaxAge = 5 * time.Minute
+
+// A new key is published in the JWKS JWT_KEY_PUBLISH_LEAD before it starts
+// signing, so verifiers holding a cached JWKS already know it. The lead is
+// never shorter than jwksMaxAge.
+var (
+	jwtKeyDir              = getEnv("JWT_KEY_DIR", "keys")
+	jwtKeyRotationInterval = getEnvDuration("JWT_KEY_ROTATION_INTERVAL", 30*24*time.Hour)
+	jwtKeyGracePeriod      = getEnvDuration("JWT_KEY_GRACE_PERIOD", time.Hour)
+	jwtKeyCheckInterval    = getEnvDuration("JWT_KEY_CHECK_INTERVAL", time.Minute)
+	jwtKeyPublishLead      = max(getEnvDuration("JWT_KEY_PUBLISH_LEAD", 2*jwksMaxAge), jwksMaxAge)
+)
+
+var (
+	errUnknownSigningKey     = errors.New("unknown signing key id")
+	errUnsupportedSigningKey = errors.New("unsupported signing key type")
+	errNoSigningKey          = errors.New("no active signing key")
+)
+
+var signingKeys *keyRing
+
+// signingKey is one private key from the key directory. A key is published
+// from CreatedAt, signs new tokens from ActiveFrom while it is the newest
+// active key, and keeps verifying tokens until gracePeriod after a newer key
+// replaced it.
+type signingKey struct {
+	ID         string
+	Signer     crypto.Signer
+	Method     jwt.SigningMethod
+	CreatedAt  time.Time
+	ActiveFrom time.Time
+	RetiredAt  time.Time
+}
+
+type keyRing struct {
+	mu      sync.RWMutex
+	dir     string
+	current *signingKey
+	keys    map[string]*signingKey
+	stop    chan struct{}
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// initSigningKeys loads the key directory, creating a first key when it is
+// empty, and starts the rotation loop. The returned func stops the loop.
+func initSigningKeys() (func(), error) {
+	ring := &keyRing{dir: jwtKeyDir, stop: make(chan struct{})}
+	if err := ring.refresh(); err != nil {
+		return nil, err
+	}
+	signingKeys = ring
+
+	go ring.rotationLoop()
+
+	return func() { close(ring.stop) }, nil
+}
+
+func (k *keyRing) rotationLoop() {
+	ticker := time.NewTicker(jwtKeyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := k.refresh(); err != nil {
+				log.Printf("Signing key refresh failed: %v", err)
+			}
+		case <-k.stop:
+			return
+		}
+	}
+}
+
+// refresh reloads the key directory so replicas sharing it converge on the
+// same keys, and generates the next key once the newest one is due. The next
+// key only takes over signing jwtKeyPublishLead later.
+func (k *keyRing) refresh() error {
+	keys, err := loadSigningKeys(k.dir)
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 0 || time.Since(keys[len(keys)-1].CreatedAt) >= jwtKeyRotationInterval {
+		key, err := generateSigningKey(k.dir)
+		if err != nil {
+			return err
+		}
+		log.Printf("Generated new signing key %s, signing from %s", key.ID, key.CreatedAt.Add(jwtKeyPublishLead).Format(time.RFC3339))
+		keys = append(keys, key)
+	}
+
+	current := planSigningKeys(keys, time.Now())
+
+	active := make(map[string]*signingKey, len(keys))
+	for _, key := range keys {
+		if key.RetiredAt.IsZero() || time.Since(key.RetiredAt) < jwtKeyGracePeriod {
+			active[key.ID] = key
+		}
+	}
+
+	k.mu.Lock()
+	k.current = current
+	k.keys = active
+	k.mu.Unlock()
+	return nil
+}
+
+// planSigningKeys sets when each key, oldest first, starts signing and is
+// retired, and returns the key that signs at now. The first key signs right
+// away since there is nothing to wait for; every later key waits
+// jwtKeyPublishLead after its creation and retires its predecessor then.
+func planSigningKeys(keys []*signingKey, now time.Time) *signingKey {
+	for i, key := range keys {
+		key.ActiveFrom = key.CreatedAt
+		if i > 0 {
+			key.ActiveFrom = key.CreatedAt.Add(jwtKeyPublishLead)
+			keys[i-1].RetiredAt = key.ActiveFrom
+		}
+	}
+
+	current := keys[0]
+	for _, key := range keys[1:] {
+		if !key.ActiveFrom.After(now) {
+			current = key
+		}
+	}
+	return current
+}
+
+func (k *keyRing) signingKey() (*signingKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.current == nil {
+		return nil, errNoSigningKey
+	}
+	return k.current, nil
+}
+
+func (k *keyRing) verificationKey(kid string) (*signingKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, errUnknownSigningKey
+	}
+	return key, nil
+}
+
+func (k *keyRing) methods() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	seen := map[string]bool{}
+	var algs []string
+	for _, key := range k.keys {
+		if alg := key.Method.Alg(); !seen[alg] {
+			seen[alg] = true
+			algs = append(algs, alg)
+		}
+	}
+	return algs
+}
+
+func (k *keyRing) jwks() JWKSet {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range k.keys {
+		if jwk, err := publicJWK(key); err == nil {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
+}
+
+// signingKeyIDLayout is the creation time at the start of every kid. The
+// order of the keys is taken from it rather than from file times, which
+// change when the key directory is copied or restored.
+const signingKeyIDLayout = "20060102T150405Z"
+
+// signingKeyCreatedAt reads the creation time from a kid of the form
+// 20060102T150405Z-<suffix>.
+func signingKeyCreatedAt(kid string) (time.Time, error) {
+	stamp, _, ok := strings.Cut(kid, "-")
+	if !ok {
+		return time.Time{}, fmt.Errorf("key id %q does not start with its creation time", kid)
+	}
+	createdAt, err := time.Parse(signingKeyIDLayout, stamp)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("key id %q does not start with its creation time", kid)
+	}
+	return createdAt, nil
+}
+
+// loadSigningKeys reads every *.pem private key in dir, oldest first. The kid
+// of a key is its file name without the extension.
+func loadSigningKeys(dir string) ([]*signingKey, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating key dir: %w", err)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("error listing key dir: %w", err)
+	}
+
+	var keys []*signingKey
+	for _, path := range paths {
+		kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+		createdAt, err := signingKeyCreatedAt(kid)
+		if err != nil {
+			return nil, fmt.Errorf("error reading key %s: %w", path, err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading key %s: %w", path, err)
+		}
+		signer, err := parsePrivateKeyPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing key %s: %w", path, err)
+		}
+		method, err := signingMethodFor(signer)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing key %s: %w", path, err)
+		}
+		keys = append(keys, &signingKey{
+			ID:        kid,
+			Signer:    signer,
+			Method:    method,
+			CreatedAt: createdAt,
+		})
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys, nil
+}
+
+func generateSigningKey(dir string) (*signingKey, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("error generating signing key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding signing key: %w", err)
+	}
+
+	suffix, err := generateRandomID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	kid := now.Format(signingKeyIDLayout) + "-" + suffix[:8]
+
+	path := filepath.Join(dir, kid+".pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, fmt.Errorf("error writing signing key: %w", err)
+	}
+
+	return &signingKey{
+		ID:        kid,
+		Signer:    private,
+		Method:    jwt.SigningMethodES256,
+		CreatedAt: now,
+	}, nil
+}
+
+func parsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errUnsupportedSigningKey
+	}
+	return signer, nil
+}
+
+func signingMethodFor(signer crypto.Signer) (jwt.SigningMethod, error) {
+	switch key := signer.(type) {
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		}
+	case *rsa.PrivateKey:
+		return jwt.SigningMethodRS256, nil
+	}
+	return nil, errUnsupportedSigningKey
+}
+
+func publicJWK(key *signingKey) (JWK, error) {
+	jwk := JWK{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+
+	switch pub := key.Signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		ecdhKey, err := pub.ECDH()
+		if err != nil {
+			return jwk, err
+		}
+		// Uncompressed point: 0x04 || X || Y
+		point := ecdhKey.Bytes()[1:]
+		size := len(point) / 2
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(point[:size])
+		jwk.Y = base64.RawURLEncoding.EncodeToString(point[size:])
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	default:
+		return jwk, errUnsupportedSigningKey
+	}
+	return jwk, nil
+}
+
+func getJWKS(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	ctx, span := tracer.Start(ctx, "auth.jwks")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("http.method", r.Method),
+		attribute.String("http.target", r.URL.Path),
+	)
+
+	if httpRequestCount != nil {
+		httpRequestCount.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("endpoint", "/.well-known/jwks.json"),
+			attribute.String("method", r.Method),
+		))
+	}
+
+	set := signingKeys.jwks()
+	span.SetAttributes(attribute.Int("jwks.key_count", len(set.Keys)))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+	if err := json.NewEncoder(w).Encode(set); err != nil {
+		span.SetStatus(codes.Error, fmt.Sprintf("Failed to encode JSON response: %v", err))
+		span.RecordError(err)
+		Logger.ErrorContext(ctx, "Failed to encode JWKS response", "error", err)
+		return
+	}
+	span.SetStatus(codes.Ok, "JWKS served")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestSigningKey(t *testing.T, dir, kid string) string {
+	t.Helper()
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, kid+".pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Copying or restoring the key directory changes file times; the order of
+// the keys must not follow them.
+func TestLoadSigningKeysOrdersByKeyID(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().UTC().Truncate(time.Second)
+	oldKid := now.Add(-40*24*time.Hour).Format(signingKeyIDLayout) + "-aaaaaaaa"
+	newKid := now.Add(-24*time.Hour).Format(signingKeyIDLayout) + "-bbbbbbbb"
+
+	oldPath := writeTestSigningKey(t, dir, oldKid)
+	newPath := writeTestSigningKey(t, dir, newKid)
+	// The old key looks freshly written, the new one months old.
+	if err := os.Chtimes(oldPath, now, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(newPath, now.AddDate(0, -3, 0), now.AddDate(0, -3, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := loadSigningKeys(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].ID != oldKid || keys[1].ID != newKid {
+		t.Fatalf("loaded %v, want %s then %s", keys, oldKid, newKid)
+	}
+	if !keys[0].CreatedAt.Equal(now.Add(-40 * 24 * time.Hour)) {
+		t.Errorf("created at %s, want the time in the kid", keys[0].CreatedAt)
+	}
+	if current := planSigningKeys(keys, now); current.ID != newKid {
+		t.Errorf("signing with %s, want the newest key %s", current.ID, newKid)
+	}
+}
+
+func TestLoadSigningKeysRejectsUnnamedKeys(t *testing.T) {
+	dir := t.TempDir()
+	writeTestSigningKey(t, dir, "imported")
+	if _, err := loadSigningKeys(dir); err == nil {
+		t.Fatal("loaded a key whose id has no creation time")
+	}
+}
+
+func TestGeneratedSigningKeyRoundTrips(t *testing.T) {
+	dir := t.TempDir()
+	key, err := generateSigningKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := loadSigningKeys(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].ID != key.ID || !keys[0].CreatedAt.Equal(key.CreatedAt) {
+		t.Fatalf("loaded %+v, want %s created %s", keys, key.ID, key.CreatedAt)
+	}
+}
@@ -2,12 +2,10 @@ package main
 
 import (
 	_ "context"
-	"encoding/csv"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -19,8 +17,6 @@ import (
 	_ "go.opentelemetry.io/otel/trace"
 )
 
-const apiKey = "26AMBY8WA3V0FCMD"
-
 type stockData struct {
 	Symbol string
 	Name   string
@@ -43,6 +39,7 @@ func getAllStockSymbols(w http.ResponseWriter, r *http.Request) {
 	span.SetAttributes(
 		attribute.String("http.method", r.Method),
 		attribute.String("http.target", r.URL.Path),
+		attribute.String("provider", stockProvider.Name()),
 	)
 	span.AddEvent("Handler execution started")
 
@@ -52,89 +49,14 @@ func getAllStockSymbols(w http.ResponseWriter, r *http.Request) {
 		attribute.String("Trace ID", span.SpanContext().TraceID().String()),
 		attribute.String("Span ID", span.SpanContext().SpanID().String())))
 
-	apiUrl := fmt.Sprintf("https://www.alphavantage.co/query?function=LISTING_STATUS&apikey=%s", apiKey)
-
-	_, apiCallSpan := tracer.Start(ctx, "alphaVantage.LISTING_STATUS")
-	apiCallSpan.SetAttributes(
-		attribute.String("http.url", apiUrl),
-		attribute.String("http.method", "GET"),
-		attribute.String("api.name", "alphavantage"),
-		attribute.String("api.operation", "LISTING_STATUS"),
-	)
-	defer apiCallSpan.End()
-
-	apiCallStartTime := time.Now()
-	response, err := http.Get(apiUrl)
-	apiCallDuration := time.Since(apiCallStartTime).Seconds()
-
-	Logger.InfoContext(ctx, "External API call made", "url", apiUrl, "duration_sec", apiCallDuration, "error", err)
-
-	externalAPICallDuration.Record(ctx, apiCallDuration, metric.WithAttributes(
-		attribute.String("api.name", "alphavantage_api"),
-		attribute.String("api.operation", "LISTING_STATUS"),
-		attribute.Bool("api.error", err != nil),
-		attribute.String("Trace ID", span.SpanContext().TraceID().String()),
-		attribute.String("Span ID", apiCallSpan.SpanContext().SpanID().String())))
-
+	symbols, err := stockSymbolCache.Get(ctx)
 	if err != nil {
-		apiCallSpan.SetStatus(codes.Error, fmt.Sprintf("HTTP GET failed: %v", err))
-		apiCallSpan.RecordError(err)
-
 		span.SetStatus(codes.Error, fmt.Sprintf("External API call failed: %v", err))
 		span.RecordError(err)
-
-		Logger.ErrorContext(ctx, "HTTP GET to AlphaVantage failed", "error", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer response.Body.Close()
-
-	apiCallSpan.SetAttributes(
-		attribute.Int("http.status_code", response.StatusCode),
-		attribute.String("http.response_content_type", response.Header.Get("Content-Type")),
-	)
-	if response.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(response.Body)
-		errorMsg := fmt.Sprintf("API returned non-OK status: %d, body: %s", response.StatusCode, bodyBytes)
-
-		apiCallSpan.SetStatus(codes.Error, errorMsg)
-		span.SetStatus(codes.Error, errorMsg)
-		Logger.ErrorContext(ctx, "AlphaVantage returned non-OK status", "status_code", response.StatusCode, "body", string(bodyBytes))
-		http.Error(w, errorMsg, response.StatusCode)
+		Logger.ErrorContext(ctx, "Fetching stock symbols failed", "provider", stockProvider.Name(), "error", err)
+		writeProviderError(w, err)
 		return
 	}
-	apiCallSpan.SetStatus(codes.Ok, "API call successful")
-
-	reader := csv.NewReader(response.Body)
-	reader.Read()
-	var symbols []stockData
-
-	_, readCsvSpan := tracer.Start(ctx, "processCsvResponse")
-	defer readCsvSpan.End()
-	readCsvSpan.AddEvent("Starting CSV parsing")
-
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			readCsvSpan.SetStatus(codes.Error, fmt.Sprintf("CSV read error: %v", err))
-			readCsvSpan.RecordError(err)
-			span.SetStatus(codes.Error, fmt.Sprintf("CSV processing failed: %v", err))
-			span.RecordError(err)
-			Logger.ErrorContext(ctx, "CSV parsing error", "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if strings.TrimSpace(record[6]) == "Active" {
-			symbols = append(symbols, stockData{record[0], record[1]})
-		}
-	}
-	readCsvSpan.SetAttributes(attribute.Int("symbols.active_count", len(symbols)))
-	readCsvSpan.SetStatus(codes.Ok, "CSV parsing complete")
-
-	Logger.InfoContext(ctx, "CSV parsing complete", "active_symbols_count", len(symbols))
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(symbols); err != nil {
@@ -162,6 +84,7 @@ func getStockData(w http.ResponseWriter, r *http.Request) {
 	span.SetAttributes(
 		attribute.String("http.method", r.Method),
 		attribute.String("http.target", r.URL.Path),
+		attribute.String("provider", stockProvider.Name()),
 	)
 	span.AddEvent("Handler execution started")
 
@@ -172,96 +95,50 @@ func getStockData(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Stock symbol is required", http.StatusBadRequest)
 		return
 	}
+	var v Validator
+	v.Symbol("symbol", symbol)
+	if !v.Valid() {
+		recordValidationFailure(span, v.Errors)
+		writeValidationError(w, v.Errors)
+		return
+	}
 	Logger.InfoContext(ctx, "Retrieving stock data for symbol", "symbol", symbol)
 
-	apiUrl := fmt.Sprintf("https://www.alphavantage.co/query?function=TIME_SERIES_DAILY&symbol=%s&outputsize=compact&apikey=%s", symbol, apiKey)
-
 	httpRequestCount.Add(ctx, 1, metric.WithAttributes(
 		attribute.String("endpoint", "/stocks/{symbol}"),
 		attribute.String("method", r.Method),
 		attribute.String("Trace ID", span.SpanContext().TraceID().String()),
 		attribute.String("Span ID", span.SpanContext().SpanID().String())))
 
-	_, apiCallSpan := tracer.Start(ctx, "alphaVantage.TIME_SERIES_DAILY")
-	apiCallSpan.SetAttributes(
-		attribute.String("http.url", apiUrl),
-		attribute.String("http.method", "GET"),
-		attribute.String("api.name", "alphavantage"),
-		attribute.String("api.operation", "TIME_SERIES_DAILY"),
-		attribute.String("stock_symbol", symbol),
-	)
-	defer apiCallSpan.End()
-
-	apiCallStartTime := time.Now()
-	response, err := http.Get(apiUrl)
-	apiCallDuration := time.Since(apiCallStartTime).Seconds()
-
-	// Log external API call completion
-	Logger.InfoContext(ctx, "External API call completed", "url", apiUrl, "duration_sec", apiCallDuration, "error_present", err != nil)
-
-	externalAPICallDuration.Record(ctx, apiCallDuration, metric.WithAttributes(
-		attribute.String("api.name", "alphavantage_api"),
-		attribute.String("api.operation", "TIME_SERIES_DAILY"),
-		attribute.Bool("api.error", err != nil),
-		attribute.String("Trace ID", span.SpanContext().TraceID().String()),
-		attribute.String("Span ID", apiCallSpan.SpanContext().SpanID().String())))
-
-	if err != nil {
-		apiCallSpan.SetStatus(codes.Error, fmt.Sprintf("HTTP GET failed: %v", err))
-		apiCallSpan.RecordError(err)
-
-		span.SetStatus(codes.Error, fmt.Sprintf("External API call failed: %v", err))
-		span.RecordError(err)
-		// Log error for HTTP GET
-		Logger.ErrorContext(ctx, "HTTP GET to AlphaVantage for stock data failed", "error", err, "api_url", apiUrl, "symbol", symbol)
-
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	req, ok := readQuoteRequest(w, r, span)
+	if !ok {
 		return
 	}
-	defer response.Body.Close()
-
-	apiCallSpan.SetAttributes(
-		attribute.Int("http.status_code", response.StatusCode),
-		attribute.String("http.response_content_type", response.Header.Get("Content-Type")),
-	)
-	if response.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(response.Body)
-		response.Body = io.NopCloser(strings.NewReader(string(bodyBytes)))
-		errorMsg := fmt.Sprintf("API returned non-OK status: %d, body: %s", response.StatusCode, bodyBytes)
-
-		apiCallSpan.SetStatus(codes.Error, errorMsg)
-		span.SetStatus(codes.Error, errorMsg)
-		Logger.ErrorContext(ctx, "AlphaVantage returned non-OK status for stock data",
-			"status_code", response.StatusCode,
-			"response_body", string(bodyBytes),
-			"api_url", apiUrl,
-			"symbol", symbol)
-		http.Error(w, errorMsg, response.StatusCode)
-		return
+	if req.Series.Interval == "" {
+		req.Series.Interval = "daily"
 	}
-	apiCallSpan.SetStatus(codes.Ok, "API call successful")
-	Logger.InfoContext(ctx, "AlphaVantage API call successful for stock data", "api_url", apiUrl, "status_code", response.StatusCode, "symbol", symbol)
-
-	_, responseSpan := tracer.Start(ctx, "processAPIresponse")
-	defer responseSpan.End()
-	responseSpan.AddEvent("Started decoding JSON")
-	Logger.InfoContext(ctx, "Starting JSON decoding for stock data response", "symbol", symbol)
+	span.SetAttributes(attribute.String("series.interval", req.Series.Interval))
 
-	var stockData map[string]interface{}
-	if err := json.NewDecoder(response.Body).Decode(&stockData); err != nil {
-		responseSpan.SetStatus(codes.Error, fmt.Sprintf("JSON read error: %v", err))
-		responseSpan.RecordError(err)
-		span.SetStatus(codes.Error, fmt.Sprintf("JSON decoding failed: %v", err))
+	// Daily candles are served from the price history; raw payloads can only
+	// come from the provider.
+	var quote *Quote
+	var err error
+	if req.Series.Interval == "daily" && req.Format != quoteFormatRaw {
+		quote, err = readDailyHistory(ctx, "STOCK", symbol, req.Series)
+	} else {
+		quote, err = stockProvider.Series(ctx, symbol, req.Series)
+	}
+	if err != nil {
+		span.SetStatus(codes.Error, fmt.Sprintf("External API call failed: %v", err))
 		span.RecordError(err)
-		// Log error for JSON decoding
-		Logger.ErrorContext(ctx, "Failed to decode JSON response for stock data", "error", err, "symbol", symbol)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		Logger.ErrorContext(ctx, "Fetching stock data failed", "provider", stockProvider.Name(), "error", err, "symbol", symbol)
+		writeProviderError(w, err)
 		return
 	}
-	Logger.InfoContext(ctx, "JSON decoding complete for stock data response", "symbol", symbol)
+	quote.trim(req.Series)
+	span.SetAttributes(attribute.Int("candles.count", len(quote.Candles)))
 
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(stockData)
+	err = writeQuote(w, quote, req.Format)
 	if err != nil {
 		span.SetStatus(codes.Error, fmt.Sprintf("Failed to encode JSON response: %v", err))
 		span.RecordError(err)
@@ -295,6 +172,7 @@ func getAllCryptoSymbols(w http.ResponseWriter, r *http.Request) {
 	span.SetAttributes(
 		attribute.String("http.method", r.Method),
 		attribute.String("http.target", r.URL.Path),
+		attribute.String("provider", cryptoProvider.Name()),
 	)
 	span.AddEvent("Handler execution started")
 
@@ -304,102 +182,14 @@ func getAllCryptoSymbols(w http.ResponseWriter, r *http.Request) {
 		attribute.String("Trace ID", span.SpanContext().TraceID().String()),
 		attribute.String("Span ID", span.SpanContext().SpanID().String())))
 
-	apiUrl := "https://api.coingecko.com/api/v3/coins/markets?vs_currency=usd&order=market_cap_desc&per_page=100&page=1&sparkline=false&price_change_percentage=24h"
-
-	_, apiCallSpan := tracer.Start(ctx, "coingecko.LISTED_COINS")
-	apiCallSpan.SetAttributes(
-		attribute.String("http.url", apiUrl),
-		attribute.String("http.method", "GET"),
-		attribute.String("api.name", "coingecko"),
-		attribute.String("api.operation", "LISTING_STATUS"),
-	)
-	defer apiCallSpan.End()
-
-	apiCallStartTime := time.Now()
-	response, err := http.Get(apiUrl)
-	apiCallDuration := time.Since(apiCallStartTime).Seconds()
-
-	// Log external API call completion
-	Logger.InfoContext(ctx, "External API call completed", "url", apiUrl, "duration_sec", apiCallDuration, "error_present", err != nil)
-
-	externalAPICallDuration.Record(ctx, apiCallDuration, metric.WithAttributes(
-		attribute.String("api.name", "coingecko_api"),
-		attribute.String("api.operation", "LISTED_COINS"),
-		attribute.Bool("api.error", err != nil),
-		attribute.String("Trace ID", span.SpanContext().TraceID().String()),
-		attribute.String("Span ID", apiCallSpan.SpanContext().SpanID().String())))
-
+	symbols, err := cryptoSymbolCache.Get(ctx)
 	if err != nil {
-		apiCallSpan.SetStatus(codes.Error, fmt.Sprintf("HTTP GET failed: %v", err))
-		apiCallSpan.RecordError(err)
-
 		span.SetStatus(codes.Error, fmt.Sprintf("External API call failed: %v", err))
 		span.RecordError(err)
-
-		// Log error for HTTP GET
-		Logger.ErrorContext(ctx, "HTTP GET to Coingecko for crypto symbols failed", "error", err, "api_url", apiUrl)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer response.Body.Close()
-
-	apiCallSpan.SetAttributes(
-		attribute.Int("http.status_code", response.StatusCode),
-		attribute.String("http.response_content_type", response.Header.Get("Content-Type")),
-	)
-	if response.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(response.Body)                          // Read body for error context
-		response.Body = io.NopCloser(strings.NewReader(string(bodyBytes))) // Restore body for later
-		errorMsg := fmt.Sprintf("API returned non-OK status: %d, body: %s", response.StatusCode, bodyBytes)
-
-		apiCallSpan.SetStatus(codes.Error, errorMsg)
-		span.SetStatus(codes.Error, errorMsg)
-		// Log error for non-OK status
-		Logger.ErrorContext(ctx, "Coingecko returned non-OK status for crypto symbols",
-			"status_code", response.StatusCode,
-			"response_body", string(bodyBytes),
-			"api_url", apiUrl)
-		http.Error(w, errorMsg, response.StatusCode)
-		return
-	}
-	apiCallSpan.SetStatus(codes.Ok, "API call successful")
-	Logger.InfoContext(ctx, "Coingecko API call successful for crypto symbols", "api_url", apiUrl, "status_code", response.StatusCode)
-
-	var cryptoData []map[string]interface{}
-	_, readJSONparser := tracer.Start(ctx, "processJSONresponse")
-	defer readJSONparser.End()
-	readJSONparser.AddEvent("Starting JSON response parsing")
-	Logger.InfoContext(ctx, "Starting JSON decoding for crypto symbols response")
-
-	if err := json.NewDecoder(response.Body).Decode(&cryptoData); err != nil {
-		readJSONparser.SetStatus(codes.Error, fmt.Sprintf("JSON read error: %v", err))
-		readJSONparser.RecordError(err)
-		span.SetStatus(codes.Error, fmt.Sprintf("crypto coins processing failed: %v", err))
-		span.RecordError(err)
-		// Log error for JSON decoding
-		Logger.ErrorContext(ctx, "Failed to decode JSON response for crypto symbols", "error", err, "api_url", apiUrl)
-		http.Error(w, "Failed to decode JSON", http.StatusInternalServerError)
+		Logger.ErrorContext(ctx, "Fetching crypto symbols failed", "provider", cryptoProvider.Name(), "error", err)
+		writeProviderError(w, err)
 		return
 	}
-	Logger.InfoContext(ctx, "JSON decoding complete for crypto symbols response")
-
-	var symbols []coinData
-	for _, coin := range cryptoData {
-		if symbol, ok := coin["symbol"].(string); ok {
-			if id, ok := coin["id"].(string); ok {
-				if name, ok := coin["name"].(string); ok {
-					symbols = append(symbols, coinData{Symbol: symbol, Name: name, Id: id})
-				} else {
-					Logger.WarnContext(ctx, "Coin data missing 'name' field, skipping coin", "coin_symbol", symbol)
-				}
-			} else {
-				Logger.WarnContext(ctx, "Coin data missing 'id' field, skipping coin", "coin_symbol", symbol)
-			}
-		} else {
-			Logger.WarnContext(ctx, "Coin data missing 'symbol' field, skipping record")
-		}
-	}
-	Logger.InfoContext(ctx, "Processed crypto data", "total_coins", len(cryptoData), "valid_symbols_extracted", len(symbols))
 
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(symbols)
@@ -432,6 +222,7 @@ func getCryptoData(w http.ResponseWriter, r *http.Request) {
 	span.SetAttributes(
 		attribute.String("http.method", r.Method),
 		attribute.String("http.target", r.URL.Path),
+		attribute.String("provider", cryptoProvider.Name()),
 	)
 	span.AddEvent("Handler execution started")
 
@@ -448,91 +239,49 @@ func getCryptoData(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Crypto symbol is required", http.StatusBadRequest)
 		return
 	}
-	Logger.InfoContext(ctx, "Retrieving crypto data for symbol", "symbol", symbol)
-
-	apiUrl := fmt.Sprintf("https://api.coingecko.com/api/v3/coins/markets?vs_currency=usd&order=market_cap_desc&per_page=100&page=1&sparkline=false&price_change_percentage=24h&ids=%s", symbol)
-
-	_, apiCallSpan := tracer.Start(ctx, "coingecko.COIN_DATA")
-	apiCallSpan.SetAttributes(
-		attribute.String("http.url", apiUrl),
-		attribute.String("http.method", "GET"),
-		attribute.String("api.name", "coingecko"),
-		attribute.String("api.operation", "COIN_DATA"),
-		attribute.String("crypto_symbol", symbol),
-	)
-	defer apiCallSpan.End()
-
-	apiCallStartTime := time.Now()
-	response, err := http.Get(apiUrl)
-	apiCallDuration := time.Since(apiCallStartTime).Seconds()
-
-	// Log external API call completion
-	Logger.InfoContext(ctx, "External API call completed", "url", apiUrl, "duration_sec", apiCallDuration, "error_present", err != nil)
-
-	externalAPICallDuration.Record(ctx, apiCallDuration, metric.WithAttributes(
-		attribute.String("api.name", "coingecko_api"),
-		attribute.String("api.operation", "LISTED_COINS"), // This might be COIN_DATA, depending on what metric name makes sense
-		attribute.Bool("api.error", err != nil),
-		attribute.String("Trace ID", span.SpanContext().TraceID().String()),
-		attribute.String("Span ID", apiCallSpan.SpanContext().SpanID().String())))
-
-	if err != nil {
-		apiCallSpan.SetStatus(codes.Error, fmt.Sprintf("HTTP GET failed: %v", err))
-		apiCallSpan.RecordError(err)
-
-		span.SetStatus(codes.Error, fmt.Sprintf("External API call failed: %v", err))
-		span.RecordError(err)
-
-		// Log error for HTTP GET
-		Logger.ErrorContext(ctx, "HTTP GET to Coingecko for crypto data failed", "error", err, "api_url", apiUrl, "symbol", symbol)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	var v Validator
+	v.CryptoID("symbol", symbol)
+	if !v.Valid() {
+		recordValidationFailure(span, v.Errors)
+		writeValidationError(w, v.Errors)
 		return
 	}
-	defer response.Body.Close()
+	Logger.InfoContext(ctx, "Retrieving crypto data for symbol", "symbol", symbol)
 
-	apiCallSpan.SetAttributes(
-		attribute.Int("http.status_code", response.StatusCode),
-		attribute.String("http.response_content_type", response.Header.Get("Content-Type")),
-	)
-	if response.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(response.Body)                          // Read body for error context
-		response.Body = io.NopCloser(strings.NewReader(string(bodyBytes))) // Restore body for later
-		errorMsg := fmt.Sprintf("API returned non-OK status: %d, body: %s", response.StatusCode, bodyBytes)
-
-		apiCallSpan.SetStatus(codes.Error, errorMsg)
-		span.SetStatus(codes.Error, errorMsg)
-		// Log error for non-OK status
-		Logger.ErrorContext(ctx, "Coingecko returned non-OK status for crypto data",
-			"status_code", response.StatusCode,
-			"response_body", string(bodyBytes),
-			"api_url", apiUrl,
-			"symbol", symbol)
-		http.Error(w, errorMsg, response.StatusCode)
+	req, ok := readQuoteRequest(w, r, span)
+	if !ok {
 		return
 	}
-	apiCallSpan.SetStatus(codes.Ok, "API call successful")
-	Logger.InfoContext(ctx, "Coingecko API call successful for crypto data", "api_url", apiUrl, "status_code", response.StatusCode, "symbol", symbol)
-
-	_, responseSpan := tracer.Start(ctx, "processAPIresponse")
-	defer responseSpan.End()
-	responseSpan.AddEvent("Started decoding JSON")
-	Logger.InfoContext(ctx, "Starting JSON decoding for crypto data response", "symbol", symbol)
 
-	var cryptoData []map[string]interface{}
-	if err := json.NewDecoder(response.Body).Decode(&cryptoData); err != nil {
-		responseSpan.SetStatus(codes.Error, fmt.Sprintf("JSON read error: %v", err))
-		responseSpan.RecordError(err)
-		span.SetStatus(codes.Error, fmt.Sprintf("JSON decoding failed: %v", err))
+	// Without an interval or range the endpoint answers with the current
+	// market snapshot, as it always has.
+	var quote *Quote
+	var err error
+	if req.Series.Interval == "" && !req.Series.Bounded() {
+		quote, err = cryptoProvider.CoinQuote(ctx, symbol)
+	} else {
+		if req.Series.Interval == "" {
+			req.Series.Interval = "daily"
+		}
+		span.SetAttributes(attribute.String("series.interval", req.Series.Interval))
+		if req.Series.Interval == "daily" && req.Format != quoteFormatRaw {
+			quote, err = readDailyHistory(ctx, "CRYPTO", symbol, req.Series)
+		} else {
+			quote, err = cryptoProvider.CoinSeries(ctx, symbol, req.Series)
+		}
+	}
+	if err != nil {
+		span.SetStatus(codes.Error, fmt.Sprintf("External API call failed: %v", err))
 		span.RecordError(err)
-		// Log error for JSON decoding
-		Logger.ErrorContext(ctx, "Failed to decode JSON response for crypto data", "error", err, "symbol", symbol)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		Logger.ErrorContext(ctx, "Fetching crypto data failed", "provider", cryptoProvider.Name(), "error", err, "symbol", symbol)
+		writeProviderError(w, err)
 		return
 	}
-	Logger.InfoContext(ctx, "JSON decoding complete for crypto data response", "symbol", symbol, "data_items_count", len(cryptoData))
+	quote.trim(req.Series)
+	span.SetAttributes(attribute.Int("candles.count", len(quote.Candles)))
+	Logger.InfoContext(ctx, "JSON decoding complete for crypto data response", "symbol", symbol, "candles_count", len(quote.Candles))
 
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(cryptoData)
+	err = writeQuote(w, quote, req.Format)
 	if err != nil {
 		span.SetStatus(codes.Error, fmt.Sprintf("Failed to encode JSON response: %v", err))
 		span.RecordError(err)
@@ -583,8 +332,46 @@ func addToWatchlist(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	user, ok := authUserFromContext(ctx)
+	if !ok {
+		span.SetStatus(codes.Error, "Unauthenticated watchlist request")
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	span.SetAttributes(attribute.Int("user_id", user.ID))
+
 	Logger.InfoContext(ctx, "Request body decoded", "symbol", data.Symbol, "type", data.Type, "userId", data.UserId)
 
+	_, validateSpan := tracer.Start(ctx, "addToWatchList.validate_request")
+	var v Validator
+	// userId is optional; the item always goes on the caller's own watchlist.
+	if data.UserId < 0 {
+		v.Add("userId", "INVALID_VALUE", "userId must be a positive integer")
+	}
+	v.Symbol("symbol", data.Symbol)
+	v.OneOf("type", data.Type, watchlistTypes)
+	if data.Type == "CRYPTO" {
+		v.CryptoID("cryptoId", data.CryptoId)
+	}
+	if !v.Valid() {
+		recordValidationFailure(validateSpan, v.Errors)
+		validateSpan.End()
+		span.SetStatus(codes.Error, "Validation failed")
+		Logger.WarnContext(ctx, "Watchlist add validation failed", "symbol", data.Symbol, "type", data.Type, "invalidFields", len(v.Errors))
+		writeValidationError(w, v.Errors)
+		return
+	}
+	validateSpan.SetStatus(codes.Ok, "Request validated successfully")
+	validateSpan.End()
+
+	if data.UserId != 0 && data.UserId != user.ID {
+		span.SetStatus(codes.Error, "userId does not match authenticated user")
+		Logger.WarnContext(ctx, "Watchlist add for another user rejected", "userId", data.UserId, "authUserId", user.ID)
+		http.Error(w, "Cannot modify another user's watchlist", http.StatusForbidden)
+		return
+	}
+	data.UserId = user.ID
+
 	_, dbCallSpan := tracer.Start(ctx, "db_call_addToList")
 	dbCallSpan.SetAttributes(
 		attribute.String("db.table", "UserSymbols"),
@@ -693,6 +480,13 @@ func getWatchlist(w http.ResponseWriter, r *http.Request) {
 		attribute.String("Trace ID", span.SpanContext().TraceID().String()),
 		attribute.String("Span ID", span.SpanContext().SpanID().String())))
 
+	user, ok := authUserFromContext(ctx)
+	if !ok {
+		span.SetStatus(codes.Error, "Unauthenticated watchlist request")
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
 	userId := mux.Vars(r)["userId"]
 	if userId == "" {
 		span.SetStatus(codes.Error, "Missing userId in request for watchlist retrieval")
@@ -700,6 +494,12 @@ func getWatchlist(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "User ID is required", http.StatusBadRequest)
 		return
 	}
+	if userId != strconv.Itoa(user.ID) {
+		span.SetStatus(codes.Error, "userId does not match authenticated user")
+		Logger.WarnContext(ctx, "Watchlist read for another user rejected", "userId", userId, "authUserId", user.ID)
+		http.Error(w, "Cannot read another user's watchlist", http.StatusForbidden)
+		return
+	}
 	Logger.InfoContext(ctx, "Retrieving watchlist for user", "userId", userId)
 
 	var watchlist []UserSymbols
@@ -712,7 +512,7 @@ func getWatchlist(w http.ResponseWriter, r *http.Request) {
 		attribute.String("user_id", userId),
 	)
 	// Assuming DB is defined and connected
-	err := DB.Where("user_id = ?", userId).Find(&watchlist).Error
+	err := DB.Where("user_id = ?", user.ID).Find(&watchlist).Error
 	dbCallDuration := time.Since(startTime).Seconds()
 	dbCallSpan.End()
 
@@ -786,6 +586,13 @@ func removeFromWatchlist(w http.ResponseWriter, r *http.Request) {
 		attribute.String("Trace ID", span.SpanContext().TraceID().String()),
 		attribute.String("Span ID", span.SpanContext().SpanID().String())))
 
+	user, ok := authUserFromContext(ctx)
+	if !ok {
+		span.SetStatus(codes.Error, "Unauthenticated watchlist request")
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
 	userId := mux.Vars(r)["userId"]
 	symbol := mux.Vars(r)["symbol"]
 
@@ -795,6 +602,12 @@ func removeFromWatchlist(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "User ID and Symbol are required", http.StatusBadRequest)
 		return
 	}
+	if userId != strconv.Itoa(user.ID) {
+		span.SetStatus(codes.Error, "userId does not match authenticated user")
+		Logger.WarnContext(ctx, "Watchlist removal for another user rejected", "userId", userId, "authUserId", user.ID)
+		http.Error(w, "Cannot modify another user's watchlist", http.StatusForbidden)
+		return
+	}
 	Logger.InfoContext(ctx, "Attempting to remove item from watchlist", "userId", userId, "symbol", symbol)
 
 	startTime := time.Now()
@@ -805,7 +618,7 @@ func removeFromWatchlist(w http.ResponseWriter, r *http.Request) {
 		attribute.String("user_id", userId),
 		attribute.String("symbol_to_remove", symbol),
 	)
-	result := DB.Where("user_id = ? AND symbol = ?", userId, symbol).Delete(&UserSymbols{})
+	result := DB.Where("user_id = ? AND symbol = ?", user.ID, symbol).Delete(&UserSymbols{})
 	dbCallDuration := time.Since(startTime).Seconds()
 	dbCallSpan.End()
 
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	symbolSearchDefaultLimit = 20
+	symbolSearchMaxLimit     = 50
+	symbolSearchMaxQuery     = 50
+)
+
+// SymbolSearchResult is one match from either catalog. Type uses the
+// watchlist values, so a result can be added to the watchlist as is.
+type SymbolSearchResult struct {
+	Type      string  `json:"type"`
+	Symbol    string  `json:"symbol"`
+	Name      string  `json:"name"`
+	Exchange  string  `json:"exchange,omitempty"`
+	AssetType string  `json:"assetType,omitempty"`
+	CryptoID  string  `json:"cryptoId,omitempty"`
+	Score     float64 `json:"score"`
+}
+
+// escapeLike escapes the LIKE wildcards in user input.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// symbolScoreSQL ranks a row against the query: an exact symbol match first,
+// then symbol prefixes, name prefixes and name substrings, plus trigram
+// similarity when pg_trgm is available so misspelled names still match.
+func symbolScoreSQL(symbolExpr string) (score, where string) {
+	score = `(CASE WHEN ` + symbolExpr + ` = @symbol THEN 1.0
+		WHEN ` + symbolExpr + ` LIKE @symbol_prefix THEN 0.8
+		WHEN LOWER(name) LIKE @name_prefix THEN 0.6
+		WHEN LOWER(name) LIKE @name_contains THEN 0.4
+		ELSE 0 END)`
+	where = symbolExpr + ` LIKE @symbol_prefix OR LOWER(name) LIKE @name_contains`
+	if symbolSearchTrigram {
+		score += ` + 0.5 * GREATEST(similarity(LOWER(name), @name), similarity(` + symbolExpr + `, @symbol))`
+		where += ` OR LOWER(name) % @name OR ` + symbolExpr + ` % @symbol`
+	}
+	return score, where
+}
+
+func searchStockListings(ctx context.Context, q string, limit int) ([]SymbolSearchResult, error) {
+	score, where := symbolScoreSQL("UPPER(symbol)")
+	query := `SELECT 'STOCK' AS type, symbol, name, exchange, asset_type, ` + score + ` AS score
+		FROM stock_listings
+		WHERE status = 'Active' AND (` + where + `)
+		ORDER BY score DESC, LENGTH(symbol), symbol
+		LIMIT @limit`
+
+	results := []SymbolSearchResult{}
+	err := DB.WithContext(ctx).Raw(query, symbolSearchArgs(q, strings.ToUpper(q), limit)).Scan(&results).Error
+	return results, err
+}
+
+func searchCryptoListings(ctx context.Context, q string, limit int) ([]SymbolSearchResult, error) {
+	score, where := symbolScoreSQL("LOWER(symbol)")
+	query := `SELECT 'CRYPTO' AS type, UPPER(symbol) AS symbol, name, id AS crypto_id, ` + score + ` AS score
+		FROM crypto_listings
+		WHERE ` + where + `
+		ORDER BY score DESC, market_cap_rank ASC NULLS LAST, LENGTH(symbol), symbol
+		LIMIT @limit`
+
+	results := []SymbolSearchResult{}
+	err := DB.WithContext(ctx).Raw(query, symbolSearchArgs(q, strings.ToLower(q), limit)).Scan(&results).Error
+	return results, err
+}
+
+func symbolSearchArgs(q, symbol string, limit int) map[string]interface{} {
+	name := strings.ToLower(q)
+	return map[string]interface{}{
+		"symbol":        symbol,
+		"symbol_prefix": escapeLike(symbol) + "%",
+		"name":          name,
+		"name_prefix":   escapeLike(name) + "%",
+		"name_contains": "%" + escapeLike(name) + "%",
+		"limit":         limit,
+	}
+}
+
+func searchSymbols(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	ctx, span := tracer.Start(ctx, "searchSymbolsHandler")
+	defer span.End()
+
+	Logger.InfoContext(ctx, "Handler execution started", "method", r.Method, "target", r.URL.Path)
+
+	if httpRequestCount != nil {
+		httpRequestCount.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("endpoint", "/symbols/search"),
+			attribute.String("method", r.Method)))
+	}
+
+	query := r.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	searchType := strings.ToLower(query.Get("type"))
+	if searchType == "" {
+		searchType = "all"
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = symbolSearchDefaultLimit
+	}
+	if limit > symbolSearchMaxLimit {
+		limit = symbolSearchMaxLimit
+	}
+
+	var v Validator
+	if v.Required("q", q) && len(q) > symbolSearchMaxQuery {
+		v.Add("q", "TOO_LONG", fmt.Sprintf("q must be at most %d characters", symbolSearchMaxQuery))
+	}
+	v.OneOf("type", searchType, []string{"stock", "crypto", "all"})
+	if !v.Valid() {
+		recordValidationFailure(span, v.Errors)
+		writeValidationError(w, v.Errors)
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("search.type", searchType),
+		attribute.Int("search.query_length", len(q)),
+		attribute.Bool("search.trigram", symbolSearchTrigram),
+	)
+
+	results := []SymbolSearchResult{}
+	if searchType != "crypto" {
+		stocks, err := searchStockListings(ctx, q, limit)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Stock search failed")
+			Logger.ErrorContext(ctx, "Stock symbol search failed", "error", err)
+			http.Error(w, "Symbol search failed", http.StatusInternalServerError)
+			return
+		}
+		results = append(results, stocks...)
+	}
+	if searchType != "stock" {
+		coins, err := searchCryptoListings(ctx, q, limit)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Crypto search failed")
+			Logger.ErrorContext(ctx, "Crypto symbol search failed", "error", err)
+			http.Error(w, "Symbol search failed", http.StatusInternalServerError)
+			return
+		}
+		results = append(results, coins...)
+	}
+
+	// Each list is already ordered; merging keeps that order among equal
+	// scores.
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	span.SetAttributes(attribute.Int("search.results", len(results)))
+	span.SetStatus(codes.Ok, "Search complete")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+)
+
+// A catalog younger than SYMBOL_CACHE_TTL is served as is. Past that it is
+// still served while a background refresh runs, until it is older than
+// SYMBOL_CACHE_MAX_STALE; then callers wait for the upstream and only get the
+// stale copy if the upstream fails.
+var (
+	symbolCacheTTL          = getEnvDuration("SYMBOL_CACHE_TTL", 6*time.Hour)
+	symbolCacheMaxStale     = getEnvDuration("SYMBOL_CACHE_MAX_STALE", 7*24*time.Hour)
+	symbolCacheFetchTimeout = getEnvDuration("SYMBOL_CACHE_FETCH_TIMEOUT", 60*time.Second)
+)
+
+// Cache statuses, reported as the cache.status span attribute and on
+// app_symbol_cache_requests.
+const (
+	cacheStatusHit   = "hit"
+	cacheStatusMiss  = "miss"
+	cacheStatusStale = "stale"
+)
+
+// catalogCache holds one provider catalog in memory. Concurrent callers that
+// need the upstream share a single fetch.
+type catalogCache[T any] struct {
+	name  string
+	load  func(ctx context.Context) ([]T, error)
+	group singleflight.Group
+
+	refreshing atomic.Bool
+
+	mu        sync.RWMutex
+	items     []T
+	fetchedAt time.Time
+}
+
+func newCatalogCache[T any](name string, load func(ctx context.Context) ([]T, error)) *catalogCache[T] {
+	return &catalogCache[T]{name: name, load: load}
+}
+
+func (c *catalogCache[T]) snapshot() ([]T, time.Time) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.items, c.fetchedAt
+}
+
+// fetch loads the catalog from the upstream, sharing the call with any other
+// caller already waiting for it. The load runs on a context detached from the
+// caller, so one client going away does not fail the fetch for the others.
+func (c *catalogCache[T]) fetch(ctx context.Context) ([]T, error) {
+	result, err, shared := c.group.Do(c.name, func() (interface{}, error) {
+		loadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), symbolCacheFetchTimeout)
+		defer cancel()
+
+		items, err := c.load(loadCtx)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		c.items, c.fetchedAt = items, time.Now()
+		c.mu.Unlock()
+		return items, nil
+	})
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("cache.fetch_shared", shared))
+	if err != nil {
+		return nil, err
+	}
+	return result.([]T), nil
+}
+
+// refreshInBackground starts a fetch unless one is already running. The
+// refresh gets its own trace, linked to the request that triggered it.
+func (c *catalogCache[T]) refreshInBackground(ctx context.Context) {
+	if !c.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	link := trace.LinkFromContext(ctx)
+	go func() {
+		defer c.refreshing.Store(false)
+
+		tracer := otel.Tracer("stock-tracker-app-tracer")
+		refreshCtx, span := tracer.Start(context.Background(), "symbolCache.refresh",
+			trace.WithLinks(link),
+			trace.WithAttributes(attribute.String("cache.name", c.name)),
+		)
+		defer span.End()
+
+		if _, err := c.fetch(refreshCtx); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Refresh failed")
+			Logger.WarnContext(refreshCtx, "Background symbol catalog refresh failed", "cache", c.name, "error", err)
+			return
+		}
+		span.SetStatus(codes.Ok, "Catalog refreshed")
+	}()
+}
+
+// Get returns the catalog, fetching it when there is no usable copy. The
+// outcome is recorded as cache.status on the span in ctx.
+func (c *catalogCache[T]) Get(ctx context.Context) ([]T, error) {
+	items, fetchedAt := c.snapshot()
+	loaded := !fetchedAt.IsZero()
+	age := time.Since(fetchedAt)
+
+	var status string
+	var err error
+	switch {
+	case loaded && age < symbolCacheTTL:
+		status = cacheStatusHit
+	case loaded && age < symbolCacheMaxStale:
+		status = cacheStatusStale
+		c.refreshInBackground(ctx)
+	default:
+		status = cacheStatusMiss
+		var fresh []T
+		if fresh, err = c.fetch(ctx); err == nil {
+			items, age = fresh, 0
+		} else if loaded {
+			status = cacheStatusStale
+			Logger.WarnContext(ctx, "Serving stale symbol catalog after upstream failure",
+				"cache", c.name, "age_sec", age.Seconds(), "error", err)
+			err = nil
+		}
+	}
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attribute.String("cache.name", c.name),
+		attribute.String("cache.status", status),
+	)
+	if err == nil {
+		span.SetAttributes(attribute.Float64("cache.age_sec", age.Seconds()))
+	}
+	if symbolCacheRequests != nil {
+		symbolCacheRequests.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("cache", c.name),
+			attribute.String("status", status),
+		))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+var (
+	stockSymbolCache  *catalogCache[stockData]
+	cryptoSymbolCache *catalogCache[coinData]
+)
+
+func initSymbolCaches() {
+	stockSymbolCache = newCatalogCache("stock_symbols", func(ctx context.Context) ([]stockData, error) {
+		listings, err := stockProvider.ListSymbols(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var symbols []stockData
+		for _, l := range listings {
+			if l.Status == "Active" {
+				symbols = append(symbols, stockData{l.Symbol, l.Name})
+			}
+		}
+		return symbols, nil
+	})
+	cryptoSymbolCache = newCatalogCache("crypto_symbols", func(ctx context.Context) ([]coinData, error) {
+		return cryptoProvider.ListCoins(ctx)
+	})
+}
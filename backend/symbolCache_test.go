@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// countingLoad is a catalog upstream that counts its calls and returns
+// whatever items and err hold at the time.
+type countingLoad struct {
+	calls   atomic.Int32
+	mu      sync.Mutex
+	items   []string
+	err     error
+	release chan struct{}
+	called  chan struct{}
+}
+
+func newCountingLoad(items ...string) *countingLoad {
+	return &countingLoad{items: items, called: make(chan struct{}, 16)}
+}
+
+func (l *countingLoad) load(ctx context.Context) ([]string, error) {
+	l.calls.Add(1)
+	if l.release != nil {
+		<-l.release
+	}
+	l.mu.Lock()
+	items, err := l.items, l.err
+	l.mu.Unlock()
+	l.called <- struct{}{}
+	return items, err
+}
+
+func (l *countingLoad) set(items []string, err error) {
+	l.mu.Lock()
+	l.items, l.err = items, err
+	l.mu.Unlock()
+}
+
+// getWithStatus calls Get inside a span and returns the cache.status it
+// recorded.
+func getWithStatus(t *testing.T, cache *catalogCache[string]) ([]string, string, error) {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	ctx, span := provider.Tracer("test").Start(context.Background(), "get")
+	items, err := cache.Get(ctx)
+	span.End()
+
+	for _, attr := range recorder.Ended()[0].Attributes() {
+		if attr.Key == attribute.Key("cache.status") {
+			return items, attr.Value.AsString(), err
+		}
+	}
+	t.Fatal("span has no cache.status")
+	return nil, "", nil
+}
+
+// age makes the cached copy look fetched d ago.
+func (c *catalogCache[T]) age(d time.Duration) {
+	c.mu.Lock()
+	c.fetchedAt = time.Now().Add(-d)
+	c.mu.Unlock()
+}
+
+func TestCatalogCacheSharesConcurrentFetches(t *testing.T) {
+	upstream := newCountingLoad("IBM")
+	upstream.release = make(chan struct{})
+	cache := newCatalogCache("test", upstream.load)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			items, err := cache.Get(context.Background())
+			if err == nil && len(items) != 1 {
+				err = errors.New("wrong catalog")
+			}
+			errs <- err
+		}()
+	}
+	// Let the callers pile up behind the first fetch before it returns.
+	time.Sleep(50 * time.Millisecond)
+	close(upstream.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if calls := upstream.calls.Load(); calls != 1 {
+		t.Errorf("upstream called %d times, want 1", calls)
+	}
+}
+
+func TestCatalogCacheWindows(t *testing.T) {
+	setVar(t, &symbolCacheTTL, time.Hour)
+	setVar(t, &symbolCacheMaxStale, 24*time.Hour)
+
+	upstream := newCountingLoad("IBM")
+	cache := newCatalogCache("test", upstream.load)
+
+	if _, status, err := getWithStatus(t, cache); err != nil || status != cacheStatusMiss {
+		t.Fatalf("first get: status %q, err %v, want a miss", status, err)
+	}
+	<-upstream.called
+
+	if _, status, _ := getWithStatus(t, cache); status != cacheStatusHit {
+		t.Errorf("fresh copy: status %q, want a hit", status)
+	}
+	if calls := upstream.calls.Load(); calls != 1 {
+		t.Errorf("fresh copy: upstream called %d times, want 1", calls)
+	}
+
+	// Past the TTL the old copy is served at once and refreshed behind it.
+	upstream.set([]string{"IBM", "MSFT"}, nil)
+	cache.age(2 * time.Hour)
+	items, status, err := getWithStatus(t, cache)
+	if err != nil || status != cacheStatusStale || len(items) != 1 {
+		t.Errorf("stale copy: got %v, status %q, err %v, want the old catalog as stale", items, status, err)
+	}
+	select {
+	case <-upstream.called:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stale copy did not trigger a refresh")
+	}
+	for cache.refreshing.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	if items, status, _ := getWithStatus(t, cache); status != cacheStatusHit || len(items) != 2 {
+		t.Errorf("after refresh: got %v, status %q, want the new catalog as a hit", items, status)
+	}
+
+	// Past the max staleness callers wait for the upstream.
+	upstream.set([]string{"IBM", "MSFT", "AAPL"}, nil)
+	cache.age(48 * time.Hour)
+	if items, status, _ := getWithStatus(t, cache); status != cacheStatusMiss || len(items) != 3 {
+		t.Errorf("expired copy: got %v, status %q, want the new catalog as a miss", items, status)
+	}
+}
+
+func TestCatalogCacheFallsBackToStaleCopy(t *testing.T) {
+	setVar(t, &symbolCacheTTL, time.Hour)
+	setVar(t, &symbolCacheMaxStale, 24*time.Hour)
+
+	upstream := newCountingLoad("IBM")
+	cache := newCatalogCache("test", upstream.load)
+	if _, err := cache.Get(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	upstream.set(nil, errors.New("upstream down"))
+	cache.age(48 * time.Hour)
+	items, status, err := getWithStatus(t, cache)
+	if err != nil {
+		t.Fatalf("err = %v, want the stale copy", err)
+	}
+	if status != cacheStatusStale || len(items) != 1 || items[0] != "IBM" {
+		t.Errorf("got %v, status %q, want the stale catalog", items, status)
+	}
+}
+
+func TestCatalogCacheMissWithoutCopy(t *testing.T) {
+	upstream := newCountingLoad()
+	upstream.set(nil, errors.New("upstream down"))
+	cache := newCatalogCache("test", upstream.load)
+
+	if _, status, err := getWithStatus(t, cache); err == nil || status != cacheStatusMiss {
+		t.Errorf("status %q, err %v, want a failed miss", status, err)
+	}
+}
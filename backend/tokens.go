@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// generateOpaqueToken returns a random URL-safe token for the client and the
+// SHA-256 hash that is stored in its place.
+func generateOpaqueToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", fmt.Errorf("error generating token: %w", err)
+	}
+	raw := base64.RawURLEncoding.EncodeToString(buf)
+	return raw, hashOpaqueToken(raw), nil
+}
+
+func hashOpaqueToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateRandomID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("error generating id: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
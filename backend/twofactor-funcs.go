@@ -0,0 +1,546 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+var (
+	twoFactorChallengeTTL = getEnvDuration("TWO_FACTOR_CHALLENGE_TTL", 5*time.Minute)
+	twoFactorMaxAttempts  = getEnvInt("TWO_FACTOR_MAX_ATTEMPTS", 5)
+)
+
+const recoveryCodeCount = 10
+
+var (
+	errInvalidChallenge    = errors.New("invalid or expired two-factor challenge")
+	errInvalidSecondFactor = errors.New("invalid two-factor code")
+)
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type TwoFactorLoginRequest struct {
+	Challenge    string `json:"challenge"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+type TwoFactorEnrollResponse struct {
+	Success    bool   `json:"success"`
+	Message    string `json:"message"`
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauthUri"`
+}
+
+type RecoveryCodesResponse struct {
+	Success       bool     `json:"success"`
+	Message       string   `json:"message"`
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// generateRecoveryCodes returns codes formatted for the user and the hashes
+// stored in their place. Each code carries 80 random bits, so a plain
+// SHA-256 is enough to protect them at rest.
+func generateRecoveryCodes() ([]string, []string, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		buf := make([]byte, 10)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, fmt.Errorf("error generating recovery code: %w", err)
+		}
+		raw := strings.ToLower(encoding.EncodeToString(buf))
+		codes = append(codes, raw[0:4]+"-"+raw[4:8]+"-"+raw[8:12]+"-"+raw[12:16])
+		hashes = append(hashes, hashOpaqueToken(raw))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+func createTwoFactorChallenge(ctx context.Context, user *User, r *http.Request) (string, error) {
+	raw, hash, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	err = DB.WithContext(ctx).Create(&TwoFactorChallenge{
+		UserID:     user.ID,
+		TokenHash:  hash,
+		ExpiresAt:  time.Now().UTC().Add(twoFactorChallengeTTL),
+		RemoteAddr: r.RemoteAddr,
+	}).Error
+	if err != nil {
+		return "", fmt.Errorf("error storing two-factor challenge: %w", err)
+	}
+	return raw, nil
+}
+
+// verifySecondFactor accepts either a TOTP code or an unused recovery code.
+// It returns which factor was used.
+func verifySecondFactor(ctx context.Context, user *User, code, recoveryCode string) (string, error) {
+	if code != "" {
+		step, ok := validateTOTP(user.TOTPSecret, code, time.Now())
+		if !ok || step <= user.TOTPLastStep {
+			return "totp", errInvalidSecondFactor
+		}
+		// Guarding on the previous step stops the same code being used twice
+		// by concurrent requests.
+		result := DB.WithContext(ctx).Model(&User{}).
+			Where("id = ? AND totp_last_step < ?", user.ID, step).
+			Update("totp_last_step", step)
+		if result.Error != nil {
+			return "totp", result.Error
+		}
+		if result.RowsAffected == 0 {
+			return "totp", errInvalidSecondFactor
+		}
+		return "totp", nil
+	}
+
+	if recoveryCode != "" {
+		result := DB.WithContext(ctx).Model(&RecoveryCode{}).
+			Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, hashOpaqueToken(normalizeRecoveryCode(recoveryCode))).
+			Update("used_at", time.Now().UTC())
+		if result.Error != nil {
+			return "recovery_code", result.Error
+		}
+		if result.RowsAffected == 0 {
+			return "recovery_code", errInvalidSecondFactor
+		}
+		return "recovery_code", nil
+	}
+
+	return "", errInvalidSecondFactor
+}
+
+func enrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+
+	ctx, span := tracer.Start(ctx, "auth.2fa.enroll",
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", "/users/2fa/enroll"),
+			attribute.String("component", "auth_service"),
+			attribute.String("operation", "two_factor_enroll"),
+		),
+	)
+	defer span.End()
+
+	if httpRequestCount != nil {
+		httpRequestCount.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("endpoint", "2fa_enroll"),
+			attribute.String("method", r.Method),
+			attribute.String("component", "auth_service"),
+		))
+	}
+
+	user, ok := authUserFromContext(ctx)
+	if !ok {
+		span.SetStatus(codes.Error, "Unauthenticated request")
+		writeAuthError(w, http.StatusUnauthorized, "Authentication required", "MISSING_TOKEN")
+		return
+	}
+	span.SetAttributes(attribute.Int("user_id", user.ID))
+
+	if user.TwoFactorEnabledAt != nil {
+		span.SetStatus(codes.Error, "Two-factor already enabled")
+		writeAuthError(w, http.StatusConflict, "Two-factor authentication is already enabled", "TWO_FACTOR_ALREADY_ENABLED")
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err == nil {
+		err = DB.WithContext(ctx).Model(user).Update("totp_pending_secret", secret).Error
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Enrollment failed")
+		Logger.ErrorContext(ctx, "Two-factor enrollment failed",
+			slog.Int("user_id", user.ID),
+			slog.String("error", err.Error()),
+		)
+		writeAuthError(w, http.StatusInternalServerError, "Two-factor enrollment failed", "DB_ERROR")
+		return
+	}
+
+	span.SetStatus(codes.Ok, "Two-factor enrollment started")
+	Logger.InfoContext(ctx, "Two-factor enrollment started",
+		slog.Int("user_id", user.ID),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TwoFactorEnrollResponse{
+		Success:    true,
+		Message:    "Scan the URI with an authenticator app and confirm with a code",
+		Secret:     secret,
+		OTPAuthURI: totpURI(secret, user.Email),
+	})
+}
+
+func confirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+
+	ctx, span := tracer.Start(ctx, "auth.2fa.confirm",
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", "/users/2fa/confirm"),
+			attribute.String("component", "auth_service"),
+			attribute.String("operation", "two_factor_confirm"),
+		),
+	)
+	defer span.End()
+
+	if httpRequestCount != nil {
+		httpRequestCount.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("endpoint", "2fa_confirm"),
+			attribute.String("method", r.Method),
+			attribute.String("component", "auth_service"),
+		))
+	}
+
+	user, ok := authUserFromContext(ctx)
+	if !ok {
+		span.SetStatus(codes.Error, "Unauthenticated request")
+		writeAuthError(w, http.StatusUnauthorized, "Authentication required", "MISSING_TOKEN")
+		return
+	}
+	span.SetAttributes(attribute.Int("user_id", user.ID))
+
+	var req TwoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		span.SetStatus(codes.Error, "Missing code")
+		writeAuthError(w, http.StatusBadRequest, "Code is required", "MISSING_CODE")
+		return
+	}
+
+	if user.TOTPPendingSecret == "" {
+		span.SetStatus(codes.Error, "No pending enrollment")
+		writeAuthError(w, http.StatusConflict, "Start enrollment before confirming", "NO_PENDING_ENROLLMENT")
+		return
+	}
+
+	step, valid := validateTOTP(user.TOTPPendingSecret, req.Code, time.Now())
+	if !valid {
+		span.SetStatus(codes.Error, "Invalid code")
+		Logger.InfoContext(ctx, "Two-factor confirmation failed - invalid code",
+			slog.Int("user_id", user.ID),
+		)
+		writeAuthError(w, http.StatusBadRequest, "Invalid code", "INVALID_CODE")
+		return
+	}
+
+	recoveryCodes, hashes, err := generateRecoveryCodes()
+	if err == nil {
+		err = DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(user).Updates(map[string]interface{}{
+				"totp_secret":           user.TOTPPendingSecret,
+				"totp_pending_secret":   "",
+				"totp_last_step":        step,
+				"two_factor_enabled_at": time.Now().UTC(),
+			}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("user_id = ?", user.ID).Delete(&RecoveryCode{}).Error; err != nil {
+				return err
+			}
+			rows := make([]RecoveryCode, 0, len(hashes))
+			for _, hash := range hashes {
+				rows = append(rows, RecoveryCode{UserID: user.ID, CodeHash: hash})
+			}
+			return tx.Create(&rows).Error
+		})
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Confirmation failed")
+		Logger.ErrorContext(ctx, "Two-factor confirmation failed",
+			slog.Int("user_id", user.ID),
+			slog.String("error", err.Error()),
+		)
+		writeAuthError(w, http.StatusInternalServerError, "Two-factor confirmation failed", "DB_ERROR")
+		return
+	}
+
+	span.SetStatus(codes.Ok, "Two-factor enabled")
+	Logger.InfoContext(ctx, "Two-factor authentication enabled",
+		slog.Int("user_id", user.ID),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{
+		Success:       true,
+		Message:       "Two-factor authentication enabled. Store these recovery codes somewhere safe; they are shown only once",
+		RecoveryCodes: recoveryCodes,
+	})
+}
+
+// loginTwoFactor exchanges a challenge from loginUser plus a TOTP or
+// recovery code for the session tokens.
+func loginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+	startTime := time.Now()
+
+	ctx, span := tracer.Start(ctx, "auth.login.2fa",
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", "/users/login/2fa"),
+			attribute.String("component", "auth_service"),
+			attribute.String("operation", "user_login_2fa"),
+			attribute.String("user_agent", r.UserAgent()),
+			attribute.String("remote_addr", r.RemoteAddr),
+		),
+	)
+	defer span.End()
+
+	baseAttrs := []attribute.KeyValue{
+		attribute.String("endpoint", "login_2fa"),
+		attribute.String("method", r.Method),
+		attribute.String("component", "auth_service"),
+	}
+
+	if httpRequestCount != nil {
+		httpRequestCount.Add(ctx, 1, metric.WithAttributes(baseAttrs...))
+	}
+
+	outcome := "error"
+	auditUserID := 0
+	defer func() {
+		if loginAttempts != nil {
+			loginAttempts.Add(ctx, 1, metric.WithAttributes(append(baseAttrs,
+				attribute.String("outcome", outcome),
+			)...))
+		}
+		recordAuthEvent(ctx, r, auditUserID, auditLoginTwoFactor, outcome, nil)
+	}()
+
+	var req TwoFactorLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Challenge == "" || (req.Code == "" && req.RecoveryCode == "") {
+		outcome = "invalid_request"
+		span.SetStatus(codes.Error, "Missing required fields")
+		writeAuthError(w, http.StatusBadRequest, "Challenge and code or recovery code are required", "MISSING_FIELDS")
+		return
+	}
+
+	var challenge TwoFactorChallenge
+	err := DB.WithContext(ctx).
+		Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashOpaqueToken(req.Challenge), time.Now().UTC()).
+		First(&challenge).Error
+	auditUserID = challenge.UserID
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = errInvalidChallenge
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Challenge rejected")
+		if errors.Is(err, errInvalidChallenge) {
+			outcome = "invalid_challenge"
+			Logger.InfoContext(ctx, "Two-factor login rejected - invalid or expired challenge")
+			writeAuthError(w, http.StatusUnauthorized, "Invalid or expired challenge, please log in again", "INVALID_CHALLENGE")
+			return
+		}
+		Logger.ErrorContext(ctx, "Database error during two-factor login",
+			slog.String("error", err.Error()),
+		)
+		writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+		return
+	}
+
+	var user User
+	if err := DB.WithContext(ctx).First(&user, "id = ?", challenge.UserID).Error; err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "User lookup failed")
+		writeAuthError(w, http.StatusUnauthorized, "Invalid or expired challenge, please log in again", "INVALID_CHALLENGE")
+		return
+	}
+	span.SetAttributes(attribute.Int("user_id", user.ID))
+
+	if user.DisabledAt != nil {
+		outcome = "account_disabled"
+		span.SetStatus(codes.Error, "Account disabled")
+		Logger.WarnContext(ctx, "Two-factor login blocked - account disabled",
+			slog.Int("user_id", user.ID),
+			slog.String("disabled_reason", user.DisabledReason),
+		)
+		writeAuthError(w, http.StatusForbidden, "This account has been disabled", "ACCOUNT_DISABLED")
+		return
+	}
+
+	// Second factor attempts count towards the same throttle and lockout as
+	// password attempts.
+	throttleKey := normalizeLoginEmail(user.Email)
+	if allowed, reason, retryAfter := loginLimiter.allow(throttleKey, remoteHost(r.RemoteAddr)); !allowed {
+		retrySeconds := int(math.Ceil(retryAfter.Seconds()))
+		span.AddEvent("login.throttled", trace.WithAttributes(
+			attribute.String("throttle.reason", reason),
+			attribute.Int("throttle.retry_after_seconds", retrySeconds),
+		))
+		span.SetStatus(codes.Error, "Login throttled")
+
+		Logger.WarnContext(ctx, "Two-factor login throttled",
+			slog.Int("user_id", user.ID),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.String("reason", reason),
+			slog.Int("retry_after_seconds", retrySeconds),
+		)
+
+		if reason == throttleReasonLocked {
+			outcome = "locked_out"
+		} else {
+			outcome = "rate_limited"
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retrySeconds))
+		writeAuthError(w, http.StatusTooManyRequests, "Too many login attempts, try again later", strings.ToUpper(reason))
+		return
+	}
+
+	// Taking the attempt before checking the code keeps concurrent guesses
+	// within twoFactorMaxAttempts.
+	result := DB.WithContext(ctx).Model(&TwoFactorChallenge{}).
+		Where("id = ? AND used_at IS NULL AND attempts < ?", challenge.ID, twoFactorMaxAttempts).
+		Update("attempts", gorm.Expr("attempts + 1"))
+	if result.Error != nil {
+		span.RecordError(result.Error)
+		span.SetStatus(codes.Error, "Database error")
+		Logger.ErrorContext(ctx, "Database error during two-factor login",
+			slog.String("error", result.Error.Error()),
+		)
+		writeAuthError(w, http.StatusInternalServerError, "Database error", "DB_ERROR")
+		return
+	}
+	if result.RowsAffected == 0 {
+		outcome = "invalid_challenge"
+		span.SetStatus(codes.Error, "Challenge attempts exhausted")
+		Logger.InfoContext(ctx, "Two-factor login rejected - challenge attempts exhausted",
+			slog.Int("user_id", user.ID),
+		)
+		writeAuthError(w, http.StatusUnauthorized, "Invalid or expired challenge, please log in again", "INVALID_CHALLENGE")
+		return
+	}
+
+	verifyCtx, verifySpan := tracer.Start(ctx, "auth.login.2fa.verify_code",
+		trace.WithAttributes(
+			attribute.String("operation", "second_factor_verification"),
+			attribute.Int("user_id", user.ID),
+		),
+	)
+	factor, err := verifySecondFactor(verifyCtx, &user, req.Code, req.RecoveryCode)
+	verifySpan.SetAttributes(attribute.String("auth.second_factor", factor))
+	if err != nil {
+		verifySpan.RecordError(err)
+		verifySpan.SetStatus(codes.Error, "Second factor rejected")
+		verifySpan.End()
+		span.SetStatus(codes.Error, "Invalid second factor")
+
+		outcome = "invalid_second_factor"
+		Logger.InfoContext(ctx, "Two-factor login failed - invalid code",
+			slog.Int("user_id", user.ID),
+			slog.String("factor", factor),
+			slog.Int("attempt", challenge.Attempts+1),
+		)
+
+		if locked, until := loginLimiter.recordFailure(throttleKey); locked {
+			span.AddEvent("login.account_locked", trace.WithAttributes(
+				attribute.String("lockout.until", until.UTC().Format(time.RFC3339)),
+				attribute.Int("lockout.threshold", loginLockoutThreshold),
+			))
+			recordAuthEvent(ctx, r, user.ID, auditLockout, "locked", map[string]interface{}{
+				"locked_until": until.UTC().Format(time.RFC3339),
+				"threshold":    loginLockoutThreshold,
+			})
+			if loginLockouts != nil {
+				loginLockouts.Add(ctx, 1, metric.WithAttributes(
+					attribute.String("endpoint", "login_2fa"),
+					attribute.String("component", "auth_service"),
+				))
+			}
+			Logger.WarnContext(ctx, "Account temporarily locked after repeated two-factor failures",
+				slog.Int("user_id", user.ID),
+				slog.String("remote_addr", r.RemoteAddr),
+				slog.Time("locked_until", until),
+			)
+		}
+		writeAuthError(w, http.StatusUnauthorized, "Invalid code", "INVALID_CODE")
+		return
+	}
+	verifySpan.SetStatus(codes.Ok, "Second factor verified")
+	verifySpan.End()
+
+	result = DB.WithContext(ctx).Model(&TwoFactorChallenge{}).
+		Where("id = ? AND used_at IS NULL", challenge.ID).
+		Update("used_at", time.Now().UTC())
+	if result.Error != nil || result.RowsAffected == 0 {
+		outcome = "invalid_challenge"
+		span.SetStatus(codes.Error, "Challenge already used")
+		writeAuthError(w, http.StatusUnauthorized, "Invalid or expired challenge, please log in again", "INVALID_CHALLENGE")
+		return
+	}
+
+	token, refreshToken, err := issueSession(ctx, &user, r)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Token generation failed")
+		Logger.ErrorContext(ctx, "JWT generation failed",
+			slog.Int("user_id", user.ID),
+			slog.String("error", err.Error()),
+		)
+		writeAuthError(w, http.StatusInternalServerError, "Token generation failed", "TOKEN_GENERATION_FAILED")
+		return
+	}
+
+	loginLimiter.recordSuccess(normalizeLoginEmail(user.Email))
+	outcome = "success"
+
+	if authDuration != nil {
+		authDuration.Record(ctx, time.Since(startTime).Seconds(),
+			metric.WithAttributes(append(baseAttrs,
+				attribute.String("status", "success"),
+				attribute.Int("user_id", user.ID),
+			)...),
+		)
+	}
+
+	span.SetStatus(codes.Ok, "Login successful")
+	Logger.InfoContext(ctx, "Two-factor login successful",
+		slog.Int("user_id", user.ID),
+		slog.String("factor", factor),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AuthResponse{
+		Success:      true,
+		Message:      "Login successful",
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(jwtTTL.Seconds()),
+		User:         &user,
+	})
+}
@@ -4,7 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"go.opentelemetry.io/otel"
@@ -29,22 +32,23 @@ type RegisterRequest struct {
 }
 
 type AuthResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
-	Token   string `json:"token,omitempty"`
-	User    *User  `json:"user,omitempty"`
+	Success           bool   `json:"success"`
+	Message           string `json:"message"`
+	Token             string `json:"token,omitempty"`
+	RefreshToken      string `json:"refreshToken,omitempty"`
+	ExpiresIn         int64  `json:"expiresIn,omitempty"`
+	TwoFactorRequired bool   `json:"twoFactorRequired,omitempty"`
+	Challenge         string `json:"challenge,omitempty"`
+	User              *User  `json:"user,omitempty"`
 }
 
 type ErrorResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
-	Error   string `json:"error,omitempty"`
+	Success bool         `json:"success"`
+	Message string       `json:"message"`
+	Error   string       `json:"error,omitempty"`
+	Fields  []FieldError `json:"fields,omitempty"`
 }
 
-func generateJWT(user *User) (string, error)              { return "dummy-jwt", nil }
-func hashPassword(password string) (string, error)        { return "hashed-password", nil }
-func verifyPassword(hashedPassword, password string) bool { return true }
-
 func loginUser(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("Login request received")
 	if DB == nil {
@@ -92,9 +96,21 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 		httpRequestCount.Add(ctx, 1, metric.WithAttributes(baseAttrs...))
 	}
 
-	if loginAttempts != nil {
-		loginAttempts.Add(ctx, 1, metric.WithAttributes(baseAttrs...))
-	}
+	// outcome is reported on loginAttempts and the audit trail once the
+	// handler returns. Throttled attempts are left out of the audit trail so
+	// a flood of them cannot fill the table; the lockout itself is recorded.
+	outcome := "error"
+	auditUserID := 0
+	defer func() {
+		if loginAttempts != nil {
+			loginAttempts.Add(ctx, 1, metric.WithAttributes(append(baseAttrs,
+				attribute.String("outcome", outcome),
+			)...))
+		}
+		if outcome != "rate_limited" && outcome != "locked_out" {
+			recordAuthEvent(ctx, r, auditUserID, auditLogin, outcome, nil)
+		}
+	}()
 
 	Logger.InfoContext(ctx, "Login attempt started",
 		slog.String("remote_addr", r.RemoteAddr),
@@ -119,6 +135,7 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 			slog.String("error", err.Error()),
 		)
 
+		outcome = "invalid_request"
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(ErrorResponse{
 			Success: false,
@@ -137,8 +154,11 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 		),
 	)
 
-	if loginReq.Email == "" || loginReq.Password == "" {
-		validateSpan.SetStatus(codes.Error, "Missing required fields")
+	var v Validator
+	v.Required("email", loginReq.Email)
+	v.Required("password", loginReq.Password)
+	if !v.Valid() {
+		recordValidationFailure(validateSpan, v.Errors)
 		validateSpan.End()
 		span.SetStatus(codes.Error, "Missing required fields")
 
@@ -148,15 +168,88 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 			slog.Bool("password_empty", loginReq.Password == ""),
 		)
 
-		w.WriteHeader(http.StatusBadRequest)
+		outcome = "invalid_request"
+		writeValidationError(w, v.Errors)
+		return
+	}
+	validateSpan.SetStatus(codes.Ok, "Request validated successfully")
+	validateSpan.End()
+
+	throttleKey := normalizeLoginEmail(loginReq.Email)
+	clientAddr := remoteHost(r.RemoteAddr)
+
+	if allowed, reason, retryAfter := loginLimiter.allow(throttleKey, clientAddr); !allowed {
+		retrySeconds := int(math.Ceil(retryAfter.Seconds()))
+		span.AddEvent("login.throttled", trace.WithAttributes(
+			attribute.String("throttle.reason", reason),
+			attribute.Int("throttle.retry_after_seconds", retrySeconds),
+		))
+		span.SetStatus(codes.Error, "Login throttled")
+
+		Logger.WarnContext(ctx, "Login throttled",
+			slog.String("email", loginReq.Email),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.String("reason", reason),
+			slog.Int("retry_after_seconds", retrySeconds),
+		)
+
+		if reason == throttleReasonLocked {
+			outcome = "locked_out"
+		} else {
+			outcome = "rate_limited"
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retrySeconds))
+		w.WriteHeader(http.StatusTooManyRequests)
 		json.NewEncoder(w).Encode(ErrorResponse{
 			Success: false,
-			Message: "Email and password are required",
+			Message: "Too many login attempts, try again later",
+			Error:   strings.ToUpper(reason),
 		})
 		return
 	}
-	validateSpan.SetStatus(codes.Ok, "Request validated successfully")
-	validateSpan.End()
+
+	if delay := loginLimiter.delay(throttleKey); delay > 0 {
+		span.AddEvent("login.progressive_delay", trace.WithAttributes(
+			attribute.Int64("throttle.delay_ms", delay.Milliseconds()),
+		))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			outcome = "cancelled"
+			return
+		}
+	}
+
+	// recordLoginFailure counts a failed credential check towards the
+	// account lockout and reports the lockout when it starts.
+	recordLoginFailure := func() {
+		outcome = "invalid_credentials"
+		locked, until := loginLimiter.recordFailure(throttleKey)
+		if !locked {
+			return
+		}
+
+		span.AddEvent("login.account_locked", trace.WithAttributes(
+			attribute.String("lockout.until", until.UTC().Format(time.RFC3339)),
+			attribute.Int("lockout.threshold", loginLockoutThreshold),
+		))
+		recordAuthEvent(ctx, r, auditUserID, auditLockout, "locked", map[string]interface{}{
+			"locked_until": until.UTC().Format(time.RFC3339),
+			"threshold":    loginLockoutThreshold,
+		})
+		if loginLockouts != nil {
+			loginLockouts.Add(ctx, 1, metric.WithAttributes(
+				attribute.String("endpoint", "login"),
+				attribute.String("component", "auth_service"),
+			))
+		}
+
+		Logger.WarnContext(ctx, "Account temporarily locked after repeated login failures",
+			slog.String("email", loginReq.Email),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.Time("locked_until", until),
+		)
+	}
 
 	var user User
 	dbStartTime := time.Now()
@@ -170,6 +263,7 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 
 	err := DB.WithContext(dbCtx).Where("email = ?", loginReq.Email).First(&user).Error
 	dbDuration := time.Since(dbStartTime)
+	auditUserID = user.ID
 
 	if dbQueryCount != nil {
 		dbQueryCount.Add(ctx, 1, metric.WithAttributes(append(baseAttrs,
@@ -192,6 +286,9 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 		span.RecordError(err)
 
 		if err == gorm.ErrRecordNotFound {
+			burnPasswordCheck(loginReq.Password)
+			recordLoginFailure()
+
 			Logger.InfoContext(ctx, "Login failed - user not found",
 				slog.String("email", loginReq.Email),
 				slog.Duration("db_duration", dbDuration),
@@ -233,10 +330,22 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 		),
 	)
 
+	if hashInfo, err := passwordHashInfo(user.Password); err == nil {
+		verifySpan.SetAttributes(
+			attribute.String("password.algorithm", passwordHashAlgorithm),
+			attribute.Int("password.memory_kib", int(hashInfo.Memory)),
+			attribute.Int("password.iterations", int(hashInfo.Iterations)),
+			attribute.Int("password.parallelism", int(hashInfo.Parallelism)),
+		)
+	} else {
+		verifySpan.SetAttributes(attribute.String("password.algorithm", "unknown"))
+	}
+
 	if !verifyPassword(user.Password, loginReq.Password) {
 		verifySpan.SetStatus(codes.Error, "Invalid password")
 		verifySpan.End()
 		span.SetStatus(codes.Error, "Invalid password")
+		recordLoginFailure()
 
 		Logger.InfoContext(ctx, "Login failed - invalid password",
 			slog.String("email", loginReq.Email),
@@ -250,9 +359,126 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+	if user.DisabledAt != nil {
+		verifySpan.SetStatus(codes.Error, "Account disabled")
+		verifySpan.End()
+		span.SetStatus(codes.Error, "Account disabled")
+		span.AddEvent("login.account_disabled")
+
+		Logger.WarnContext(ctx, "Login blocked - account disabled",
+			slog.String("email", loginReq.Email),
+			slog.Int("user_id", int(user.ID)),
+			slog.Time("disabled_at", *user.DisabledAt),
+			slog.String("disabled_reason", user.DisabledReason),
+		)
+
+		outcome = "account_disabled"
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Success: false,
+			Message: "This account has been disabled",
+			Error:   "ACCOUNT_DISABLED",
+		})
+		return
+	}
+	if emailVerificationRequired && user.EmailVerifiedAt == nil {
+		verifySpan.SetStatus(codes.Error, "Email not verified")
+		verifySpan.End()
+		span.SetStatus(codes.Error, "Email not verified")
+
+		Logger.InfoContext(ctx, "Login blocked - email not verified",
+			slog.String("email", loginReq.Email),
+			slog.Int("user_id", int(user.ID)),
+		)
+
+		outcome = "email_not_verified"
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Success: false,
+			Message: "Email address has not been verified",
+			Error:   "EMAIL_NOT_VERIFIED",
+		})
+		return
+	}
+
+	needsRehash := passwordNeedsRehash(user.Password)
+	verifySpan.SetAttributes(attribute.Bool("password.needs_rehash", needsRehash))
 	verifySpan.SetStatus(codes.Ok, "Password verified successfully")
 	verifySpan.End()
 
+	if needsRehash {
+		rehashCtx, rehashSpan := tracer.Start(ctx, "auth.login.rehash_password",
+			trace.WithAttributes(
+				attribute.String("operation", "password_rehash"),
+				attribute.Int("user_id", int(user.ID)),
+				attribute.String("password.algorithm", passwordHashAlgorithm),
+				attribute.Int("password.memory_kib", int(passwordParams.Memory)),
+				attribute.Int("password.iterations", int(passwordParams.Iterations)),
+				attribute.Int("password.parallelism", int(passwordParams.Parallelism)),
+			),
+		)
+
+		// A failed upgrade must not block the login; the old hash is still valid
+		// and the upgrade will be retried on the next successful login.
+		rehashed, err := hashPassword(loginReq.Password)
+		if err == nil {
+			err = DB.WithContext(rehashCtx).Model(&user).Update("password", rehashed).Error
+		}
+		if err != nil {
+			rehashSpan.RecordError(err)
+			rehashSpan.SetStatus(codes.Error, "Password rehash failed")
+
+			Logger.WarnContext(ctx, "Password rehash failed",
+				slog.Int("user_id", int(user.ID)),
+				slog.String("error", err.Error()),
+			)
+		} else {
+			rehashSpan.SetStatus(codes.Ok, "Password rehashed successfully")
+
+			Logger.InfoContext(ctx, "Password hash upgraded",
+				slog.Int("user_id", int(user.ID)),
+			)
+		}
+		rehashSpan.End()
+	}
+
+	if user.TwoFactorEnabledAt != nil {
+		challenge, err := createTwoFactorChallenge(ctx, &user, r)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Two-factor challenge failed")
+
+			Logger.ErrorContext(ctx, "Failed to create two-factor challenge",
+				slog.Int("user_id", int(user.ID)),
+				slog.String("error", err.Error()),
+			)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(ErrorResponse{
+				Success: false,
+				Message: "Login failed",
+				Error:   "DB_ERROR",
+			})
+			return
+		}
+
+		outcome = "two_factor_required"
+		span.SetStatus(codes.Ok, "Two-factor challenge issued")
+		span.SetAttributes(attribute.Int("user_id", int(user.ID)))
+
+		Logger.InfoContext(ctx, "Password accepted, two-factor code required",
+			slog.Int("user_id", int(user.ID)),
+		)
+
+		json.NewEncoder(w).Encode(AuthResponse{
+			Success:           true,
+			Message:           "Two-factor authentication required",
+			TwoFactorRequired: true,
+			Challenge:         challenge,
+		})
+		return
+	}
+
 	ctx, tokenSpan := tracer.Start(ctx, "auth.login.generate_token",
 		trace.WithAttributes(
 			attribute.String("operation", "jwt_generation"),
@@ -260,7 +486,7 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 		),
 	)
 
-	token, err := generateJWT(&user)
+	token, refreshToken, err := issueSession(ctx, &user, r)
 	if err != nil {
 		tokenSpan.RecordError(err)
 		tokenSpan.SetStatus(codes.Error, "Token generation failed")
@@ -293,6 +519,9 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 		)
 	}
 
+	loginLimiter.recordSuccess(throttleKey)
+	outcome = "success"
+
 	span.SetStatus(codes.Ok, "Login successful")
 	span.SetAttributes(
 		attribute.Int("user_id", int(user.ID)),
@@ -308,10 +537,12 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 	)
 
 	json.NewEncoder(w).Encode(AuthResponse{
-		Success: true,
-		Message: "Login successful",
-		Token:   token,
-		User:    &user,
+		Success:      true,
+		Message:      "Login successful",
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(jwtTTL.Seconds()),
+		User:         &user,
 	})
 }
 
@@ -406,24 +637,25 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 		),
 	)
 
-	if req.Email == "" || req.Password == "" || req.Username == "" {
-		validateSpan.SetStatus(codes.Error, "Missing required fields")
+	req.Email = strings.TrimSpace(req.Email)
+	req.Username = strings.TrimSpace(req.Username)
+
+	var v Validator
+	v.Email("email", req.Email)
+	v.Username("username", req.Username)
+	v.Password("password", req.Password, req.Username, req.Email)
+	if !v.Valid() {
+		recordValidationFailure(validateSpan, v.Errors)
 		validateSpan.End()
-		span.SetStatus(codes.Error, "Missing required fields")
+		span.SetStatus(codes.Error, "Validation failed")
 
-		Logger.ErrorContext(ctx, "Registration validation failed - missing fields",
+		Logger.WarnContext(ctx, "Registration validation failed",
 			slog.String("email", req.Email),
 			slog.String("username", req.Username),
-			slog.Bool("email_empty", req.Email == ""),
-			slog.Bool("username_empty", req.Username == ""),
-			slog.Bool("password_empty", req.Password == ""),
+			slog.Int("invalid_fields", len(v.Errors)),
 		)
 
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(ErrorResponse{
-			Success: false,
-			Message: "Username, email, and password are required",
-		})
+		writeValidationError(w, v.Errors)
 		return
 	}
 	validateSpan.SetStatus(codes.Ok, "Request validated successfully")
@@ -462,6 +694,8 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 		emailCheckSpan.SetStatus(codes.Error, "Email already exists")
 		emailCheckSpan.End()
 
+		recordAuthEvent(ctx, r, 0, auditRegister, "email_taken", nil)
+
 		Logger.InfoContext(ctx, "Registration failed - email already exists",
 			slog.String("email", req.Email),
 			slog.Duration("db_duration", emailCheckDuration),
@@ -528,6 +762,8 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 		usernameCheckSpan.SetStatus(codes.Error, "Username already exists")
 		usernameCheckSpan.End()
 
+		recordAuthEvent(ctx, r, 0, auditRegister, "username_taken", nil)
+
 		Logger.InfoContext(ctx, "Registration failed - username already taken",
 			slog.String("username", req.Username),
 			slog.Duration("db_duration", usernameCheckDuration),
@@ -565,6 +801,10 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 	ctx, hashSpan := tracer.Start(ctx, "auth.register.hash_password",
 		trace.WithAttributes(
 			attribute.String("operation", "password_hashing"),
+			attribute.String("password.algorithm", passwordHashAlgorithm),
+			attribute.Int("password.memory_kib", int(passwordParams.Memory)),
+			attribute.Int("password.iterations", int(passwordParams.Iterations)),
+			attribute.Int("password.parallelism", int(passwordParams.Parallelism)),
 		),
 	)
 
@@ -653,6 +893,32 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 	)
 	createSpan.End()
 
+	// The mail span must hang off auth.register rather than the already
+	// finished step spans carried in ctx.
+	mailCtx, mailSpan := tracer.Start(trace.ContextWithSpan(ctx, span), "auth.register.send_verification_email",
+		trace.WithAttributes(
+			attribute.String("operation", "send_verification_email"),
+			attribute.Int("user_id", int(user.ID)),
+		),
+	)
+
+	verificationSent := true
+	if err := sendEmailVerification(mailCtx, user); err != nil {
+		verificationSent = false
+		mailSpan.RecordError(err)
+		mailSpan.SetStatus(codes.Error, "Verification email failed")
+
+		// The account exists at this point; the user can request a new
+		// link through /users/verify/resend.
+		Logger.ErrorContext(ctx, "Verification email failed",
+			slog.Int("user_id", int(user.ID)),
+			slog.String("error", err.Error()),
+		)
+	} else {
+		mailSpan.SetStatus(codes.Ok, "Verification email sent")
+	}
+	mailSpan.End()
+
 	if authDuration != nil {
 		authDuration.Record(ctx, time.Since(startTime).Seconds(),
 			metric.WithAttributes(append(baseAttrs,
@@ -662,6 +928,10 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 		)
 	}
 
+	recordAuthEvent(ctx, r, user.ID, auditRegister, "success", map[string]interface{}{
+		"verification_sent": verificationSent,
+	})
+
 	span.SetStatus(codes.Ok, "Registration successful")
 	span.SetAttributes(
 		attribute.Int("user_id", int(user.ID)),
@@ -677,10 +947,15 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 		slog.Duration("total_duration", time.Since(startTime)),
 	)
 
+	message := "Registration successful, check your email to verify your account"
+	if !verificationSent {
+		message = "Registration successful, but the verification email could not be sent"
+	}
+
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(AuthResponse{
 		Success: true,
-		Message: "Registration successful",
+		Message: message,
 		User:    user,
 	})
 }
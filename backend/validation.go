@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	passwordMinLength = getEnvInt("PASSWORD_MIN_LENGTH", 10)
+	passwordMaxLength = getEnvInt("PASSWORD_MAX_LENGTH", 128)
+)
+
+const (
+	usernameMinLength = 3
+	usernameMaxLength = 50
+	emailMaxLength    = 200
+)
+
+var (
+	usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+	symbolPattern   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.\-]{0,14}$`)
+	cryptoIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,63}$`)
+)
+
+var watchlistTypes = []string{"STOCK", "CRYPTO"}
+
+// FieldError describes why a single request field was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Validator collects field errors so a request reports every problem at
+// once instead of one per round trip.
+type Validator struct {
+	Errors []FieldError
+}
+
+func (v *Validator) Add(field, code, message string) {
+	v.Errors = append(v.Errors, FieldError{Field: field, Code: code, Message: message})
+}
+
+func (v *Validator) Valid() bool {
+	return len(v.Errors) == 0
+}
+
+// Required reports false, recording a REQUIRED error, when value is blank.
+func (v *Validator) Required(field, value string) bool {
+	if strings.TrimSpace(value) == "" {
+		v.Add(field, "REQUIRED", fmt.Sprintf("%s is required", field))
+		return false
+	}
+	return true
+}
+
+func (v *Validator) Email(field, value string) {
+	if !v.Required(field, value) {
+		return
+	}
+	if len(value) > emailMaxLength {
+		v.Add(field, "TOO_LONG", fmt.Sprintf("%s must be at most %d characters", field, emailMaxLength))
+		return
+	}
+	// ParseAddress also accepts display names ("Bob <bob@example.com>"), so
+	// the parsed address must be the whole input.
+	addr, err := mail.ParseAddress(value)
+	if err != nil || addr.Address != value || !strings.Contains(value[strings.LastIndex(value, "@")+1:], ".") {
+		v.Add(field, "INVALID_FORMAT", fmt.Sprintf("%s must be a valid email address", field))
+	}
+}
+
+func (v *Validator) Username(field, value string) {
+	if !v.Required(field, value) {
+		return
+	}
+	if len(value) < usernameMinLength || len(value) > usernameMaxLength {
+		v.Add(field, "INVALID_LENGTH", fmt.Sprintf("%s must be between %d and %d characters", field, usernameMinLength, usernameMaxLength))
+		return
+	}
+	if !usernamePattern.MatchString(value) {
+		v.Add(field, "INVALID_CHARACTERS", fmt.Sprintf("%s may only contain letters, digits, '.', '_' and '-', and must start with a letter or digit", field))
+	}
+}
+
+// Password applies the password policy. Identifiers are the user's username
+// and email, which the password may not contain.
+func (v *Validator) Password(field, value string, identifiers ...string) {
+	if !v.Required(field, value) {
+		return
+	}
+	if len(value) < passwordMinLength {
+		v.Add(field, "TOO_SHORT", fmt.Sprintf("%s must be at least %d characters", field, passwordMinLength))
+		return
+	}
+	if len(value) > passwordMaxLength {
+		v.Add(field, "TOO_LONG", fmt.Sprintf("%s must be at most %d characters", field, passwordMaxLength))
+		return
+	}
+
+	var hasLetter, hasDigit bool
+	for _, c := range value {
+		switch {
+		case unicode.IsLetter(c):
+			hasLetter = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		}
+	}
+	if !hasLetter || !hasDigit {
+		v.Add(field, "TOO_WEAK", fmt.Sprintf("%s must contain at least one letter and one digit", field))
+		return
+	}
+
+	lower := strings.ToLower(value)
+	for _, id := range identifiers {
+		id, _, _ = strings.Cut(strings.ToLower(id), "@")
+		if len(id) >= usernameMinLength && strings.Contains(lower, id) {
+			v.Add(field, "CONTAINS_IDENTIFIER", fmt.Sprintf("%s must not contain your username or email", field))
+			return
+		}
+	}
+}
+
+func (v *Validator) Symbol(field, value string) {
+	if !v.Required(field, value) {
+		return
+	}
+	if !symbolPattern.MatchString(value) {
+		v.Add(field, "INVALID_FORMAT", fmt.Sprintf("%s must be 1-15 letters, digits, '.' or '-'", field))
+	}
+}
+
+func (v *Validator) CryptoID(field, value string) {
+	if !v.Required(field, value) {
+		return
+	}
+	if !cryptoIDPattern.MatchString(value) {
+		v.Add(field, "INVALID_FORMAT", fmt.Sprintf("%s must be a lowercase CoinGecko id", field))
+	}
+}
+
+func (v *Validator) OneOf(field, value string, allowed []string) {
+	if !v.Required(field, value) {
+		return
+	}
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.Add(field, "INVALID_VALUE", fmt.Sprintf("%s must be one of %s", field, strings.Join(allowed, ", ")))
+}
+
+// recordValidationFailure adds one span event per invalid field and marks the
+// span as failed. Field values are left out since they may hold passwords.
+func recordValidationFailure(span trace.Span, errs []FieldError) {
+	fields := make([]string, 0, len(errs))
+	for _, e := range errs {
+		span.AddEvent("validation.field_invalid", trace.WithAttributes(
+			attribute.String("validation.field", e.Field),
+			attribute.String("validation.code", e.Code),
+		))
+		fields = append(fields, e.Field)
+	}
+	span.SetAttributes(attribute.StringSlice("validation.invalid_fields", fields))
+	span.SetStatus(codes.Error, "Validation failed")
+}
+
+func writeValidationError(w http.ResponseWriter, errs []FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Success: false,
+		Message: "Request validation failed",
+		Error:   "VALIDATION_FAILED",
+		Fields:  errs,
+	})
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// Verification is only required by default when mail goes out over SMTP:
+// with the file outbox nobody outside the server could open the link.
+var (
+	emailVerificationRequired = getEnvBool("EMAIL_VERIFICATION_REQUIRED", mailer.Transport() == "smtp")
+	emailVerificationTTL      = getEnvDuration("EMAIL_VERIFICATION_TTL", 24*time.Hour)
+	appBaseURL                = getEnv("APP_BASE_URL", "http://localhost:8000")
+)
+
+var (
+	errInvalidVerificationToken = errors.New("invalid or expired verification token")
+	errEmailTaken               = errors.New("email already in use")
+)
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+type ResendVerificationRequest struct {
+	Email string `json:"email"`
+}
+
+// sendEmailVerification replaces any outstanding account verification tokens
+// of the user with a new one and mails the verification link.
+func sendEmailVerification(ctx context.Context, user *User) error {
+	return sendVerificationLink(ctx, user, "")
+}
+
+// sendEmailChangeVerification mails a verification link to newEmail,
+// replacing the links of any earlier email change. The account email only
+// changes once that link is opened.
+func sendEmailChangeVerification(ctx context.Context, user *User, newEmail string) error {
+	return sendVerificationLink(ctx, user, newEmail)
+}
+
+func sendVerificationLink(ctx context.Context, user *User, newEmail string) error {
+	raw, hash, err := generateOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	// Account verification and email change links are replaced separately,
+	// so asking for one does not break a link of the other still in flight.
+	purpose := "email = ''"
+	if newEmail != "" {
+		purpose = "email <> ''"
+	}
+	err = DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&EmailVerificationToken{}).
+			Where("user_id = ? AND used_at IS NULL", user.ID).
+			Where(purpose).
+			Update("used_at", time.Now().UTC()).Error; err != nil {
+			return err
+		}
+		return tx.Create(&EmailVerificationToken{
+			UserID:    user.ID,
+			TokenHash: hash,
+			Email:     newEmail,
+			ExpiresAt: time.Now().UTC().Add(emailVerificationTTL),
+		}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("error storing verification token: %w", err)
+	}
+
+	link := fmt.Sprintf("%s/users/verify?token=%s", appBaseURL, url.QueryEscape(raw))
+	if newEmail != "" {
+		return sendMail(ctx, MailMessage{
+			To:      newEmail,
+			Subject: "Confirm your new Stock Tracker email address",
+			Body: fmt.Sprintf("Hi %s,\n\nConfirm that this is the new email address of your account by opening the link below:\n\n%s\n\nThe link expires in %s. If you did not request this change, ignore this email.\n",
+				user.Username, link, emailVerificationTTL),
+		})
+	}
+	return sendMail(ctx, MailMessage{
+		To:      user.Email,
+		Subject: "Verify your Stock Tracker account",
+		Body: fmt.Sprintf("Hi %s,\n\nConfirm your email address by opening the link below:\n\n%s\n\nThe link expires in %s.\n",
+			user.Username, link, emailVerificationTTL),
+	})
+}
+
+// sendEmailChangedNotice tells the previous address that the account email
+// was changed, so an owner who did not ask for it finds out.
+func sendEmailChangedNotice(ctx context.Context, user *User, previousEmail string) error {
+	return sendMail(ctx, MailMessage{
+		To:      previousEmail,
+		Subject: "Your Stock Tracker email address was changed",
+		Body: fmt.Sprintf("Hi %s,\n\nThe email address of your account was changed from %s to %s.\n\nIf you did not make this change, reset your password and contact support right away.\n",
+			user.Username, previousEmail, user.Email),
+	})
+}
+
+// consumeEmailVerification marks the account email as verified, or for an
+// email change token, switches the account to the new address and returns
+// the previous one.
+func consumeEmailVerification(ctx context.Context, raw string, r *http.Request) (*User, string, error) {
+	var user User
+	var previous string
+	err := DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var token EmailVerificationToken
+		err := tx.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashOpaqueToken(raw), time.Now().UTC()).
+			First(&token).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errInvalidVerificationToken
+		}
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		if err := tx.Model(&token).Update("used_at", now).Error; err != nil {
+			return err
+		}
+		if err := tx.First(&user, "id = ?", token.UserID).Error; err != nil {
+			return err
+		}
+
+		if token.Email != "" {
+			var taken int64
+			if err := tx.Model(&User{}).Where("email = ? AND id <> ?", token.Email, user.ID).
+				Count(&taken).Error; err != nil {
+				return err
+			}
+			if taken > 0 {
+				return errEmailTaken
+			}
+
+			previous = user.Email
+			if err := tx.Model(&user).Updates(map[string]interface{}{
+				"email":             token.Email,
+				"pending_email":     "",
+				"email_verified_at": now,
+			}).Error; err != nil {
+				return err
+			}
+			return recordAudit(ctx, tx, r, user.ID, user.ID, auditEmailChanged, map[string]interface{}{
+				"previousEmail": previous,
+			})
+		}
+
+		if user.EmailVerifiedAt == nil {
+			return tx.Model(&user).Update("email_verified_at", now).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &user, previous, nil
+}
+
+func verifyEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+
+	ctx, span := tracer.Start(ctx, "auth.verify_email",
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", "/users/verify"),
+			attribute.String("component", "auth_service"),
+			attribute.String("operation", "email_verification"),
+		),
+	)
+	defer span.End()
+
+	if httpRequestCount != nil {
+		httpRequestCount.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("endpoint", "verify"),
+			attribute.String("method", r.Method),
+			attribute.String("component", "auth_service"),
+		))
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" && r.Method == http.MethodPost {
+		var req VerifyEmailRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		token = req.Token
+	}
+	if token == "" {
+		span.SetStatus(codes.Error, "Missing verification token")
+		writeAuthError(w, http.StatusBadRequest, "Verification token is required", "MISSING_VERIFICATION_TOKEN")
+		return
+	}
+
+	user, previousEmail, err := consumeEmailVerification(ctx, token, r)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Email verification failed")
+
+		if errors.Is(err, errInvalidVerificationToken) {
+			Logger.InfoContext(ctx, "Email verification rejected - invalid or expired token")
+			writeAuthError(w, http.StatusBadRequest, "Invalid or expired verification token", "INVALID_VERIFICATION_TOKEN")
+			return
+		}
+		if errors.Is(err, errEmailTaken) {
+			Logger.InfoContext(ctx, "Email change rejected - address taken in the meantime")
+			writeAuthError(w, http.StatusConflict, "Email already in use", "EMAIL_TAKEN")
+			return
+		}
+
+		Logger.ErrorContext(ctx, "Database error during email verification",
+			slog.String("error", err.Error()),
+		)
+		writeAuthError(w, http.StatusInternalServerError, "Email verification failed", "DB_ERROR")
+		return
+	}
+
+	if previousEmail != "" {
+		if err := sendEmailChangedNotice(ctx, user, previousEmail); err != nil {
+			span.RecordError(err)
+			Logger.ErrorContext(ctx, "Failed to notify previous email address of the change",
+				slog.Int("user_id", user.ID),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+
+	span.SetStatus(codes.Ok, "Email verified")
+	span.SetAttributes(attribute.Int("user_id", user.ID))
+
+	Logger.InfoContext(ctx, "Email verified",
+		slog.Int("user_id", user.ID),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AuthResponse{
+		Success: true,
+		Message: "Email verified",
+		User:    user,
+	})
+}
+
+// rejectMailThrottled answers 429 when email or the client address has
+// asked for too many mails, and reports whether it did.
+func rejectMailThrottled(ctx context.Context, span trace.Span, w http.ResponseWriter, r *http.Request, email string) bool {
+	allowed, reason, retryAfter := mailLimiter.allow(normalizeLoginEmail(email), remoteHost(r.RemoteAddr))
+	if allowed {
+		return false
+	}
+	retrySeconds := int(math.Ceil(retryAfter.Seconds()))
+	span.AddEvent("mail.throttled", trace.WithAttributes(
+		attribute.String("throttle.reason", reason),
+		attribute.Int("throttle.retry_after_seconds", retrySeconds),
+	))
+	span.SetStatus(codes.Error, "Mail request throttled")
+
+	Logger.WarnContext(ctx, "Mail request throttled",
+		slog.String("remote_addr", r.RemoteAddr),
+		slog.String("reason", reason),
+		slog.Int("retry_after_seconds", retrySeconds),
+	)
+	w.Header().Set("Retry-After", strconv.Itoa(retrySeconds))
+	writeAuthError(w, http.StatusTooManyRequests, "Too many requests, try again later", strings.ToUpper(reason))
+	return true
+}
+
+// resendEmailVerification always answers the same way so it cannot be used
+// to find out which emails are registered.
+func resendEmailVerification(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	tracer := otel.Tracer("stock-tracker-app-tracer")
+
+	ctx, span := tracer.Start(ctx, "auth.resend_verification",
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", "/users/verify/resend"),
+			attribute.String("component", "auth_service"),
+			attribute.String("operation", "resend_email_verification"),
+		),
+	)
+	defer span.End()
+
+	if httpRequestCount != nil {
+		httpRequestCount.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("endpoint", "verify_resend"),
+			attribute.String("method", r.Method),
+			attribute.String("component", "auth_service"),
+		))
+	}
+
+	var req ResendVerificationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		span.SetStatus(codes.Error, "Missing email")
+		writeAuthError(w, http.StatusBadRequest, "Email is required", "MISSING_EMAIL")
+		return
+	}
+	if rejectMailThrottled(ctx, span, w, r, req.Email) {
+		return
+	}
+
+	var user User
+	err := DB.WithContext(ctx).Where("email = ?", req.Email).First(&user).Error
+	switch {
+	case err == nil && user.EmailVerifiedAt == nil:
+		if err := sendEmailVerification(ctx, &user); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Verification email failed")
+			Logger.ErrorContext(ctx, "Failed to resend verification email",
+				slog.Int("user_id", user.ID),
+				slog.String("error", err.Error()),
+			)
+		} else {
+			Logger.InfoContext(ctx, "Verification email resent",
+				slog.Int("user_id", user.ID),
+			)
+		}
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound):
+		span.RecordError(err)
+		Logger.ErrorContext(ctx, "Database error during verification resend",
+			slog.String("error", err.Error()),
+		)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(AuthResponse{
+		Success: true,
+		Message: "If the account exists and is not verified, a new verification email has been sent",
+	})
+}